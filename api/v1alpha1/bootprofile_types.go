@@ -0,0 +1,59 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// BootProfileSpec defines the boot configuration of the Inventories selected
+// by the profile.
+type BootProfileSpec struct {
+	// Selector selects the Inventories by their labels. An empty selector
+	// selects all Inventories.
+	Selector metav1.LabelSelector `json:"selector"`
+	// Priority decides between profiles selecting the same Inventory, the
+	// profile with the highest priority is used.
+	// +optional
+	Priority int32 `json:"priority,omitempty"`
+	// IPXE holds the iPXE parts by name, e.g. boot. They are templates like
+	// the keys of the ipxe-<uuid> ConfigMap.
+	// +optional
+	IPXE map[string]string `json:"ipxe,omitempty"`
+	// Ignition holds the butane templates by key, e.g. ignition-default, like
+	// the keys of the ipxe-<uuid> Secret.
+	// +optional
+	Ignition map[string]string `json:"ignition,omitempty"`
+	// IgnitionSecretRef references a Secret in the namespace of the profile
+	// holding further butane templates. Its keys take precedence over the ones
+	// of Ignition.
+	// +optional
+	IgnitionSecretRef *corev1.LocalObjectReference `json:"ignitionSecretRef,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:printcolumn:name="Priority",type=integer,JSONPath=`.spec.priority`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// BootProfile is the Schema for the bootprofiles API
+type BootProfile struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec BootProfileSpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// BootProfileList contains a list of BootProfile
+type BootProfileList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []BootProfile `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&BootProfile{}, &BootProfileList{})
+}
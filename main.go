@@ -4,21 +4,48 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"os"
 
 	"github.com/ironcore-dev/ipxe-service/pkg"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager/signals"
 )
 
 func main() {
 	fmt.Println("iPXE is stating ...")
 
+	ctx := signals.SetupSignalHandler()
 	conf := pkg.GetConf(pkg.ConfigFile)
+	logger := pkg.SetupLogger(conf.Log)
+	ctrllog.SetLogger(logger)
+	shutdownTracing, err := pkg.SetupTracing(ctx, conf.Tracing)
+	if err != nil {
+		logger.Error(err, "Failed to setup tracing")
+		os.Exit(1)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			logger.Error(err, "Failed to flush traces")
+		}
+	}()
 	k8sClient := pkg.NewK8sClient(nil, client.Options{})
+	if !conf.DisableCache {
+		if err := k8sClient.StartCache(ctx, conf); err != nil {
+			logger.Error(err, "Failed to start cache")
+			os.Exit(1)
+		}
+	}
 	ipxe := pkg.IPXE{
-		Config:    conf,
-		K8sClient: k8sClient,
+		Config:     conf,
+		ConfigFile: pkg.ConfigFile,
+		K8sClient:  k8sClient,
 	}
 
-	ipxe.Start()
+	if err := ipxe.Start(ctx); err != nil {
+		logger.Error(err, "Failed to run IPXE Server")
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,186 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	ipxev1alpha1 "github.com/ironcore-dev/ipxe-service/api/v1alpha1"
+	inventoryv1alpha4 "github.com/ironcore-dev/metal/apis/metal/v1alpha4"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// BootProfileConfig enables the BootProfiles in the configmap namespace. They
+// serve the iPXE and ignition parts of Inventories by label selector when the
+// ipxe-<uuid> ConfigMap or Secret of the machine has no such part. The
+// BootProfile CRD has to be installed when enabled.
+type BootProfileConfig struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+}
+
+// selectBootProfile returns the profile of profiles with the highest priority
+// selecting inventory, nil if none selects it. Profiles with the same highest
+// priority are a conflict, as the result would depend on the list order.
+func selectBootProfile(profiles []ipxev1alpha1.BootProfile, inventory *inventoryv1alpha4.Inventory) (*ipxev1alpha1.BootProfile, error) {
+	var selected []*ipxev1alpha1.BootProfile
+	for n := range profiles {
+		profile := &profiles[n]
+		selector, err := metav1.LabelSelectorAsSelector(&profile.Spec.Selector)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid selector of BootProfile %s", profile.Name)
+		}
+		if !selector.Matches(labels.Set(inventory.Labels)) {
+			continue
+		}
+		if len(selected) > 0 && profile.Spec.Priority < selected[0].Spec.Priority {
+			continue
+		}
+		if len(selected) > 0 && profile.Spec.Priority > selected[0].Spec.Priority {
+			selected = selected[:0]
+		}
+		selected = append(selected, profile)
+	}
+
+	switch len(selected) {
+	case 0:
+		return nil, nil
+	case 1:
+		return selected[0], nil
+	default:
+		var names []string
+		for _, profile := range selected {
+			names = append(names, profile.Name)
+		}
+		slices.Sort(names)
+		return nil, &ConflictError{
+			Kind:  "BootProfile",
+			Key:   fmt.Sprintf("priority %d for Inventory %s", selected[0].Spec.Priority, inventory.Name),
+			Names: names,
+		}
+	}
+}
+
+// getBootProfile returns the BootProfile of inventory, nil if profiles are
+// disabled or none selects it.
+func (i IPXE) getBootProfile(ctx context.Context, inventory *inventoryv1alpha4.Inventory) (*ipxev1alpha1.BootProfile, error) {
+	if !i.Config.BootProfiles.Enabled {
+		return nil, nil
+	}
+	profiles, err := i.K8sClient.getBootProfiles(ctx, i.Config.ConfigmapNS)
+	if err != nil {
+		return nil, err
+	}
+	profile, err := selectBootProfile(profiles, inventory)
+	if err != nil {
+		return nil, err
+	}
+	if profile != nil {
+		loggerFrom(ctx).V(1).Info("Selected BootProfile", "uuid", inventory.Name, "bootProfile", profile.Name)
+	}
+	return profile, nil
+}
+
+// readMachineIPXE reads part of the machine, from the ipxe-<uuid> ConfigMap or
+// its BootProfile. Without either the error of the ConfigMap is returned.
+func (i IPXE) readMachineIPXE(ctx context.Context, inventory *inventoryv1alpha4.Inventory, part string) ([]byte, string, error) {
+	configMapName := "ipxe-" + inventory.Name
+	configMap, err := i.K8sClient.getConfigMag(ctx, configMapName, i.Config.ConfigmapNS)
+	var notFoundErr *NotFoundError
+	if err != nil && !errors.As(err, &notFoundErr) {
+		return nil, sourceNone, err
+	}
+	if configMap != nil {
+		if data, ok := configMap.Data[part]; ok {
+			return []byte(data), sourceMachineConfigMap, nil
+		}
+		err = &KeyNotFoundError{Kind: "ConfigMap", Name: configMapName, Key: part}
+	}
+
+	profile, profileErr := i.getBootProfile(ctx, inventory)
+	if profileErr != nil {
+		return nil, sourceNone, profileErr
+	}
+	if profile != nil {
+		if data, ok := profile.Spec.IPXE[part]; ok {
+			return []byte(data), sourceBootProfile, nil
+		}
+		return nil, sourceNone, &KeyNotFoundError{Kind: "BootProfile", Name: profile.Name, Key: part}
+	}
+	return nil, sourceNone, err
+}
+
+// readMachineIgnition reads the ignition key of the machine, from the
+// ipxe-<uuid> Secret or its BootProfile. Without either the error of the
+// Secret is returned.
+func (i IPXE) readMachineIgnition(ctx context.Context, inventory *inventoryv1alpha4.Inventory, key string) ([]byte, string, error) {
+	secretName := "ipxe-" + inventory.Name
+	secret, err := i.K8sClient.getSecret(ctx, secretName, i.Config.ConfigmapNS)
+	var notFoundErr *NotFoundError
+	if err != nil && !errors.As(err, &notFoundErr) {
+		return nil, sourceNone, err
+	}
+	if secret != nil {
+		if data := secret.Data[key]; len(data) > 0 {
+			return data, sourceMachineSecret, nil
+		}
+		err = &KeyNotFoundError{Kind: "Secret", Name: secretName, Key: key}
+	}
+
+	profile, profileErr := i.getBootProfile(ctx, inventory)
+	if profileErr != nil {
+		return nil, sourceNone, profileErr
+	}
+	if profile == nil {
+		return nil, sourceNone, err
+	}
+	if ref := profile.Spec.IgnitionSecretRef; ref != nil {
+		secret, err := i.K8sClient.getSecret(ctx, ref.Name, profile.Namespace)
+		if err != nil {
+			return nil, sourceNone, err
+		}
+		if data := secret.Data[key]; len(data) > 0 {
+			return data, sourceBootProfile, nil
+		}
+	}
+	if data := profile.Spec.Ignition[key]; data != "" {
+		return []byte(data), sourceBootProfile, nil
+	}
+	return nil, sourceNone, &KeyNotFoundError{Kind: "BootProfile", Name: profile.Name, Key: key}
+}
+
+// getBootProfiles returns the BootProfiles in namespace.
+func (k K8sClient) getBootProfiles(ctx context.Context, namespace string) (_ []ipxev1alpha1.BootProfile, err error) {
+	ctx, span := startSpan(ctx, "getBootProfiles", attrNamespace.String(namespace))
+	defer func() { endSpan(span, err) }()
+
+	var profiles ipxev1alpha1.BootProfileList
+	err = k.listBootProfiles(ctx, &profiles, namespace)
+	if err != nil {
+		return nil, &UnavailableError{Err: errors.Wrapf(err, "Failed to list BootProfiles in namespace %s", namespace)}
+	}
+	return profiles.Items, nil
+}
+
+// listBootProfiles lists the BootProfiles from the cache and falls back to the
+// API server when the cache fails or is not started. An empty list is a valid
+// answer of the cache, most namespaces have no profiles.
+func (k K8sClient) listBootProfiles(ctx context.Context, profiles *ipxev1alpha1.BootProfileList, namespace string) (err error) {
+	defer observeLookup(profiles, time.Now(), &err)
+
+	if k.Cache != nil {
+		err := k.Cache.List(ctx, profiles, client.InNamespace(namespace))
+		if err == nil {
+			return nil
+		}
+		loggerFrom(ctx).Info("Failed to list BootProfiles from cache, fall back to API server", "error", err.Error())
+	}
+
+	return k.Client.List(ctx, profiles, client.InNamespace(namespace))
+}
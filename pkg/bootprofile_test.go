@@ -0,0 +1,137 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	ipxev1alpha1 "github.com/ironcore-dev/ipxe-service/api/v1alpha1"
+	inventoryv1alpha4 "github.com/ironcore-dev/metal/apis/metal/v1alpha4"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+var _ = Describe("Boot profiles", func() {
+	ctx := context.Background()
+	SetupTestData(ctx)
+
+	var profiled IPXE
+	BeforeEach(func() {
+		profiled = ipxe
+		profiled.Config.BootProfiles.Enabled = true
+	})
+
+	sampleProfile := func() *ipxev1alpha1.BootProfile {
+		profileYaml, err := os.ReadFile("../config/samples/bootprofile/compute.yaml")
+		Expect(err).NotTo(HaveOccurred())
+		profile := &ipxev1alpha1.BootProfile{}
+		Expect(yaml.NewYAMLOrJSONDecoder(bytes.NewReader(profileYaml), 100).Decode(profile)).To(Succeed())
+		return profile
+	}
+	createProfile := func(profile *ipxev1alpha1.BootProfile) {
+		Expect(ipxe.K8sClient.Client.Create(ctx, profile)).To(Succeed())
+		DeferCleanup(ipxe.K8sClient.Client.Delete, ctx, profile)
+	}
+	serve := func(url string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		profiled.getRouter().ServeHTTP(rr, requestFrom(url, validIP1))
+		return rr
+	}
+
+	It("Serves the parts of the profile", func() {
+		createProfile(sampleProfile())
+
+		rr := serve(fmt.Sprintf("/ipxe/%s/install", uuid))
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+		Expect(rr.Body.String()).To(ContainSubstring("echo Installing " + uuid))
+
+		rr = serve(fmt.Sprintf("/ignition/%s/install", uuid))
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+		Expect(rr.Body.String()).To(ContainSubstring("/etc/hostname"))
+
+		By("Preferring the parts of the machine")
+		rr = serve(fmt.Sprintf("/ipxe/%s/boot", uuid))
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+		expected, err := os.ReadFile("../config/samples/configmap/ipxe-f2175eb4-e203-11ec-b5d5-3a68dd76b473")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rr.Body.String()).To(Equal(string(expected)))
+
+		expectError(serve(fmt.Sprintf("/ipxe/%s/missing", uuid)), http.StatusNotFound, ErrorCodeKeyNotFound)
+	})
+
+	It("Reads ignition from the Secret of the profile", func() {
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "compute-ignition", Namespace: namespace},
+			Data: map[string][]byte{
+				"ignition-install": []byte("variant: fcos\nversion: 1.3.0\nstorage:\n  files:\n    - path: /etc/from-secret\n"),
+			},
+		}
+		Expect(ipxe.K8sClient.Client.Create(ctx, secret)).To(Succeed())
+		DeferCleanup(ipxe.K8sClient.Client.Delete, ctx, secret)
+		profile := sampleProfile()
+		profile.Spec.IgnitionSecretRef = &corev1.LocalObjectReference{Name: secret.Name}
+		createProfile(profile)
+
+		rr := serve(fmt.Sprintf("/ignition/%s/install", uuid))
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+		Expect(rr.Body.String()).To(ContainSubstring("/etc/from-secret"))
+	})
+
+	It("Ignores profiles when disabled", func() {
+		createProfile(sampleProfile())
+		profiled.Config.BootProfiles.Enabled = false
+		expectError(serve(fmt.Sprintf("/ipxe/%s/install", uuid)), http.StatusNotFound, ErrorCodeKeyNotFound)
+	})
+
+	It("Rejects profiles with the same priority", func() {
+		createProfile(sampleProfile())
+		other := sampleProfile()
+		other.Name = "compute-rescue"
+		createProfile(other)
+		expectError(serve(fmt.Sprintf("/ipxe/%s/install", uuid)), http.StatusConflict, ErrorCodeConflict)
+	})
+
+	It("Selects the profile with the highest priority", func() {
+		inventory := &inventoryv1alpha4.Inventory{
+			ObjectMeta: metav1.ObjectMeta{Name: uuid, Labels: map[string]string{"rack": "a", "size": "m"}},
+		}
+		profile := func(name string, priority int32, matchLabels map[string]string) ipxev1alpha1.BootProfile {
+			return ipxev1alpha1.BootProfile{
+				ObjectMeta: metav1.ObjectMeta{Name: name},
+				Spec: ipxev1alpha1.BootProfileSpec{
+					Selector: metav1.LabelSelector{MatchLabels: matchLabels},
+					Priority: priority,
+				},
+			}
+		}
+
+		selected, err := selectBootProfile([]ipxev1alpha1.BootProfile{
+			profile("all", 0, nil),
+			profile("rack", 20, map[string]string{"rack": "a"}),
+			profile("other-rack", 30, map[string]string{"rack": "b"}),
+			profile("size", 10, map[string]string{"size": "m"}),
+		}, inventory)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(selected.Name).To(Equal("rack"))
+
+		selected, err = selectBootProfile([]ipxev1alpha1.BootProfile{profile("other-rack", 30, map[string]string{"rack": "b"})}, inventory)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(selected).To(BeNil())
+
+		_, err = selectBootProfile([]ipxev1alpha1.BootProfile{
+			profile("size", 10, map[string]string{"size": "m"}),
+			profile("all", 10, nil),
+			profile("none", 0, nil),
+		}, inventory)
+		Expect(err).To(MatchError("More than one BootProfile has priority 10 for Inventory " + uuid + ": all, size"))
+	})
+})
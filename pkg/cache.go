@@ -0,0 +1,135 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	ipamv1alpha1 "github.com/ironcore-dev/ipam/api/ipam/v1alpha1"
+	ipxev1alpha1 "github.com/ironcore-dev/ipxe-service/api/v1alpha1"
+	inventoryv1alpha4 "github.com/ironcore-dev/metal/apis/metal/v1alpha4"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	IPLabelIndex         = "metadata.labels.ip"
+	IPMacLabelIndex      = "metadata.labels.mac"
+	InventoryMacIndex    = "metadata.labels.mac-address"
+	InventorySerialIndex = "spec.system.serialNumber"
+	InventoryAssetIndex  = "metadata.labels.asset"
+	ipLabel              = "ip"
+	macLabel             = "mac"
+)
+
+var ipLabelIndexes = map[string]string{
+	ipLabel:  IPLabelIndex,
+	macLabel: IPMacLabelIndex,
+}
+
+// cachedObjects are the types served from the informer cache. Informers for
+// them are created up front, so the cache is fully synced before serving.
+var cachedObjects = []client.Object{
+	&ipamv1alpha1.IP{},
+	&ipamv1alpha1.Subnet{},
+	&inventoryv1alpha4.Inventory{},
+	&corev1.ConfigMap{},
+	&corev1.Secret{},
+}
+
+// StartCache creates the shared informers for IPAM IPs and Subnets,
+// Inventories, ConfigMaps, Secrets and, if enabled, BootProfiles in the
+// namespaces of the config, starts them and blocks until they are synced.
+// Afterwards reads of K8sClient are served from the cache.
+func (k *K8sClient) StartCache(ctx context.Context, conf Config) error {
+	namespaces := map[string]cache.Config{}
+	for _, ns := range []string{conf.ConfigmapNS, conf.IpamNS, conf.InventoryNS} {
+		// an empty namespace means all namespaces
+		if ns == "" {
+			namespaces = nil
+			break
+		}
+		namespaces[ns] = cache.Config{}
+	}
+
+	c, err := cache.New(k.restConfig, cache.Options{
+		Scheme:            k.Client.Scheme(),
+		Mapper:            k.Client.RESTMapper(),
+		DefaultNamespaces: namespaces,
+	})
+	if err != nil {
+		return errors.Wrap(err, "Failed to create cache")
+	}
+
+	if err := addIndexes(ctx, c); err != nil {
+		return err
+	}
+	objects := cachedObjects
+	if conf.BootProfiles.Enabled {
+		objects = append(slices.Clone(objects), &ipxev1alpha1.BootProfile{})
+	}
+	for _, obj := range objects {
+		if _, err := c.GetInformer(ctx, obj); err != nil {
+			return errors.Wrapf(err, "Failed to get informer for %T", obj)
+		}
+	}
+
+	go func() {
+		if err := c.Start(ctx); err != nil {
+			logger.Error(err, "Cache stopped")
+		}
+	}()
+
+	logger.Info("Waiting for cache to sync")
+	if !c.WaitForCacheSync(ctx) {
+		return errors.New("Failed to sync cache")
+	}
+	logger.Info("Cache is synced")
+
+	k.Cache = c
+	return nil
+}
+
+func addIndexes(ctx context.Context, c cache.Cache) error {
+	err := c.IndexField(ctx, &ipamv1alpha1.IP{}, IPLabelIndex, labelIndexer(ipLabel))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to add index %s", IPLabelIndex)
+	}
+	err = c.IndexField(ctx, &ipamv1alpha1.IP{}, IPMacLabelIndex, labelIndexer(macLabel))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to add index %s", IPMacLabelIndex)
+	}
+	for _, lookup := range inventoryLookups {
+		err = c.IndexField(ctx, &inventoryv1alpha4.Inventory{}, lookup.index, lookup.indexer)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to add index %s", lookup.index)
+		}
+	}
+
+	return nil
+}
+
+func labelIndexer(label string) client.IndexerFunc {
+	return func(obj client.Object) []string {
+		value, ok := obj.GetLabels()[label]
+		if !ok || value == "" {
+			return nil
+		}
+		return []string{value}
+	}
+}
+
+func inventoryMacIndexer(obj client.Object) []string {
+	var macs []string
+	for label := range obj.GetLabels() {
+		if strings.HasPrefix(label, InventoryMacLabelPrefix) {
+			macs = append(macs, strings.TrimPrefix(label, InventoryMacLabelPrefix))
+		}
+	}
+	return macs
+}
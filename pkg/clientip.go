@@ -0,0 +1,164 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Headers carrying the client address, one of them is set by the trusted
+// proxies.
+const (
+	HeaderForwarded     = "Forwarded"
+	HeaderXForwardedFor = "X-Forwarded-For"
+	HeaderXRealIP       = "X-Real-IP"
+)
+
+// validateForwardHeader checks that header is one of the forwarding headers,
+// empty means X-Forwarded-For.
+func validateForwardHeader(header string) error {
+	for _, known := range []string{"", HeaderForwarded, HeaderXForwardedFor, HeaderXRealIP} {
+		if strings.EqualFold(header, known) {
+			return nil
+		}
+	}
+	return errors.Errorf("Invalid forward-header %s, use %s, %s or %s", header, HeaderForwarded, HeaderXForwardedFor, HeaderXRealIP)
+}
+
+// parseTrustedProxies parses a list of CIDRs or single addresses.
+func parseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			addr, err := netip.ParseAddr(proxy)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Invalid trusted proxy %s", proxy)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid trusted proxy %s", proxy)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func isTrusted(addr netip.Addr, trusted []netip.Prefix) bool {
+	for _, prefix := range trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// getIP returns the address of the client. The forwarding header is only
+// used when the peer is a trusted proxy, without trusted proxies it is
+// ignored. Only the header set by the proxies is read, its chain is walked
+// from right to left and the first address which is not a trusted proxy is
+// the client.
+func (i IPXE) getIP(r *http.Request) (string, error) {
+	peer, err := peerIP(r)
+	if err != nil {
+		return "", err
+	}
+	if i.Config.DisableForwardHeader || len(i.Config.TrustedProxies) == 0 {
+		return peer.String(), nil
+	}
+
+	// the config is validated when it is loaded
+	trusted, _ := parseTrustedProxies(i.Config.TrustedProxies)
+	if !isTrusted(peer, trusted) {
+		return peer.String(), nil
+	}
+
+	var chain []string
+	switch {
+	case strings.EqualFold(i.Config.ForwardHeader, HeaderForwarded):
+		chain = forwardedFor(r.Header.Values(HeaderForwarded))
+	case strings.EqualFold(i.Config.ForwardHeader, HeaderXRealIP):
+		if realIP := r.Header.Get(HeaderXRealIP); realIP != "" {
+			chain = []string{realIP}
+		}
+	default:
+		chain = splitList(r.Header.Values(HeaderXForwardedFor))
+	}
+
+	client := peer
+	for k := len(chain) - 1; k >= 0; k-- {
+		addr, err := parseHop(chain[k])
+		if err != nil {
+			return "", &RequestError{Reason: err.Error()}
+		}
+		client = addr
+		if !isTrusted(addr, trusted) {
+			break
+		}
+	}
+
+	return client.String(), nil
+}
+
+// peerIP returns the address of the direct peer of the connection.
+func peerIP(r *http.Request) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, &RequestError{Reason: err.Error()}
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, &RequestError{Reason: err.Error()}
+	}
+	return addr.Unmap().WithZone(""), nil
+}
+
+// parseHop parses an address of a forwarding header, which may carry a port
+// and, in Forwarded, brackets around IPv6 addresses.
+func parseHop(hop string) (netip.Addr, error) {
+	hop = strings.TrimSpace(hop)
+	if addrPort, err := netip.ParseAddrPort(hop); err == nil {
+		return addrPort.Addr().Unmap().WithZone(""), nil
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, errors.Errorf("Invalid forwarded address %q", hop)
+	}
+	return addr.Unmap().WithZone(""), nil
+}
+
+// splitList splits the comma separated values of all lines of a header.
+func splitList(values []string) []string {
+	var list []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			if element = strings.TrimSpace(element); element != "" {
+				list = append(list, element)
+			}
+		}
+	}
+	return list
+}
+
+// forwardedFor returns the for parameters of the RFC 7239 Forwarded header
+// in order, e.g. for=192.0.2.60;proto=http, for="[2001:db8::1]:4711".
+func forwardedFor(values []string) []string {
+	var list []string
+	for _, element := range splitList(values) {
+		for _, pair := range strings.Split(element, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(key, "for") {
+				list = append(list, strings.Trim(value, `"`))
+			}
+		}
+	}
+	return list
+}
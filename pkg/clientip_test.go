@@ -0,0 +1,163 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Client IP", func() {
+	proxied := IPXE{Config: Config{TrustedProxies: []string{"10.0.0.0/8", "fd00:1::/64", "192.0.2.1"}}}
+
+	newRequest := func(remoteAddr string, headers ...string) *http.Request {
+		req := httptest.NewRequest("GET", "/ipxe", nil)
+		req.RemoteAddr = remoteAddr
+		for k := 0; k < len(headers); k += 2 {
+			req.Header.Add(headers[k], headers[k+1])
+		}
+		return req
+	}
+
+	It("Finds the client in the forwarding header of trusted proxies", func() {
+		forwarded := proxied
+		forwarded.Config.ForwardHeader = HeaderForwarded
+		realIP := proxied
+		realIP.Config.ForwardHeader = "x-real-ip"
+		for _, c := range []struct {
+			ipxe   IPXE
+			req    *http.Request
+			client string
+		}{
+			{proxied, newRequest("10.0.0.1:80"), "10.0.0.1"},
+			{proxied, newRequest("10.0.0.1:80", HeaderXForwardedFor, "198.51.100.7"), "198.51.100.7"},
+			{proxied, newRequest("10.0.0.1:80", HeaderXForwardedFor, "198.51.100.7, 10.0.0.2"), "198.51.100.7"},
+			{proxied, newRequest("10.0.0.1:80", HeaderXForwardedFor, "198.51.100.7", HeaderXForwardedFor, "10.0.0.2, 10.0.0.3"), "198.51.100.7"},
+			{proxied, newRequest("10.0.0.1:80", HeaderXForwardedFor, "10.0.0.5, 10.0.0.2"), "10.0.0.5"},
+			{proxied, newRequest("192.0.2.1:80", HeaderXForwardedFor, "fd00::b:1"), "fd00::b:1"},
+			{proxied, newRequest("[fd00:1::1]:80", HeaderXForwardedFor, "::ffff:198.51.100.7"), "198.51.100.7"},
+			{forwarded, newRequest("10.0.0.1:80", HeaderForwarded, `for=198.51.100.7;proto=http, for=10.0.0.2`), "198.51.100.7"},
+			{forwarded, newRequest("10.0.0.1:80", HeaderForwarded, `for="[fd00::b:1]:4711";proto=https`), "fd00::b:1"},
+			{forwarded, newRequest("10.0.0.1:80", HeaderForwarded, `For=198.51.100.7:8080`), "198.51.100.7"},
+			{realIP, newRequest("10.0.0.1:80", HeaderXRealIP, "198.51.100.7"), "198.51.100.7"},
+		} {
+			ip, err := c.ipxe.getIP(c.req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ip).To(Equal(c.client), fmt.Sprintf("%v", c.req.Header))
+		}
+	})
+
+	It("Reads only the header of the trusted proxies", func() {
+		// the proxy appends to X-Forwarded-For and passes the Forwarded
+		// header of the client through
+		ip, err := proxied.getIP(newRequest("10.0.0.1:80", HeaderForwarded, "for="+validIP1, HeaderXForwardedFor, "198.51.100.9"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip).To(Equal("198.51.100.9"))
+
+		ip, err = proxied.getIP(newRequest("10.0.0.1:80", HeaderXRealIP, validIP1))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip).To(Equal("10.0.0.1"))
+
+		forwarded := proxied
+		forwarded.Config.ForwardHeader = HeaderForwarded
+		ip, err = forwarded.getIP(newRequest("10.0.0.1:80", HeaderXForwardedFor, validIP1, HeaderForwarded, "for=198.51.100.9"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip).To(Equal("198.51.100.9"))
+
+		Expect(validateForwardHeader("")).To(Succeed())
+		Expect(validateForwardHeader("forwarded")).To(Succeed())
+		Expect(validateForwardHeader("X-Client-IP")).ToNot(Succeed())
+	})
+
+	It("Ignores spoofed addresses", func() {
+		for _, c := range []struct {
+			req    *http.Request
+			client string
+		}{
+			// headers of untrusted peers
+			{newRequest("198.51.100.9:80", HeaderXForwardedFor, validIP1), "198.51.100.9"},
+			{newRequest("198.51.100.9:80", HeaderForwarded, "for=127.0.0.1"), "198.51.100.9"},
+			{newRequest("198.51.100.9:80", HeaderXRealIP, validIP1), "198.51.100.9"},
+			{newRequest("192.0.2.2:80", HeaderXForwardedFor, validIP1), "192.0.2.2"},
+			// addresses prepended by the client to the chain of a trusted proxy
+			{newRequest("10.0.0.1:80", HeaderXForwardedFor, validIP1+", 198.51.100.9"), "198.51.100.9"},
+			{newRequest("10.0.0.1:80", HeaderXForwardedFor, "10.0.0.7, 198.51.100.9, 10.0.0.2"), "198.51.100.9"},
+			{newRequest("10.0.0.1:80", HeaderXForwardedFor, "127.0.0.1, 198.51.100.9"), "198.51.100.9"},
+		} {
+			ip, err := proxied.getIP(c.req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ip).To(Equal(c.client), fmt.Sprintf("%v", c.req.Header))
+		}
+	})
+
+	It("Ignores forwarding headers when disabled", func() {
+		disabled := proxied
+		disabled.Config.DisableForwardHeader = true
+		ip, err := disabled.getIP(newRequest("10.0.0.1:80", HeaderXForwardedFor, "198.51.100.7"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip).To(Equal("10.0.0.1"))
+
+		disabled = IPXE{Config: Config{DisableForwardHeader: true}}
+		ip, err = disabled.getIP(newRequest("10.0.0.1:80", HeaderXForwardedFor, "198.51.100.7"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ip).To(Equal("10.0.0.1"))
+	})
+
+	It("Ignores forwarding headers without trusted proxies", func() {
+		for _, req := range []*http.Request{
+			newRequest("198.51.100.9:80"),
+			newRequest("198.51.100.9:80", HeaderXForwardedFor, validIP1),
+			newRequest("198.51.100.9:80", HeaderXForwardedFor, "198.51.100.7, 10.0.0.2"),
+		} {
+			ip, err := IPXE{}.getIP(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ip).To(Equal("198.51.100.9"), fmt.Sprintf("%v", req.Header))
+		}
+	})
+
+	It("Rejects invalid addresses", func() {
+		for _, req := range []*http.Request{
+			newRequest("invalid"),
+			newRequest("10.0.0.1:80", HeaderXForwardedFor, "not-an-ip"),
+		} {
+			_, err := proxied.getIP(req)
+			Expect(err).To(BeAssignableToTypeOf(&RequestError{}))
+		}
+		forwarded := proxied
+		forwarded.Config.ForwardHeader = HeaderForwarded
+		_, err := forwarded.getIP(newRequest("10.0.0.1:80", HeaderForwarded, "for=unknown"))
+		Expect(err).To(BeAssignableToTypeOf(&RequestError{}))
+	})
+
+	It("Validates the trusted proxies", func() {
+		prefixes, err := parseTrustedProxies([]string{"10.0.0.1/8", "fd00::1", "::ffff:192.0.2.1"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(prefixes).To(HaveLen(3))
+		Expect(prefixes[0].String()).To(Equal("10.0.0.0/8"))
+		Expect(prefixes[1].String()).To(Equal("fd00::1/128"))
+		Expect(prefixes[2].String()).To(Equal("192.0.2.1/32"))
+
+		_, err = parseTrustedProxies([]string{"10.0.0.0/33"})
+		Expect(err).To(HaveOccurred())
+		_, err = parseTrustedProxies([]string{"proxy"})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Does not reload the config for forwarded loopback addresses", func() {
+		trustAll := ipxe
+		trustAll.Config.TrustedProxies = []string{"0.0.0.0/0", "::/0"}
+
+		rr := httptest.NewRecorder()
+		trustAll.reloadApp(rr, newRequest("198.51.100.9:80", HeaderXForwardedFor, "127.0.0.1"))
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusForbidden))
+
+		rr = httptest.NewRecorder()
+		trustAll.reloadApp(rr, newRequest("198.51.100.9:80", HeaderForwarded, "for=127.0.0.1"))
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusForbidden))
+	})
+})
@@ -0,0 +1,107 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	inventoryv1alpha4 "github.com/ironcore-dev/metal/apis/metal/v1alpha4"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Files of the NoCloud-net datasource of cloud-init. A machine is pointed at
+// them with the seed URL http://<host>/cloud-init/<uuid>/.
+const (
+	CloudInitUserData      = "user-data"
+	CloudInitMetaData      = "meta-data"
+	CloudInitVendorData    = "vendor-data"
+	CloudInitNetworkConfig = "network-config"
+)
+
+// CloudInitKeyPrefix prefixes the files in the ipxe-<uuid> Secret, BootProfiles
+// and the default config, e.g. cloud-init-user-data.
+const CloudInitKeyPrefix = "cloud-init-"
+
+// getCloudInit answers with a file of the NoCloud-net datasource of the machine
+// uuid, rendered with the ignition template data. The files are read from the
+// ipxe-<uuid> Secret or BootProfile of the machine and fall back to the default
+// config. Without meta-data one with the UUID and hostname is generated.
+func (i IPXE) getCloudInit(w http.ResponseWriter, r *http.Request) {
+	m := newRequestMetrics(r.Context(), requestCloudInitDuration, routeCloudInit)
+	defer m.observe()
+
+	params := mux.Vars(r)
+	uuid := params["uuid"]
+	file := params["file"]
+	log := loggerFrom(r.Context()).WithValues("uuid", uuid, "file", file)
+	trace.SpanFromContext(r.Context()).SetAttributes(attrUUID.String(uuid), attrPart.String(file))
+
+	inventory, mac, clientIP, err := i.verifyMachine(r, uuid)
+	if err != nil {
+		m.writeError(w, r, err)
+		return
+	}
+
+	key := CloudInitKeyPrefix + file
+	data, source, err := i.readCloudInit(r.Context(), inventory, key)
+	outcome := outcomeServed
+	if source == sourceDefaultSecret || source == sourceDefaultConfigMap {
+		outcome = outcomeDefault
+	}
+	var keyNotFoundErr *KeyNotFoundError
+	if errors.As(err, &keyNotFoundErr) && file == CloudInitMetaData {
+		data, source, outcome, err = []byte(cloudInitMetaData), sourceNone, outcomeDefault, nil
+	}
+	if err != nil {
+		m.writeError(w, r, err)
+		return
+	}
+
+	if file == CloudInitUserData {
+		log.Info("Render cloud-init", "source", source, "clientIP", clientIP)
+		i.K8sClient.EventRecorder.Eventf(inventory, corev1.EventTypeNormal, "CloudInit",
+			"Render cloud-init %s for client %s", file, clientIP)
+	}
+
+	cfg := i.ignitionTemplateData(r.Context(), uuid, mac, clientIP, inventory)
+	kubeconfigSecret, err := i.K8sClient.getSecret(r.Context(), fmt.Sprintf("kubeconfig-inventory-%s", uuid), i.Config.InventoryNS)
+	if err == nil {
+		cfg.Kubeconfig = string(kubeconfigSecret.Data["kubeconfig"])
+	}
+	body, err := renderTemplate(r.Context(), key, data, cfg)
+	if err != nil {
+		m.writeError(w, r, err)
+		return
+	}
+	log.V(1).Info("Rendered cloud-init", "source", source)
+	m.served(file, outcome, source)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err = w.Write(body)
+	if err != nil {
+		log.Error(err, "Failed to write cloud-init", "mac", mac)
+	}
+}
+
+// cloudInitMetaData is served if no meta-data is configured.
+const cloudInitMetaData = `instance-id: {{ .UUID }}
+local-hostname: {{ .Hostname }}
+`
+
+// readCloudInit reads key from the Secret or BootProfile of the machine and
+// falls back to the default config.
+func (i IPXE) readCloudInit(ctx context.Context, inventory *inventoryv1alpha4.Inventory, key string) ([]byte, string, error) {
+	data, source, err := i.readMachineIgnition(ctx, inventory, key)
+	var notFoundErr *NotFoundError
+	var keyNotFoundErr *KeyNotFoundError
+	if err == nil || (!errors.As(err, &notFoundErr) && !errors.As(err, &keyNotFoundErr)) {
+		return data, source, err
+	}
+	return readIpxeConfFile(key)
+}
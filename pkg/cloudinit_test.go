@@ -0,0 +1,78 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("cloud-init", func() {
+	ctx := context.Background()
+	SetupTestData(ctx)
+
+	serve := func(url, ip string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		ipxe.getRouter().ServeHTTP(rr, requestFrom(url, ip))
+		return rr
+	}
+	setSecretKey := func(key, value string) {
+		secret := &corev1.Secret{}
+		Expect(ipxe.K8sClient.Client.Get(ctx, client.ObjectKey{Name: "ipxe-" + uuid, Namespace: namespace}, secret)).To(Succeed())
+		secret.Data[key] = []byte(value)
+		Expect(ipxe.K8sClient.Client.Update(ctx, secret)).To(Succeed())
+	}
+
+	It("Serves the files of the machine", func() {
+		setSecretKey("cloud-init-user-data", "#cloud-config\nhostname: {{ .Hostname }}\n")
+		setSecretKey("cloud-init-network-config", "version: 2\nethernets:\n  id0:\n    match:\n      macaddress: {{ .NIC.MACAddress }}\n")
+
+		// a cached client sees the updates only once the informer got them
+		Eventually(func(g Gomega) {
+			rr := serve("/cloud-init/"+uuid+"/user-data", validIP1)
+			g.Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+			g.Expect(rr.Body.String()).To(Equal("#cloud-config\nhostname: " + uuid + "\n"))
+
+			rr = serve("/cloud-init/"+uuid+"/network-config", validIP1)
+			g.Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+			g.Expect(rr.Body.String()).To(ContainSubstring("macaddress: 08:c0:eb:a2:99:04"))
+		}).Should(Succeed())
+	})
+
+	It("Falls back to the defaults", func() {
+		rr := serve("/cloud-init/"+uuid+"/meta-data", validIP1)
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+		Expect(rr.Body.String()).To(Equal("instance-id: " + uuid + "\nlocal-hostname: " + uuid + "\n"))
+
+		rr = serve("/cloud-init/"+uuid+"/vendor-data", validIP1)
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+		expected, err := os.ReadFile("../config/samples/ipxe-default-cm/cloud-init-vendor-data")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rr.Body.String()).To(Equal(string(expected)))
+
+		expectError(serve("/cloud-init/"+uuid+"/user-data", validIP1), http.StatusNotFound, ErrorCodeKeyNotFound)
+
+		By("Preferring the meta-data of the machine")
+		setSecretKey("cloud-init-meta-data", "instance-id: {{ .UUID }}\nlocal-hostname: node-1\n")
+		Eventually(func(g Gomega) {
+			rr := serve("/cloud-init/"+uuid+"/meta-data", validIP1)
+			g.Expect(rr.Body.String()).To(Equal("instance-id: " + uuid + "\nlocal-hostname: node-1\n"))
+		}).Should(Succeed())
+	})
+
+	It("Serves the files only to the machine", func() {
+		expectError(serve("/cloud-init/"+uuid+"/meta-data", badIP), http.StatusForbidden, ErrorCodeUnknownClient)
+		expectError(serve("/cloud-init/"+emptyInventoryUUID+"/meta-data", validIP1), http.StatusForbidden, ErrorCodeMacMismatch)
+
+		rr := serve("/cloud-init/"+uuid+"/other", validIP1)
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusNotFound))
+	})
+})
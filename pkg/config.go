@@ -5,46 +5,111 @@ package pkg
 
 import (
 	"fmt"
-	"log"
 	"os"
 
+	"github.com/pkg/errors"
 	"gopkg.in/yaml.v1"
 )
 
 type Config struct {
-	ConfigmapNS          string `yaml:"configmap-namespace"`
-	IpamNS               string `yaml:"ipam-namespace"`
-	MachineRequestNS     string `yaml:"machine-request-namespace"`
-	InventoryNS          string `yaml:"inventory-namespace"`
-	ImageNS              string `yaml:"k8simage-namespace"`
-	DisableForwardHeader bool   `yaml:"disable-forward-header,omitempty"`
+	ConfigmapNS          string              `yaml:"configmap-namespace"`
+	IpamNS               string              `yaml:"ipam-namespace"`
+	MachineRequestNS     string              `yaml:"machine-request-namespace"`
+	InventoryNS          string              `yaml:"inventory-namespace"`
+	ImageNS              string              `yaml:"k8simage-namespace"`
+	DisableForwardHeader bool                `yaml:"disable-forward-header,omitempty"`
+	TrustedProxies       []string            `yaml:"trusted-proxies,omitempty"`
+	ForwardHeader        string              `yaml:"forward-header,omitempty"`
+	MacResolvers         MacResolverConfig   `yaml:"mac-resolvers,omitempty"`
+	IdentityChain        IdentityChainConfig `yaml:"identity-chain,omitempty"`
+	BootProfiles         BootProfileConfig   `yaml:"boot-profiles,omitempty"`
+	Rules                []Rule              `yaml:"rules,omitempty"`
+	DisableCache         bool                `yaml:"disable-cache,omitempty"`
+	TFTP                 TFTPConfig          `yaml:"tftp,omitempty"`
+	DHCP                 DHCPConfig          `yaml:"dhcp,omitempty"`
+	HTTP                 HTTPConfig          `yaml:"http,omitempty"`
+	TLS                  TLSConfig           `yaml:"tls,omitempty"`
+	Signing              SigningConfig       `yaml:"signing,omitempty"`
+	Log                  LogConfig           `yaml:"log,omitempty"`
+	Metrics              MetricsConfig       `yaml:"metrics,omitempty"`
+	Tracing              TracingConfig       `yaml:"tracing,omitempty"`
 }
 
 func GetConf(configFile string) Config {
+	c, err := LoadConf(configFile)
+	if err != nil {
+		logger.Error(err, "Failed to load config", "file", configFile)
+		os.Exit(1)
+	}
+	return c
+}
+
+// LoadConf reads the config from configFile. If the file can not be read,
+// the in-cluster namespace is used for everything.
+func LoadConf(configFile string) (Config, error) {
 	var c Config
 	yamlFile, err := os.ReadFile(configFile)
 	if err != nil {
-		log.Printf("Can not read config %s, err %s\n", ConfigFile, err)
+		logger.Info("Can not read config", "file", configFile, "error", err.Error())
 		ns, _ := getInClusterNamespace()
 		if len(ns) == 0 {
 			ns = "default"
 		}
-		log.Printf("Application will use namespace '%s' for everything\n", ns)
+		logger.Info("Application will use one namespace for everything", "namespace", ns)
 		c = Config{
 			ConfigmapNS:      ns,
 			IpamNS:           ns,
 			MachineRequestNS: ns,
 			InventoryNS:      ns,
 			ImageNS:          ns}
-		log.Printf("Config is #%+v ", c)
-		return c
+		logger.Info("Loaded config", "config", c)
+		return c, nil
 	}
-	err = yaml.Unmarshal(yamlFile, &c)
+	return parseConf(yamlFile)
+}
+
+// readConf reads the config from configFile. Unlike LoadConf it fails when
+// the file can not be read, so a reload keeps the current config.
+func readConf(configFile string) (Config, error) {
+	yamlFile, err := os.ReadFile(configFile)
 	if err != nil {
-		log.Fatalf("Unmarshal: %v", err)
+		return Config{}, errors.Wrap(err, "Failed to read config")
 	}
-	log.Printf("Config is #%+v ", c)
-	return c
+	return parseConf(yamlFile)
+}
+
+func parseConf(yamlFile []byte) (Config, error) {
+	var c Config
+	err := yaml.Unmarshal(yamlFile, &c)
+	if err != nil {
+		return Config{}, err
+	}
+	if _, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+		return Config{}, err
+	}
+	if err := validateForwardHeader(c.ForwardHeader); err != nil {
+		return Config{}, err
+	}
+	if len(c.TrustedProxies) == 0 && !c.DisableForwardHeader {
+		logger.Info("Forwarding headers are ignored, set trusted-proxies to the addresses of the proxies")
+	}
+	if c.HTTP.ProxyProtocol.Enabled && !c.DisableForwardHeader {
+		return Config{}, errors.New("PROXY protocol requires disable-forward-header")
+	}
+	if err := c.HTTP.validate(); err != nil {
+		return Config{}, err
+	}
+	if err := c.MacResolvers.validate(); err != nil {
+		return Config{}, err
+	}
+	if err := c.IdentityChain.validate(); err != nil {
+		return Config{}, err
+	}
+	if err := validateRules(c.Rules); err != nil {
+		return Config{}, err
+	}
+	logger.Info("Loaded config", "config", c)
+	return c, nil
 }
 
 func getInClusterNamespace() (string, error) {
@@ -6,10 +6,31 @@ package pkg
 import "time"
 
 const (
-	TimeoutSecond           = 5 * time.Second
-	ConfigFile              = "/etc/ipxe-service/config.yaml"
-	ServiceServerCert       = "ipxe-service-server-cert"
-	DefaultSecretPath       = "/etc/ipxe-default-secret"
-	DefaultConfigMapPath    = "/etc/ipxe-default-cm"
-	InventoryMacLabelPrefix = "metal.ironcore.dev/mac-address-"
+	TimeoutSecond            = 5 * time.Second
+	ConfigFile               = "/etc/ipxe-service/config.yaml"
+	ServiceServerCert        = "ipxe-service-server-cert"
+	DefaultSecretPath        = "/etc/ipxe-default-secret"
+	DefaultConfigMapPath     = "/etc/ipxe-default-cm"
+	InventoryMacLabelPrefix  = "metal.ironcore.dev/mac-address-"
+	InventoryAssetLabel      = "metal.ironcore.dev/asset-tag"
+	DefaultHTTPPort          = "8082"
+	DefaultHTTPSPort         = "8443"
+	DefaultTFTPAddress       = ":69"
+	DefaultTFTPScriptName    = "boot.ipxe"
+	DefaultBIOSBootFile      = "undionly.kpxe"
+	DefaultEFIBootFile       = "ipxe.efi"
+	DefaultIdentityChainPart = "boot"
+	ProxyDHCPPort            = 4011
+	DefaultARPFile           = "/proc/net/arp"
+	DefaultDnsmasqLeaseFile  = "/var/lib/misc/dnsmasq.leases"
+	DefaultISCLeaseFile      = "/var/lib/dhcp/dhcpd.leases"
+
+	DefaultReadTimeout       = 30 * time.Second
+	DefaultReadHeaderTimeout = 10 * time.Second
+	DefaultWriteTimeout      = 60 * time.Second
+	DefaultIdleTimeout       = 120 * time.Second
+	DefaultDrainPeriod       = 5 * time.Second
+	DefaultShutdownTimeout   = 30 * time.Second
+	DefaultKeaTimeout        = 2 * time.Second
+	DefaultLeaseCacheTTL     = 10 * time.Second
 )
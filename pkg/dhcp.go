@@ -0,0 +1,333 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/server4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/dhcpv6/server6"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/pkg/errors"
+)
+
+type DHCPConfig struct {
+	Enabled      bool   `yaml:"enabled,omitempty"`
+	DisableV4    bool   `yaml:"disable-v4,omitempty"`
+	DisableV6    bool   `yaml:"disable-v6,omitempty"`
+	Interface    string `yaml:"interface,omitempty"`
+	NextServer   string `yaml:"next-server,omitempty"`
+	NextServerV6 string `yaml:"next-server-v6,omitempty"`
+	BIOSBootFile string `yaml:"bios-boot-file,omitempty"`
+	EFIBootFile  string `yaml:"efi-boot-file,omitempty"`
+	BootURL      string `yaml:"boot-url,omitempty"`
+}
+
+// dhcpResponder answers proxyDHCP and DHCPv6 requests of known clients with
+// boot options only. It never hands out addresses: DHCPv6 Solicits are
+// answered with the status NoAddrsAvail and only Information-Requests get a
+// Reply, Requests are left to the DHCPv6 server handing out the addresses.
+type dhcpResponder struct {
+	ipxe     IPXE
+	serverIP net.IP
+	serverV6 net.IP
+	duid     dhcpv6.DUID
+}
+
+func (i IPXE) startDHCP(ctx context.Context) error {
+	d, err := i.newDHCPResponder()
+	if err != nil {
+		return errors.Wrap(err, "Failed to start DHCP responder")
+	}
+	conf := i.Config.DHCP
+
+	if !conf.DisableV4 {
+		for _, port := range []int{dhcpv4.ServerPort, ProxyDHCPPort} {
+			s, err := server4.NewServer(conf.Interface, &net.UDPAddr{IP: net.IPv4zero, Port: port}, d.dhcpv4Handler(port))
+			if err != nil {
+				return errors.Wrapf(err, "Failed to start proxyDHCP responder on port %d", port)
+			}
+			logger.Info("Start proxyDHCP responder", "port", port)
+			go func() {
+				if err := s.Serve(); err != nil {
+					logger.Error(err, "ProxyDHCP responder stopped")
+				}
+			}()
+			go closeOnDone(ctx, s)
+		}
+	}
+
+	if !conf.DisableV6 {
+		s, err := server6.NewServer(conf.Interface, nil, d.handleDHCPv6)
+		if err != nil {
+			return errors.Wrap(err, "Failed to start DHCPv6 responder")
+		}
+		logger.Info("Start DHCPv6 responder")
+		go func() {
+			if err := s.Serve(); err != nil {
+				logger.Error(err, "DHCPv6 responder stopped")
+			}
+		}()
+		go closeOnDone(ctx, s)
+	}
+	return nil
+}
+
+func closeOnDone(ctx context.Context, c io.Closer) {
+	<-ctx.Done()
+	_ = c.Close()
+}
+
+func (i IPXE) newDHCPResponder() (*dhcpResponder, error) {
+	conf := i.Config.DHCP
+	d := &dhcpResponder{
+		ipxe:     i,
+		serverIP: net.ParseIP(conf.NextServer),
+		serverV6: net.ParseIP(conf.NextServerV6),
+	}
+
+	if conf.Interface == "" {
+		if (!conf.DisableV4 && d.serverIP == nil) || !conf.DisableV6 {
+			return nil, errors.New("DHCP interface is required for DHCPv6 and without next-server")
+		}
+		return d, nil
+	}
+
+	iface, err := net.InterfaceByName(conf.Interface)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get interface %s", conf.Interface)
+	}
+	d.duid = &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: iface.HardwareAddr}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get addresses of interface %s", conf.Interface)
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if d.serverIP == nil && ipNet.IP.To4() != nil {
+			d.serverIP = ipNet.IP.To4()
+		}
+		if d.serverV6 == nil && ipNet.IP.To4() == nil && ipNet.IP.IsGlobalUnicast() {
+			d.serverV6 = ipNet.IP
+		}
+	}
+	if !conf.DisableV4 && d.serverIP == nil {
+		return nil, errors.New(fmt.Sprintf("No IPv4 address found on interface %s", conf.Interface))
+	}
+	if !conf.DisableV6 && d.serverV6 == nil {
+		return nil, errors.New(fmt.Sprintf("No global IPv6 address found on interface %s", conf.Interface))
+	}
+
+	return d, nil
+}
+
+// dhcpv4Handler returns the handler of the proxyDHCP responder on port.
+func (d *dhcpResponder) dhcpv4Handler(port int) server4.Handler {
+	return func(conn net.PacketConn, peer net.Addr, req *dhcpv4.DHCPv4) {
+		resp, err := d.proxyDHCPv4Reply(req, port)
+		if err != nil {
+			logger.Error(err, "Failed to answer proxyDHCP request", "mac", req.ClientHWAddr.String())
+			return
+		}
+		if resp == nil {
+			return
+		}
+
+		if udpAddr, ok := peer.(*net.UDPAddr); ok && udpAddr.IP.IsUnspecified() {
+			peer = &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}
+		}
+		if _, err := conn.WriteTo(resp.ToBytes(), peer); err != nil {
+			logger.Error(err, "Failed to send proxyDHCP answer", "type", resp.MessageType().String(), "peer", peer.String())
+		}
+	}
+}
+
+// proxyDHCPv4Reply returns the proxyDHCP answer for req received on port, or
+// nil when the request is not a PXE boot request of a client known to IPAM.
+// On the DHCP server port only Discovers are answered, and Requests which
+// are addressed to this server, so the exchange of the client with the DHCP
+// server handing out the address is left alone.
+func (d *dhcpResponder) proxyDHCPv4Reply(req *dhcpv4.DHCPv4, port int) (*dhcpv4.DHCPv4, error) {
+	var msgType dhcpv4.MessageType
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeDiscover:
+		if port != dhcpv4.ServerPort {
+			return nil, nil
+		}
+		msgType = dhcpv4.MessageTypeOffer
+	case dhcpv4.MessageTypeRequest:
+		if port == dhcpv4.ServerPort && !req.ServerIdentifier().Equal(d.serverIP) {
+			return nil, nil
+		}
+		msgType = dhcpv4.MessageTypeAck
+	default:
+		return nil, nil
+	}
+
+	// PXE clients, iPXE included, carry PXEClient in the vendor class
+	if !strings.HasPrefix(req.ClassIdentifier(), "PXEClient") {
+		return nil, nil
+	}
+	ipxeClient := isIPXEUserClass(req.UserClass())
+	if !d.isKnownMac(req.ClientHWAddr) {
+		return nil, nil
+	}
+
+	bootFile := d.bootFile(ipxeClient, req.ClientArch(), d.serverIP)
+	logger.Info("Answer proxyDHCP request", "type", msgType.String(), "bootFile", bootFile, "mac", req.ClientHWAddr.String())
+
+	resp, err := dhcpv4.NewReplyFromRequest(req,
+		dhcpv4.WithMessageType(msgType),
+		dhcpv4.WithServerIP(d.serverIP),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(d.serverIP)),
+		dhcpv4.WithOption(dhcpv4.OptClassIdentifier("PXEClient")),
+		dhcpv4.WithOption(dhcpv4.OptBootFileName(bootFile)),
+		// PXE discovery control: skip boot server discovery, use the boot file
+		dhcpv4.WithOption(dhcpv4.OptGeneric(dhcpv4.OptionVendorSpecificInformation, []byte{6, 1, 8, 255})),
+		dhcpv4.WithOptionCopied(req, dhcpv4.OptionClientMachineIdentifier),
+	)
+	if err != nil {
+		return nil, err
+	}
+	// older PXE ROMs only look at the boot file field of the BOOTP header
+	resp.BootFileName = bootFile
+
+	return resp, nil
+}
+
+func (d *dhcpResponder) handleDHCPv6(conn net.PacketConn, peer net.Addr, req dhcpv6.DHCPv6) {
+	resp, err := d.dhcpv6Reply(req)
+	if err != nil {
+		logger.Error(err, "Failed to answer DHCPv6 request", "peer", peer.String())
+		return
+	}
+	if resp == nil {
+		return
+	}
+
+	if _, err := conn.WriteTo(resp.ToBytes(), peer); err != nil {
+		logger.Error(err, "Failed to send DHCPv6 answer", "type", resp.Type().String(), "peer", peer.String())
+	}
+}
+
+// dhcpv6Reply returns the answer carrying the boot file URL (option 59) for
+// req, or nil when the client did not ask for it or is unknown to IPAM.
+func (d *dhcpResponder) dhcpv6Reply(req dhcpv6.DHCPv6) (dhcpv6.DHCPv6, error) {
+	msg, err := req.GetInnerMessage()
+	if err != nil {
+		return nil, err
+	}
+	if !msg.Options.RequestedOptions().Contains(dhcpv6.OptionBootfileURL) {
+		return nil, nil
+	}
+
+	mac, err := dhcpv6.ExtractMAC(req)
+	if err != nil {
+		logger.V(1).Info("Failed to get MAC of DHCPv6 client", "error", err.Error())
+		return nil, nil
+	}
+	if !d.isKnownMac(mac) {
+		return nil, nil
+	}
+
+	var userClasses []string
+	for _, userClass := range msg.Options.UserClasses() {
+		userClasses = append(userClasses, string(userClass))
+	}
+	ipxeClient := isIPXEUserClass(userClasses)
+	bootFile := d.bootFile(ipxeClient, msg.Options.ArchTypes(), d.serverV6)
+	if !ipxeClient {
+		bootFile = fmt.Sprintf("tftp://[%s]/%s", d.serverV6, bootFile)
+	}
+
+	modifiers := []dhcpv6.Modifier{
+		dhcpv6.WithServerID(d.duid),
+		dhcpv6.WithOption(dhcpv6.OptBootFileURL(bootFile)),
+	}
+	var resp *dhcpv6.Message
+	switch msg.Type() {
+	case dhcpv6.MessageTypeSolicit:
+		// like a proxyDHCP offer the Advertise has no addresses, the status
+		// NoAddrsAvail makes clients pick the real DHCPv6 server for them
+		modifiers = append(modifiers, dhcpv6.WithOption(noAddrsAvail()))
+		for _, ia := range msg.Options.IANA() {
+			modifiers = append(modifiers, dhcpv6.WithOption(&dhcpv6.OptIANA{
+				IaId:    ia.IaId,
+				Options: dhcpv6.IdentityOptions{Options: dhcpv6.Options{noAddrsAvail()}},
+			}))
+		}
+		resp, err = dhcpv6.NewAdvertiseFromSolicit(msg, modifiers...)
+	case dhcpv6.MessageTypeInformationRequest:
+		resp, err = dhcpv6.NewReplyFromMessage(msg, modifiers...)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Answer DHCPv6 request", "type", resp.Type().String(), "bootFile", bootFile, "mac", mac.String())
+
+	if relay, ok := req.(*dhcpv6.RelayMessage); ok {
+		return dhcpv6.NewRelayReplFromRelayForw(relay, resp)
+	}
+	return resp, nil
+}
+
+func noAddrsAvail() *dhcpv6.OptStatusCode {
+	return &dhcpv6.OptStatusCode{StatusCode: iana.StatusNoAddrsAvail, StatusMessage: "boot options only"}
+}
+
+// bootFile returns the /ipxe URL for iPXE clients and the name of the iPXE
+// binary matching the client architecture for PXE ROM clients.
+func (d *dhcpResponder) bootFile(ipxeClient bool, arches iana.Archs, serverIP net.IP) string {
+	config := d.ipxe.current().Config
+	conf := config.DHCP
+	if ipxeClient {
+		if conf.BootURL != "" {
+			return conf.BootURL
+		}
+		return config.ipxeURL(serverIP.String())
+	}
+
+	for _, arch := range arches {
+		if arch == iana.INTEL_X86PC {
+			if conf.BIOSBootFile != "" {
+				return conf.BIOSBootFile
+			}
+			return DefaultBIOSBootFile
+		}
+	}
+	if conf.EFIBootFile != "" {
+		return conf.EFIBootFile
+	}
+	return DefaultEFIBootFile
+}
+
+func (d *dhcpResponder) isKnownMac(mac net.HardwareAddr) bool {
+	ips, err := d.ipxe.K8sClient.getIPsFromMac(context.Background(), macLabelValue(mac), d.ipxe.current().Config.IpamNS)
+	if err != nil {
+		logger.Error(err, "Failed to look up mac", "mac", mac.String())
+		return false
+	}
+	return len(ips) > 0
+}
+
+func isIPXEUserClass(userClasses []string) bool {
+	for _, userClass := range userClasses {
+		if userClass == "iPXE" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,175 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"context"
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DHCP responder", func() {
+	Context("Boot options", func() {
+		ctx := context.Background()
+		SetupTestData(ctx)
+
+		knownMac, _ := net.ParseMAC("08:c0:eb:a2:99:04")
+		unknownMac, _ := net.ParseMAC("08:c0:eb:a2:99:ff")
+		responder := func() *dhcpResponder {
+			return &dhcpResponder{
+				ipxe:     ipxe,
+				serverIP: net.ParseIP("192.168.0.1").To4(),
+				serverV6: net.ParseIP("fd00:da8:fff6:3302::1"),
+				duid:     &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: knownMac},
+			}
+		}
+
+		It("ProxyDHCP offers the BIOS binary to a PXE ROM", func() {
+			req, err := dhcpv4.NewDiscovery(knownMac,
+				dhcpv4.WithOption(dhcpv4.OptClassIdentifier("PXEClient:Arch:00000:UNDI:002001")),
+				dhcpv4.WithOption(dhcpv4.OptClientArch(iana.INTEL_X86PC)))
+			Expect(err).ToNot(HaveOccurred())
+
+			resp, err := responder().proxyDHCPv4Reply(req, dhcpv4.ServerPort)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp).ToNot(BeNil())
+			Expect(resp.MessageType()).To(Equal(dhcpv4.MessageTypeOffer))
+			Expect(resp.YourIPAddr.IsUnspecified()).To(BeTrue())
+			Expect(resp.ServerIPAddr.String()).To(Equal("192.168.0.1"))
+			Expect(resp.BootFileNameOption()).To(Equal(DefaultBIOSBootFile))
+		})
+
+		It("ProxyDHCP offers the /ipxe url to iPXE", func() {
+			req, err := dhcpv4.NewDiscovery(knownMac,
+				dhcpv4.WithOption(dhcpv4.OptClassIdentifier("PXEClient:Arch:00007:UNDI:003010")),
+				dhcpv4.WithOption(dhcpv4.OptUserClass("iPXE")))
+			Expect(err).ToNot(HaveOccurred())
+
+			resp, err := responder().proxyDHCPv4Reply(req, dhcpv4.ServerPort)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp).ToNot(BeNil())
+			Expect(resp.BootFileNameOption()).To(Equal("http://192.168.0.1:8082/ipxe"))
+
+			By("Using the configured listener")
+			r := responder()
+			r.ipxe.Config.HTTP.Address = ":8080"
+			r.ipxe.Config.TLS = TLSConfig{Enabled: true, Address: ":443", DisablePlain: true}
+			resp, err = r.proxyDHCPv4Reply(req, dhcpv4.ServerPort)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.BootFileNameOption()).To(Equal("https://192.168.0.1:443/ipxe"))
+		})
+
+		It("ProxyDHCP acknowledges only Requests addressed to it", func() {
+			discover, err := dhcpv4.NewDiscovery(knownMac,
+				dhcpv4.WithOption(dhcpv4.OptClassIdentifier("PXEClient:Arch:00000:UNDI:002001")))
+			Expect(err).ToNot(HaveOccurred())
+			offer, err := dhcpv4.NewReplyFromRequest(discover,
+				dhcpv4.WithMessageType(dhcpv4.MessageTypeOffer),
+				dhcpv4.WithYourIP(net.ParseIP("192.168.0.23")),
+				dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.ParseIP("192.168.0.2"))))
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Ignoring the Request to the DHCP server")
+			req, err := dhcpv4.NewRequestFromOffer(offer,
+				dhcpv4.WithOption(dhcpv4.OptClassIdentifier("PXEClient:Arch:00000:UNDI:002001")))
+			Expect(err).ToNot(HaveOccurred())
+			resp, err := responder().proxyDHCPv4Reply(req, dhcpv4.ServerPort)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp).To(BeNil())
+
+			By("Answering the Request to the proxyDHCP server")
+			req.UpdateOption(dhcpv4.OptServerIdentifier(net.ParseIP("192.168.0.1")))
+			resp, err = responder().proxyDHCPv4Reply(req, dhcpv4.ServerPort)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.MessageType()).To(Equal(dhcpv4.MessageTypeAck))
+
+			By("Answering Requests on the proxyDHCP port")
+			req.Options.Del(dhcpv4.OptionServerIdentifier)
+			resp, err = responder().proxyDHCPv4Reply(req, ProxyDHCPPort)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.MessageType()).To(Equal(dhcpv4.MessageTypeAck))
+
+			By("Ignoring Discovers on the proxyDHCP port")
+			resp, err = responder().proxyDHCPv4Reply(discover, ProxyDHCPPort)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp).To(BeNil())
+		})
+
+		It("ProxyDHCP ignores unknown mac", func() {
+			req, err := dhcpv4.NewDiscovery(unknownMac,
+				dhcpv4.WithOption(dhcpv4.OptClassIdentifier("PXEClient")))
+			Expect(err).ToNot(HaveOccurred())
+
+			resp, err := responder().proxyDHCPv4Reply(req, dhcpv4.ServerPort)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp).To(BeNil())
+		})
+
+		It("DHCPv6 advertises the EFI binary to a PXE ROM", func() {
+			req, err := dhcpv6.NewSolicit(knownMac,
+				dhcpv6.WithRequestedOptions(dhcpv6.OptionBootfileURL),
+				dhcpv6.WithArchType(iana.EFI_X86_64))
+			Expect(err).ToNot(HaveOccurred())
+
+			resp, err := responder().dhcpv6Reply(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp).ToNot(BeNil())
+			Expect(resp.Type()).To(Equal(dhcpv6.MessageTypeAdvertise))
+			msg, err := resp.GetInnerMessage()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(msg.Options.BootFileURL()).To(Equal("tftp://[fd00:da8:fff6:3302::1]/ipxe.efi"))
+
+			By("Offering no addresses")
+			Expect(msg.Options.Status()).ToNot(BeNil())
+			Expect(msg.Options.Status().StatusCode).To(Equal(iana.StatusNoAddrsAvail))
+			Expect(msg.Options.OneIANA()).ToNot(BeNil())
+			Expect(msg.Options.OneIANA().Options.Addresses()).To(BeEmpty())
+			Expect(msg.Options.OneIANA().Options.Status().StatusCode).To(Equal(iana.StatusNoAddrsAvail))
+		})
+
+		It("DHCPv6 replies to Information-Requests of iPXE", func() {
+			req, err := dhcpv6.NewMessage(
+				dhcpv6.WithClientID(&dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: knownMac}),
+				dhcpv6.WithRequestedOptions(dhcpv6.OptionBootfileURL),
+				dhcpv6.WithUserClass([]byte("iPXE")))
+			Expect(err).ToNot(HaveOccurred())
+			req.MessageType = dhcpv6.MessageTypeInformationRequest
+
+			resp, err := responder().dhcpv6Reply(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp).ToNot(BeNil())
+			Expect(resp.Type()).To(Equal(dhcpv6.MessageTypeReply))
+			msg, err := resp.GetInnerMessage()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(msg.Options.BootFileURL()).To(Equal("http://[fd00:da8:fff6:3302::1]:8082/ipxe"))
+		})
+
+		It("DHCPv6 leaves Requests to the address server", func() {
+			r := responder()
+			req, err := dhcpv6.NewSolicit(knownMac, dhcpv6.WithRequestedOptions(dhcpv6.OptionBootfileURL))
+			Expect(err).ToNot(HaveOccurred())
+			req.MessageType = dhcpv6.MessageTypeRequest
+			req.AddOption(dhcpv6.OptServerID(r.duid))
+
+			resp, err := r.dhcpv6Reply(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp).To(BeNil())
+		})
+
+		It("DHCPv6 ignores unknown mac", func() {
+			req, err := dhcpv6.NewSolicit(unknownMac,
+				dhcpv6.WithRequestedOptions(dhcpv6.OptionBootfileURL))
+			Expect(err).ToNot(HaveOccurred())
+
+			resp, err := responder().dhcpv6Reply(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp).To(BeNil())
+		})
+	})
+})
@@ -0,0 +1,191 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Error codes returned in the body of failed requests. They are stable and
+// meant to be used by alerting, the messages are not.
+const (
+	ErrorCodeBadRequest         = "bad_request"
+	ErrorCodeUnknownClient      = "unknown_client"
+	ErrorCodeMacMismatch        = "mac_mismatch"
+	ErrorCodeKeyNotFound        = "key_not_found"
+	ErrorCodeConflict           = "conflict"
+	ErrorCodeRenderFailed       = "render_failed"
+	ErrorCodeBackendUnavailable = "backend_unavailable"
+	ErrorCodeInternal           = "internal_error"
+)
+
+// NotFoundError is returned when a Kubernetes object does not exist. Its
+// error code is derived from the kind, e.g. inventory_not_found.
+type NotFoundError struct {
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+func (e *NotFoundError) Error() string {
+	if e.Namespace == "" {
+		return fmt.Sprintf("%s %s not found", e.Kind, e.Name)
+	}
+	return fmt.Sprintf("%s %s not found in namespace %s", e.Kind, e.Name, e.Namespace)
+}
+
+// KeyNotFoundError is returned when a ConfigMap, Secret or default config
+// exists but has no data for the requested key.
+type KeyNotFoundError struct {
+	Kind string
+	Name string
+	Key  string
+}
+
+func (e *KeyNotFoundError) Error() string {
+	return fmt.Sprintf("Key %s not found in %s %s", e.Key, e.Kind, e.Name)
+}
+
+// ConflictError is returned when a lookup which has to be unique matches
+// more than one object.
+type ConflictError struct {
+	Kind  string
+	Key   string
+	Names []string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("More than one %s has %s: %s", e.Kind, e.Key, strings.Join(e.Names, ", "))
+}
+
+// UnavailableError is returned when the Kubernetes API could not be queried,
+// e.g. on timeouts or missing permissions.
+type UnavailableError struct {
+	Err error
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("Kubernetes API unavailable: %s", e.Err)
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// UnknownClientError is returned when the client IP can not be mapped to a
+// single MAC address.
+type UnknownClientError struct {
+	IP     string
+	Reason string
+}
+
+func (e *UnknownClientError) Error() string {
+	return fmt.Sprintf("Client %s is unknown: %s", e.IP, e.Reason)
+}
+
+// MacMismatchError is returned when the MAC address of the client does not
+// belong to the requested Inventory.
+type MacMismatchError struct {
+	MAC  string
+	UUID string
+}
+
+func (e *MacMismatchError) Error() string {
+	return fmt.Sprintf("Mac %s not found for Inventory %s", e.MAC, e.UUID)
+}
+
+// RenderError is returned when a template or butane config from the cluster
+// can not be rendered.
+type RenderError struct {
+	Name string
+	Err  error
+}
+
+func (e *RenderError) Error() string {
+	return fmt.Sprintf("Failed to render %s: %s", e.Name, e.Err)
+}
+
+func (e *RenderError) Unwrap() error {
+	return e.Err
+}
+
+// RequestError is returned for invalid requests.
+type RequestError struct {
+	Reason string
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("Bad request: %s", e.Reason)
+}
+
+// apiError converts an error of the Kubernetes API into a NotFoundError or
+// UnavailableError.
+func apiError(err error, kind, namespace, name string) error {
+	if apierrors.IsNotFound(err) {
+		return &NotFoundError{Kind: kind, Namespace: namespace, Name: name}
+	}
+	return &UnavailableError{Err: errors.Wrapf(err, "Failed to get %s %s in namespace %s", kind, name, namespace)}
+}
+
+type errorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// errorStatus maps err to the HTTP status, error code and a message which is
+// safe to return to the client.
+func errorStatus(err error) (int, string, string) {
+	var requestErr *RequestError
+	var unknownClientErr *UnknownClientError
+	var macMismatchErr *MacMismatchError
+	var notFoundErr *NotFoundError
+	var keyNotFoundErr *KeyNotFoundError
+	var conflictErr *ConflictError
+	var renderErr *RenderError
+	var unavailableErr *UnavailableError
+
+	switch {
+	case errors.As(err, &requestErr):
+		return http.StatusBadRequest, ErrorCodeBadRequest, requestErr.Error()
+	case errors.As(err, &unknownClientErr):
+		return http.StatusForbidden, ErrorCodeUnknownClient, "client is unknown"
+	case errors.As(err, &macMismatchErr):
+		return http.StatusForbidden, ErrorCodeMacMismatch, "client is not allowed to access this machine"
+	case errors.As(err, &notFoundErr):
+		return http.StatusNotFound, strings.ToLower(notFoundErr.Kind) + "_not_found", notFoundErr.Error()
+	case errors.As(err, &keyNotFoundErr):
+		return http.StatusNotFound, ErrorCodeKeyNotFound, keyNotFoundErr.Error()
+	case errors.As(err, &conflictErr):
+		return http.StatusConflict, ErrorCodeConflict, fmt.Sprintf("%s is not unique", conflictErr.Key)
+	case errors.As(err, &renderErr):
+		return http.StatusBadGateway, ErrorCodeRenderFailed, fmt.Sprintf("failed to render %s", renderErr.Name)
+	case errors.As(err, &unavailableErr):
+		return http.StatusServiceUnavailable, ErrorCodeBackendUnavailable, "Kubernetes API unavailable"
+	default:
+		return http.StatusInternalServerError, ErrorCodeInternal, "internal error"
+	}
+}
+
+// writeError logs err and answers with its status and a JSON body with the
+// error code.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status, code, message := errorStatus(err)
+	log := loggerFrom(r.Context())
+	if status < http.StatusInternalServerError {
+		log.Info("Request failed", "status", status, "code", code, "error", err.Error())
+	} else {
+		log.Error(err, "Request failed", "status", status, "code", code)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(errorResponse{Code: code, Message: message})
+}
@@ -0,0 +1,169 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	inventoryv1alpha4 "github.com/ironcore-dev/metal/apis/metal/v1alpha4"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+func expectError(rr *httptest.ResponseRecorder, status int, code string) {
+	Expect(rr.Code).Should(BeNumerically("==", status))
+	Expect(rr.Header().Get("Content-Type")).To(Equal("application/json"))
+
+	var body errorResponse
+	Expect(json.Unmarshal(rr.Body.Bytes(), &body)).To(Succeed())
+	Expect(body.Code).To(Equal(code))
+	Expect(body.Message).ToNot(BeEmpty())
+}
+
+var _ = Describe("Errors", func() {
+	Context("Status mapping", func() {
+		It("Maps typed errors to status and code", func() {
+			notFound := apierrors.NewNotFound(schema.GroupResource{Resource: "inventories"}, uuid)
+			timeout := apierrors.NewTimeoutError("timeout", 1)
+
+			for _, c := range []struct {
+				err    error
+				status int
+				code   string
+			}{
+				{&RequestError{Reason: "no uuid specified"}, http.StatusBadRequest, ErrorCodeBadRequest},
+				{&UnknownClientError{IP: badIP, Reason: "no IPAM IP found"}, http.StatusForbidden, ErrorCodeUnknownClient},
+				{&MacMismatchError{MAC: "08c0eba29906", UUID: uuid}, http.StatusForbidden, ErrorCodeMacMismatch},
+				{apiError(notFound, "Inventory", namespace, uuid), http.StatusNotFound, "inventory_not_found"},
+				{&KeyNotFoundError{Kind: "ConfigMap", Name: "ipxe-" + uuid, Key: "boot"}, http.StatusNotFound, ErrorCodeKeyNotFound},
+				{&RenderError{Name: "boot", Err: errors.New("bad template")}, http.StatusBadGateway, ErrorCodeRenderFailed},
+				{apiError(timeout, "Inventory", namespace, uuid), http.StatusServiceUnavailable, ErrorCodeBackendUnavailable},
+				{errors.Wrap(&UnavailableError{Err: timeout}, "wrapped"), http.StatusServiceUnavailable, ErrorCodeBackendUnavailable},
+				{errors.New("unexpected"), http.StatusInternalServerError, ErrorCodeInternal},
+			} {
+				rr := httptest.NewRecorder()
+				writeError(rr, httptest.NewRequest("GET", "/", nil), c.err)
+				expectError(rr, c.status, c.code)
+			}
+		})
+
+		It("Does not leak internal errors", func() {
+			rr := httptest.NewRecorder()
+			writeError(rr, httptest.NewRequest("GET", "/", nil), &UnavailableError{Err: errors.New("dial tcp 10.0.0.1:443: connection refused")})
+			Expect(rr.Body.String()).ToNot(ContainSubstring("10.0.0.1"))
+		})
+	})
+
+	Context("Unavailable API", func() {
+		It("Answers with 503", func() {
+			unavailable := ipxe
+			unavailable.K8sClient = K8sClient{
+				Client: fake.NewClientBuilder().WithInterceptorFuncs(interceptor.Funcs{
+					List: func(_ context.Context, _ client.WithWatch, _ client.ObjectList, _ ...client.ListOption) error {
+						return apierrors.NewServiceUnavailable("unavailable")
+					},
+				}).Build(),
+			}
+
+			rr := serveRequest(unavailable.getRouter(), fmt.Sprintf("/ipxe/%s/boot", uuid))
+			expectError(rr, http.StatusServiceUnavailable, ErrorCodeBackendUnavailable)
+			rr = serveRequest(unavailable.getRouter(), fmt.Sprintf("/ignition/%s/default", uuid))
+			expectError(rr, http.StatusServiceUnavailable, ErrorCodeBackendUnavailable)
+		})
+	})
+
+	Context("Handlers", func() {
+		ctx := context.Background()
+		SetupTestData(ctx)
+
+		It("Rejects an invalid client address", func() {
+			noForward := ipxe
+			noForward.Config.DisableForwardHeader = true
+			req, err := http.NewRequest("GET", fmt.Sprintf("/ipxe/%s/boot", uuid), nil)
+			Expect(err).ToNot(HaveOccurred())
+			req.RemoteAddr = "invalid"
+
+			rr := httptest.NewRecorder()
+			noForward.getRouter().ServeHTTP(rr, req)
+			expectError(rr, http.StatusBadRequest, ErrorCodeBadRequest)
+		})
+
+		It("Rejects unknown clients", func() {
+			for _, url := range []string{
+				fmt.Sprintf("/ipxe/%s/boot", uuid),
+				fmt.Sprintf("/ignition/%s/default", uuid),
+			} {
+				req, err := http.NewRequest("GET", url, nil)
+				Expect(err).ToNot(HaveOccurred())
+				req.Header.Set("X-FORWARDED-FOR", badIP)
+				req.RemoteAddr = proxyAddr
+
+				rr := httptest.NewRecorder()
+				ipxe.getRouter().ServeHTTP(rr, req)
+				expectError(rr, http.StatusForbidden, ErrorCodeUnknownClient)
+			}
+		})
+
+		It("Rejects clients with a foreign mac", func() {
+			inventory := &inventoryv1alpha4.Inventory{}
+			Expect(ipxe.K8sClient.Client.Get(ctx, client.ObjectKey{Name: uuid, Namespace: namespace}, inventory)).To(Succeed())
+			delete(inventory.Labels, InventoryMacLabelPrefix+"08c0eba29905")
+			Expect(ipxe.K8sClient.Client.Update(ctx, inventory)).To(Succeed())
+
+			for _, url := range []string{
+				fmt.Sprintf("/ipxe/%s/boot", uuid),
+				fmt.Sprintf("/ignition/%s/default", uuid),
+			} {
+				req, err := http.NewRequest("GET", url, nil)
+				Expect(err).ToNot(HaveOccurred())
+				req.Header.Set("X-FORWARDED-FOR", validIP2)
+				req.RemoteAddr = proxyAddr
+
+				rr := httptest.NewRecorder()
+				ipxe.getRouter().ServeHTTP(rr, req)
+				expectError(rr, http.StatusForbidden, ErrorCodeMacMismatch)
+			}
+		})
+
+		It("Answers unknown inventories with 404", func() {
+			rr := serveRequest(ipxe.getRouter(), fmt.Sprintf("/ipxe/%s/boot", badUUID))
+			expectError(rr, http.StatusNotFound, "inventory_not_found")
+			rr = serveRequest(ipxe.getRouter(), fmt.Sprintf("/ignition/%s/default", badUUID))
+			expectError(rr, http.StatusNotFound, "inventory_not_found")
+		})
+
+		It("Answers missing parts with 404", func() {
+			for _, url := range []string{
+				fmt.Sprintf("/ipxe/%s/missing", uuid),
+				fmt.Sprintf("/ipxe/%s/missing", emptyInventoryUUID),
+				fmt.Sprintf("/ignition/%s/missing", uuid),
+				fmt.Sprintf("/ignition/%s/missing", emptyInventoryUUID),
+			} {
+				rr := serveRequest(ipxe.getRouter(), url)
+				expectError(rr, http.StatusNotFound, ErrorCodeKeyNotFound)
+			}
+		})
+
+		It("Answers broken templates with 502", func() {
+			configMap := &corev1.ConfigMap{}
+			Expect(ipxe.K8sClient.Client.Get(ctx, client.ObjectKey{Name: "ipxe-" + uuid, Namespace: namespace}, configMap)).To(Succeed())
+			configMap.Data["broken"] = "#!ipxe\n{{ .Broken"
+			Expect(ipxe.K8sClient.Client.Update(ctx, configMap)).To(Succeed())
+
+			rr := serveRequest(ipxe.getRouter(), fmt.Sprintf("/ipxe/%s/broken", uuid))
+			expectError(rr, http.StatusBadGateway, ErrorCodeRenderFailed)
+		})
+	})
+})
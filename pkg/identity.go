@@ -0,0 +1,103 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	inventoryv1alpha4 "github.com/ironcore-dev/metal/apis/metal/v1alpha4"
+	"github.com/pkg/errors"
+)
+
+// IdentityChainConfig lets /ipxe identify the client server-side, by its
+// trusted MAC and the mac-address labels of the Inventories, and chain it to
+// the per-machine script. This serves machines with broken or all-zero SMBIOS
+// UUIDs. Clients which can not be identified get the default script.
+type IdentityChainConfig struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+	// Redirect answers with an HTTP redirect instead of a chain script
+	Redirect bool `yaml:"redirect,omitempty"`
+	// Part is the part of the per-machine script, boot by default
+	Part string `yaml:"part,omitempty"`
+}
+
+var partPattern = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+func (c IdentityChainConfig) part() string {
+	if c.Part == "" {
+		return DefaultIdentityChainPart
+	}
+	return c.Part
+}
+
+func (c IdentityChainConfig) validate() error {
+	if !partPattern.MatchString(c.part()) {
+		return errors.Errorf("Invalid identity chain part %s", c.Part)
+	}
+	return nil
+}
+
+// identifyClient returns the Inventory of the client at clientIP. Only
+// trusted MACs which belong to exactly one Inventory identify a client.
+func (i IPXE) identifyClient(ctx context.Context, r *http.Request, clientIP string) (_ *inventoryv1alpha4.Inventory, err error) {
+	ctx, span := startSpan(ctx, "identifyClient")
+	defer func() { endSpan(span, err) }()
+
+	resolution, err := i.resolveMac(ctx, r, clientIP)
+	if err != nil {
+		return nil, err
+	}
+	inventory, err := i.inventoryOfClient(ctx, resolution, clientIP)
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attrUUID.String(inventory.Name))
+	return inventory, nil
+}
+
+// inventoryOfClient returns the Inventory of the client at clientIP with the
+// MAC of resolution, see identifyClient.
+func (i IPXE) inventoryOfClient(ctx context.Context, resolution macResolution, clientIP string) (*inventoryv1alpha4.Inventory, error) {
+	if err := resolution.requireTrusted(clientIP); err != nil {
+		return nil, err
+	}
+
+	inventories, err := i.K8sClient.getInventories(ctx, lookupByMAC, resolution.MAC, i.Config.InventoryNS)
+	if err != nil {
+		return nil, err
+	}
+	switch len(inventories) {
+	case 0:
+		return nil, &UnknownClientError{IP: clientIP, Reason: "no Inventory has MAC " + resolution.MAC}
+	case 1:
+		return &inventories[0], nil
+	default:
+		return nil, &UnknownClientError{IP: clientIP, Reason: "more than one Inventory has MAC " + resolution.MAC}
+	}
+}
+
+// chainToMachine sends the client to the per-machine script of uuid, either
+// by a redirect or by a script chaining it. The path is relative, so iPXE
+// resolves it against the URL of /ipxe and keeps scheme and host.
+func (i IPXE) chainToMachine(w http.ResponseWriter, r *http.Request, uuid string) {
+	conf := i.Config.IdentityChain
+	target := withQuery(fmt.Sprintf("/ipxe/%s/%s", uuid, conf.part()), r.URL.RawQuery)
+
+	if conf.Redirect {
+		http.Redirect(w, r, target, http.StatusFound)
+		return
+	}
+	_, _ = fmt.Fprintf(w, "#!ipxe\n\nchain --replace --autofree %s\n", target)
+}
+
+// withQuery appends the raw query, if any, to path.
+func withQuery(path, rawQuery string) string {
+	if rawQuery == "" {
+		return path
+	}
+	return path + "?" + rawQuery
+}
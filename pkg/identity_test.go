@@ -0,0 +1,114 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	inventoryv1alpha4 "github.com/ironcore-dev/metal/apis/metal/v1alpha4"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("Identity chain", func() {
+	ctx := context.Background()
+	SetupTestData(ctx)
+
+	identifying := func(redirect bool) IPXE {
+		i := ipxe
+		i.Config.IdentityChain = IdentityChainConfig{Enabled: true, Redirect: redirect}
+		return i
+	}
+	defaultScript := func() string {
+		expected, err := os.ReadFile("../config/samples/ipxe-default-cm/ipxe")
+		Expect(err).ToNot(HaveOccurred())
+		return string(expected)
+	}
+
+	It("Chains identified clients to their iPXE config", func() {
+		rr := httptest.NewRecorder()
+		identifying(false).getRouter().ServeHTTP(rr, requestFrom("/ipxe", validIP1))
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+		Expect(rr.Body.String()).To(Equal(fmt.Sprintf("#!ipxe\n\nchain --replace --autofree /ipxe/%s/boot\n", uuid)))
+
+		By("Keeping the query")
+		rr = httptest.NewRecorder()
+		identifying(false).getRouter().ServeHTTP(rr, requestFrom("/ipxe?mac=08:c0:eb:a2:99:04", validIP2))
+		Expect(rr.Body.String()).To(ContainSubstring(fmt.Sprintf("/ipxe/%s/boot?mac=08:c0:eb:a2:99:04\n", uuid)))
+	})
+
+	It("Redirects identified clients to their iPXE config", func() {
+		i := identifying(true)
+		i.Config.IdentityChain.Part = "install"
+		rr := httptest.NewRecorder()
+		i.getRouter().ServeHTTP(rr, requestFrom("/ipxe", validIP1))
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusFound))
+		Expect(rr.Header().Get("Location")).To(Equal(fmt.Sprintf("/ipxe/%s/install", uuid)))
+
+		By("Serving the redirected config")
+		i = identifying(true)
+		rr = httptest.NewRecorder()
+		i.getRouter().ServeHTTP(rr, requestFrom("/ipxe", validIP1))
+		location := rr.Header().Get("Location")
+		rr = httptest.NewRecorder()
+		i.getRouter().ServeHTTP(rr, requestFrom(location, validIP1))
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+		expected, err := os.ReadFile("../config/samples/configmap/ipxe-f2175eb4-e203-11ec-b5d5-3a68dd76b473")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rr.Body.String()).To(Equal(string(expected)))
+	})
+
+	It("Falls back to the default config", func() {
+		By("Not identifying unknown clients")
+		rr := httptest.NewRecorder()
+		identifying(false).getRouter().ServeHTTP(rr, requestFrom("/ipxe", badIP))
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+		Expect(rr.Body.String()).To(Equal(defaultScript()))
+
+		By("Not identifying clients with untrusted MACs")
+		untrusted := identifying(false)
+		untrusted.Config.MacResolvers = MacResolverConfig{
+			Order:   []string{MacResolverIPAM, MacResolverEUI64},
+			Trusted: [][]string{{MacResolverIPAM}},
+		}
+		rr = httptest.NewRecorder()
+		untrusted.getRouter().ServeHTTP(rr, requestFrom("/ipxe", eui64IP))
+		Expect(rr.Body.String()).To(Equal(defaultScript()))
+
+		By("Not identifying clients when disabled")
+		rr = httptest.NewRecorder()
+		ipxe.getRouter().ServeHTTP(rr, requestFrom("/ipxe", validIP1))
+		Expect(rr.Body.String()).To(Equal(defaultScript()))
+	})
+
+	It("Does not identify MACs of more than one Inventory", func() {
+		duplicate := &inventoryv1alpha4.Inventory{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "d2f7b3a0-5b4e-11ef-8c1f-3a68dd76b473",
+				Namespace: namespace,
+				Labels:    map[string]string{InventoryMacLabelPrefix + "08c0eba29904": ""},
+			},
+		}
+		Expect(ipxe.K8sClient.Client.Create(ctx, duplicate)).To(Succeed())
+		DeferCleanup(ipxe.K8sClient.Client.Delete, ctx, duplicate)
+
+		_, err := identifying(false).identifyClient(ctx, nil, validIP1)
+		Expect(err).To(BeAssignableToTypeOf(&UnknownClientError{}))
+
+		rr := httptest.NewRecorder()
+		identifying(false).getRouter().ServeHTTP(rr, requestFrom("/ipxe", validIP1))
+		Expect(rr.Body.String()).To(Equal(defaultScript()))
+	})
+
+	It("Validates the part", func() {
+		Expect(IdentityChainConfig{}.validate()).To(Succeed())
+		Expect(IdentityChainConfig{Part: "install-2"}.validate()).To(Succeed())
+		Expect(IdentityChainConfig{Part: "../boot"}.validate()).ToNot(Succeed())
+	})
+})
@@ -6,18 +6,24 @@ package pkg
 import (
 	"context"
 	"fmt"
-	"log"
 	"net"
 	"os"
+	"slices"
 	"strings"
+	"time"
 
 	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
 
 	ipamv1alpha1 "github.com/ironcore-dev/ipam/api/ipam/v1alpha1"
+	ipxev1alpha1 "github.com/ironcore-dev/ipxe-service/api/v1alpha1"
 	inventoryv1alpha4 "github.com/ironcore-dev/metal/apis/metal/v1alpha4"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/scheme"
 	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
@@ -27,15 +33,21 @@ import (
 
 type K8sClient struct {
 	Client        client.Client
+	Cache         cache.Cache
 	EventRecorder record.EventRecorder
+
+	restConfig *rest.Config
 }
 
 func NewK8sClient(cfg *rest.Config, options client.Options) K8sClient {
 	if err := inventoryv1alpha4.AddToScheme(scheme.Scheme); err != nil {
-		log.Fatal("Unable to add registered types inventory to client scheme: ", err)
+		fatal(err, "Unable to add registered types inventory to client scheme")
 	}
 	if err := ipamv1alpha1.AddToScheme(scheme.Scheme); err != nil {
-		log.Fatal("Unable to add registered types ipam to client scheme: ", err)
+		fatal(err, "Unable to add registered types ipam to client scheme")
+	}
+	if err := ipxev1alpha1.AddToScheme(scheme.Scheme); err != nil {
+		fatal(err, "Unable to add registered types ipxe to client scheme")
 	}
 
 	if cfg == nil {
@@ -44,12 +56,12 @@ func NewK8sClient(cfg *rest.Config, options client.Options) K8sClient {
 
 	cl, err := client.New(cfg, options)
 	if err != nil {
-		log.Fatal("Failed to create a controller runtime client: ", err)
+		fatal(err, "Failed to create a controller runtime client")
 	}
 
 	corev1Client, err := corev1client.NewForConfig(cfg)
 	if err != nil {
-		log.Fatal("Failed to create a core client: ", err)
+		fatal(err, "Failed to create a core client")
 	}
 
 	broadcaster := record.NewBroadcaster()
@@ -57,7 +69,7 @@ func NewK8sClient(cfg *rest.Config, options client.Options) K8sClient {
 	// Leader id, needs to be unique
 	id, err := os.Hostname()
 	if err != nil {
-		log.Fatal("Failed to get hostname: ", err)
+		fatal(err, "Failed to get hostname")
 	}
 	recorder := broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: id})
 	broadcaster.StartRecordingToSink(&corev1client.EventSinkImpl{Interface: corev1Client.Events("")})
@@ -65,10 +77,14 @@ func NewK8sClient(cfg *rest.Config, options client.Options) K8sClient {
 	return K8sClient{
 		Client:        cl,
 		EventRecorder: recorder,
+		restConfig:    cfg,
 	}
 }
 
-func (k K8sClient) getSecret(name, namespace string) (*corev1.Secret, error) {
+func (k K8sClient) getSecret(ctx context.Context, name, namespace string) (_ *corev1.Secret, err error) {
+	ctx, span := startSpan(ctx, "getSecret", attrName.String(name), attrNamespace.String(namespace))
+	defer func() { endSpan(span, err) }()
+
 	secret := &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: namespace,
@@ -76,16 +92,19 @@ func (k K8sClient) getSecret(name, namespace string) (*corev1.Secret, error) {
 		},
 	}
 
-	err := k.Client.Get(context.Background(), client.ObjectKeyFromObject(secret), secret)
+	err = k.get(ctx, secret)
 	if err != nil {
-		log.Printf("Failed to get Secret %s in Namespace %s: %s", name, namespace, err)
-		return nil, err
+		loggerFrom(ctx).Info("Failed to get Secret", "name", name, "namespace", namespace, "error", err.Error())
+		return nil, apiError(err, "Secret", namespace, name)
 	}
 
 	return secret, nil
 }
 
-func (k K8sClient) getConfigMag(name, namespace string) (*corev1.ConfigMap, error) {
+func (k K8sClient) getConfigMag(ctx context.Context, name, namespace string) (_ *corev1.ConfigMap, err error) {
+	ctx, span := startSpan(ctx, "getConfigMap", attrName.String(name), attrNamespace.String(namespace))
+	defer func() { endSpan(span, err) }()
+
 	configMap := &corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: namespace,
@@ -93,49 +112,101 @@ func (k K8sClient) getConfigMag(name, namespace string) (*corev1.ConfigMap, erro
 		},
 	}
 
-	err := k.Client.Get(context.Background(), client.ObjectKeyFromObject(configMap), configMap)
+	err = k.get(ctx, configMap)
 	if err != nil {
-		log.Printf("Failed to get ConfigMap %s in Namespace %s: %s", name, namespace, err)
-		return nil, err
+		loggerFrom(ctx).Info("Failed to get ConfigMap", "name", name, "namespace", namespace, "error", err.Error())
+		return nil, apiError(err, "ConfigMap", namespace, name)
 	}
 
 	return configMap, nil
 }
 
-func (k K8sClient) getMacFromIP(clientIP, namespace string) (string, error) {
+func (k K8sClient) getMacFromIP(ctx context.Context, clientIP, namespace string) (_ string, err error) {
+	ctx, span := startSpan(ctx, "getMacFromIP", semconv.ClientAddress(clientIP), attrNamespace.String(namespace))
+	defer func() { endSpan(span, err) }()
+
+	ip, err := k.getIPAMIP(ctx, clientIP, namespace)
+	if err != nil {
+		return "", err
+	}
+
+	mac, exists := ip.Labels[macLabel]
+	if !exists {
+		return "", &UnknownClientError{IP: clientIP, Reason: "no mac label on IPAM IP"}
+	}
+	span.SetAttributes(attrMAC.String(mac))
+
+	loggerFrom(ctx).V(1).Info("Found mac for IPAM IP", "mac", mac, "ip", clientIP)
+	return mac, nil
+}
+
+func (k K8sClient) getIPAMIP(ctx context.Context, clientIP, namespace string) (*ipamv1alpha1.IP, error) {
 	if getIPVersion(clientIP) == "ipv6" {
 		ip := net.ParseIP(clientIP)
 		clientIP = getLongIPv6(ip)
 	}
 
 	var ips ipamv1alpha1.IPList
-	err := k.Client.List(context.Background(),
-		&ips,
-		client.InNamespace(namespace),
-		client.MatchingLabels{"ip": strings.ReplaceAll(clientIP, ":", "-")})
+	err := k.listIPs(ctx, &ips, namespace, ipLabel, strings.ReplaceAll(clientIP, ":", "-"))
 	if err != nil {
-		err = errors.Wrapf(err, "Failed to list IPAM IPs in namespace %s", namespace)
-		return "", err
+		return nil, &UnavailableError{Err: errors.Wrapf(err, "Failed to list IPAM IPs in namespace %s", namespace)}
 	}
 
-	var mac string
 	if len(ips.Items) == 0 {
-		return "", errors.New(fmt.Sprintf("IP %s is unknown", clientIP))
+		return nil, &UnknownClientError{IP: clientIP, Reason: "no IPAM IP found"}
 	} else if len(ips.Items) > 1 {
-		return "", errors.New(fmt.Sprintf("More than one IP %s found", clientIP))
-	} else if len(ips.Items) == 1 {
-		macLabel, exists := ips.Items[0].Labels["mac"]
-		if !exists {
-			return "", errors.New(fmt.Sprintf("No Mac was found for IP %s", clientIP))
-		}
-		mac = macLabel
+		return nil, &UnknownClientError{IP: clientIP, Reason: "more than one IPAM IP found"}
 	}
 
-	log.Printf("Mac %s for IPAM IP %s found", mac, clientIP)
-	return mac, nil
+	return &ips.Items[0], nil
 }
 
-func (k K8sClient) getInventory(uuid, namespace string) (*inventoryv1alpha4.Inventory, error) {
+func (k K8sClient) getSubnet(ctx context.Context, name, namespace string) (*ipamv1alpha1.Subnet, error) {
+	subnet := &ipamv1alpha1.Subnet{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+		},
+	}
+
+	err := k.get(ctx, subnet)
+	if err != nil {
+		return nil, apiError(err, "Subnet", namespace, name)
+	}
+
+	return subnet, nil
+}
+
+func (k K8sClient) getIPsFromMac(ctx context.Context, mac, namespace string) ([]ipamv1alpha1.IP, error) {
+	var ips ipamv1alpha1.IPList
+	err := k.listIPs(ctx, &ips, namespace, macLabel, mac)
+	if err != nil {
+		return nil, &UnavailableError{Err: errors.Wrapf(err, "Failed to list IPAM IPs in namespace %s", namespace)}
+	}
+
+	return ips.Items, nil
+}
+
+// getInventories returns the Inventories with value, e.g. the Inventories
+// with the mac-address label of a MAC.
+func (k K8sClient) getInventories(ctx context.Context, lookup inventoryLookup, value, namespace string) (_ []inventoryv1alpha4.Inventory, err error) {
+	ctx, span := startSpan(ctx, "getInventories", attribute.String("ipxe.lookup", lookup.name),
+		attribute.String("ipxe.lookup.value", value), attrNamespace.String(namespace))
+	defer func() { endSpan(span, err) }()
+
+	var inventories inventoryv1alpha4.InventoryList
+	err = k.listInventories(ctx, &inventories, namespace, lookup, value)
+	if err != nil {
+		return nil, &UnavailableError{Err: errors.Wrapf(err, "Failed to list Inventories in namespace %s", namespace)}
+	}
+
+	loggerFrom(ctx).V(1).Info("Found Inventories", "lookup", lookup.name, "value", value, "count", len(inventories.Items))
+	return inventories.Items, nil
+}
+
+func (k K8sClient) getInventory(ctx context.Context, uuid, namespace string) (_ *inventoryv1alpha4.Inventory, err error) {
+	ctx, span := startSpan(ctx, "getInventory", attrUUID.String(uuid), attrNamespace.String(namespace))
+	defer func() { endSpan(span, err) }()
 
 	inventory := &inventoryv1alpha4.Inventory{
 		ObjectMeta: metav1.ObjectMeta{
@@ -143,12 +214,76 @@ func (k K8sClient) getInventory(uuid, namespace string) (*inventoryv1alpha4.Inve
 			Namespace: namespace,
 		},
 	}
-	err := k.Client.Get(context.Background(), client.ObjectKeyFromObject(inventory), inventory)
+	err = k.get(ctx, inventory)
 	if err != nil {
-		err = errors.Wrapf(err, "Failed to get inventory in namespace %s", namespace)
-		return nil, err
+		return nil, apiError(err, "Inventory", namespace, uuid)
 	}
 
-	log.Printf("Found Inventory for UUID %s", uuid)
+	loggerFrom(ctx).V(1).Info("Found Inventory", "uuid", uuid)
 	return inventory, nil
 }
+
+// get reads obj from the cache and falls back to a live read from the API
+// server when the cache misses or is not started.
+func (k K8sClient) get(ctx context.Context, obj client.Object) (err error) {
+	defer observeLookup(obj, time.Now(), &err)
+
+	key := client.ObjectKeyFromObject(obj)
+	if k.Cache != nil {
+		err := k.Cache.Get(ctx, key, obj)
+		if err == nil {
+			return nil
+		}
+		if !apierrors.IsNotFound(err) {
+			loggerFrom(ctx).Info("Failed to read from cache, fall back to API server", "type", fmt.Sprintf("%T", obj), "key", key.String(), "error", err.Error())
+		}
+	}
+
+	return k.Client.Get(ctx, key, obj)
+}
+
+// listIPs lists the IPAM IPs whose label equals value. The cache is queried
+// by the field index of the label. It is synced before it is set, so an empty
+// result is authoritative and only a failing cache falls back to the API
+// server, which is queried by label selector.
+func (k K8sClient) listIPs(ctx context.Context, ips *ipamv1alpha1.IPList, namespace, label, value string) (err error) {
+	defer observeLookup(ips, time.Now(), &err)
+
+	if k.Cache != nil {
+		err := k.Cache.List(ctx, ips, client.InNamespace(namespace), client.MatchingFields{ipLabelIndexes[label]: value})
+		if err == nil {
+			return nil
+		}
+		loggerFrom(ctx).Info("Failed to list IPAM IPs from cache, fall back to API server", "error", err.Error())
+	}
+
+	return k.Client.List(ctx, ips, client.InNamespace(namespace), client.MatchingLabels{label: value})
+}
+
+// listInventories lists the Inventories with value. The cache is queried by
+// the index of lookup and an empty result is authoritative. Only when the
+// cache fails, the API server is queried by the selector of lookup and the
+// result filtered by its indexer.
+func (k K8sClient) listInventories(ctx context.Context, inventories *inventoryv1alpha4.InventoryList, namespace string, lookup inventoryLookup, value string) (err error) {
+	defer observeLookup(inventories, time.Now(), &err)
+
+	if k.Cache != nil {
+		err := k.Cache.List(ctx, inventories, client.InNamespace(namespace), client.MatchingFields{lookup.index: value})
+		if err == nil {
+			return nil
+		}
+		loggerFrom(ctx).Info("Failed to list Inventories from cache, fall back to API server", "error", err.Error())
+	}
+
+	options := []client.ListOption{client.InNamespace(namespace)}
+	if lookup.selector != nil {
+		options = append(options, lookup.selector(value))
+	}
+	if err := k.Client.List(ctx, inventories, options...); err != nil {
+		return err
+	}
+	inventories.Items = slices.DeleteFunc(inventories.Items, func(inventory inventoryv1alpha4.Inventory) bool {
+		return !slices.Contains(lookup.indexer(&inventory), value)
+	})
+	return nil
+}
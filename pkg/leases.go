@@ -0,0 +1,446 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/pkg/errors"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// KeaConfig configures the Kea control agent which is asked for the leases
+// of the clients.
+type KeaConfig struct {
+	URL          string `yaml:"url,omitempty"`
+	Username     string `yaml:"username,omitempty"`
+	PasswordFile string `yaml:"password-file,omitempty"`
+	Timeout      string `yaml:"timeout,omitempty"`
+}
+
+// Result codes of the Kea control agent, see the Kea API reference.
+const (
+	keaResultSuccess = 0
+	keaResultEmpty   = 3
+)
+
+// keaResolver looks up the lease of the client by lease4-get or lease6-get of
+// the Kea control agent. Leases without hw-address, usual for lease6, are
+// resolved by the DUID of the client.
+type keaResolver struct {
+	conf   KeaConfig
+	client *http.Client
+}
+
+type keaCommand struct {
+	Command   string            `json:"command"`
+	Service   []string          `json:"service"`
+	Arguments map[string]string `json:"arguments"`
+}
+
+type keaResponse struct {
+	Result    int    `json:"result"`
+	Text      string `json:"text"`
+	Arguments struct {
+		HWAddress string `json:"hw-address"`
+		DUID      string `json:"duid"`
+	} `json:"arguments"`
+}
+
+func newKeaResolver(conf KeaConfig) (keaResolver, error) {
+	if conf.URL == "" {
+		return keaResolver{}, errors.New("MAC resolver kea requires a url")
+	}
+	return keaResolver{
+		conf:   conf,
+		client: &http.Client{Timeout: durationOrDefault(conf.Timeout, DefaultKeaTimeout)},
+	}, nil
+}
+
+func (r keaResolver) resolve(ctx context.Context, client macClient) (_ string, err error) {
+	addr, err := netip.ParseAddr(client.IP)
+	if err != nil {
+		return "", nil
+	}
+	addr = addr.Unmap()
+
+	command := keaCommand{Command: "lease4-get", Service: []string{"dhcp4"}, Arguments: map[string]string{"ip-address": addr.String()}}
+	if addr.Is6() {
+		command = keaCommand{Command: "lease6-get", Service: []string{"dhcp6"}, Arguments: map[string]string{"ip-address": addr.String(), "type": "IA_NA"}}
+	}
+
+	ctx, span := startSpan(ctx, command.Command, semconv.ClientAddress(client.IP))
+	defer func() { endSpan(span, err) }()
+
+	response, err := r.post(ctx, command)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to get lease of %s from Kea", client.IP)
+	}
+	switch response.Result {
+	case keaResultSuccess:
+		mac := normalizeMac(response.Arguments.HWAddress)
+		if mac == "" && response.Arguments.DUID != "" {
+			// lease6 often lacks the hw-address, the DUID may carry the MAC
+			duid, err := hex.DecodeString(strings.ReplaceAll(response.Arguments.DUID, ":", ""))
+			if err != nil {
+				return "", errors.Wrapf(err, "Invalid DUID of lease of %s from Kea", client.IP)
+			}
+			mac = duidMac(ctx, addr, duid)
+		}
+		span.SetAttributes(attrMAC.String(mac))
+		return mac, nil
+	case keaResultEmpty:
+		return "", nil
+	default:
+		return "", errors.Errorf("Failed to get lease of %s from Kea: %s", client.IP, response.Text)
+	}
+}
+
+func (r keaResolver) post(ctx context.Context, command keaCommand) (keaResponse, error) {
+	body, err := json.Marshal(command)
+	if err != nil {
+		return keaResponse{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return keaResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.conf.Username != "" {
+		password, err := os.ReadFile(r.conf.PasswordFile)
+		if err != nil {
+			return keaResponse{}, errors.Wrap(err, "Failed to read Kea password")
+		}
+		req.SetBasicAuth(r.conf.Username, strings.TrimSpace(string(password)))
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return keaResponse{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return keaResponse{}, errors.Errorf("unexpected status %s", resp.Status)
+	}
+
+	// the control agent answers with one response per service
+	var responses []keaResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&responses); err != nil {
+		return keaResponse{}, errors.Wrap(err, "Failed to decode response")
+	}
+	if len(responses) == 0 {
+		return keaResponse{}, errors.New("empty response")
+	}
+	return responses[0], nil
+}
+
+// dnsmasqResolver reads the MAC of leases from the lease file of dnsmasq, e.g.
+// 1718272800 08:c0:eb:a2:99:04 10.0.0.30 machine-1 01:08:c0:eb:a2:99:04
+// IPv6 leases follow the duid line of the server and carry the IAID and the
+// DUID of the client instead of the MAC, e.g.
+// 1718280000 2849765888 fd00::d:1 machine-1 00:01:00:01:2c:1f:5e:8a:08:c0:eb:a2:99:04
+// The MAC is taken from DUIDs holding a link-layer address.
+type dnsmasqResolver struct {
+	leaseFile string
+	now       func() time.Time
+}
+
+func (r dnsmasqResolver) resolve(ctx context.Context, client macClient) (string, error) {
+	addr, err := netip.ParseAddr(client.IP)
+	if err != nil {
+		return "", nil
+	}
+	addr = addr.Unmap()
+
+	file, err := os.Open(r.leaseFile)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to read dnsmasq leases")
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		ip, err := netip.ParseAddr(fields[2])
+		if err != nil || ip != addr {
+			continue
+		}
+		// an expiry of 0 is an infinite lease
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil || (expiry != 0 && time.Unix(expiry, 0).Before(r.now())) {
+			continue
+		}
+		if addr.Is4() {
+			return normalizeMac(fields[1]), nil
+		}
+		if len(fields) < 5 {
+			continue
+		}
+		duid, _ := hex.DecodeString(strings.ReplaceAll(fields[4], ":", ""))
+		return duidMac(ctx, addr, duid), nil
+	}
+	return "", errors.Wrap(scanner.Err(), "Failed to read dnsmasq leases")
+}
+
+// iscResolver reads the MAC of leases from the lease file of the ISC DHCP
+// server, dhcpd.leases or dhcpd6.leases. The file is a log, later
+// declarations of a lease replace earlier ones.
+type iscResolver struct {
+	leaseFile string
+	now       func() time.Time
+}
+
+// iscLease is the part of a lease declaration used to find the MAC, e.g.
+//
+//	lease 10.0.0.30 {
+//	  ends 4 2024/06/13 22:00:00;
+//	  binding state active;
+//	  hardware ethernet 08:c0:eb:a2:99:04;
+//	}
+//
+// IPv6 leases are the iaaddr declarations of an ia-na, the MAC is taken from
+// the DUID of the client following the IAID in the ia-na identifier, e.g.
+//
+//	ia-na "\001\000\000\000\000\003\000\001\010\300\353\242\231\004" {
+//	  iaaddr fd00::b:1 {
+//	    binding state active;
+//	    ends 4 2024/06/13 22:00:00;
+//	  }
+//	}
+type iscLease struct {
+	ip      netip.Addr
+	mac     string
+	duid    []byte
+	ends    time.Time
+	binding string
+}
+
+func (r iscResolver) resolve(ctx context.Context, client macClient) (string, error) {
+	addr, err := netip.ParseAddr(client.IP)
+	if err != nil {
+		return "", nil
+	}
+	addr = addr.Unmap()
+
+	file, err := os.Open(r.leaseFile)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to read ISC DHCP leases")
+	}
+	defer file.Close()
+
+	var found *iscLease
+	var lease *iscLease
+	// duid is the DUID of the client of the ia-na declaration being read
+	var duid []byte
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if comment := strings.Index(line, "#"); comment >= 0 {
+			line = strings.TrimSpace(line[:comment])
+		}
+		fields := strings.Fields(strings.TrimSuffix(line, ";"))
+		switch {
+		case len(fields) == 0:
+		case fields[0] == "lease" && len(fields) >= 2:
+			lease = &iscLease{}
+			lease.ip, _ = netip.ParseAddr(fields[1])
+		case fields[0] == "ia-na" && len(fields) >= 2:
+			duid = nil
+			if ia := unquoteISC(line); len(ia) > 4 {
+				duid = ia[4:]
+			}
+		case fields[0] == "iaaddr" && len(fields) >= 2:
+			lease = &iscLease{duid: duid}
+			lease.ip, _ = netip.ParseAddr(fields[1])
+		case lease == nil:
+		case fields[0] == "}":
+			if lease.ip == addr {
+				found = lease
+			}
+			lease = nil
+		case fields[0] == "hardware" && len(fields) == 3:
+			lease.mac = normalizeMac(fields[2])
+		case fields[0] == "binding" && len(fields) == 3 && fields[1] == "state":
+			lease.binding = fields[2]
+		case fields[0] == "ends":
+			lease.ends = parseISCTime(fields[1:])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", errors.Wrap(err, "Failed to read ISC DHCP leases")
+	}
+
+	if found == nil || (found.binding != "" && found.binding != "active") {
+		return "", nil
+	}
+	if !found.ends.IsZero() && found.ends.Before(r.now()) {
+		return "", nil
+	}
+	if found.duid != nil {
+		return duidMac(ctx, addr, found.duid), nil
+	}
+	return found.mac, nil
+}
+
+// unquoteISC returns the bytes of the first quoted string of line, in which
+// the ISC DHCP server escapes unprintable bytes in octal, e.g. "\001\010".
+func unquoteISC(line string) []byte {
+	start := strings.Index(line, `"`)
+	if start < 0 {
+		return nil
+	}
+	var out []byte
+	for k := start + 1; k < len(line); k++ {
+		switch {
+		case line[k] == '"':
+			return out
+		case line[k] == '\\' && k+3 < len(line) && isOctal(line[k+1:k+4]):
+			b, _ := strconv.ParseUint(line[k+1:k+4], 8, 8)
+			out = append(out, byte(b))
+			k += 3
+		case line[k] == '\\' && k+1 < len(line):
+			k++
+			out = append(out, line[k])
+		default:
+			out = append(out, line[k])
+		}
+	}
+	return nil
+}
+
+func isOctal(digits string) bool {
+	for _, digit := range digits {
+		if digit < '0' || digit > '7' {
+			return false
+		}
+	}
+	return true
+}
+
+// duidMac returns the MAC of a DUID-LLT or DUID-LL of an Ethernet interface.
+// Other DUIDs, e.g. DUID-UUID of most UEFI firmwares, hold no MAC, their
+// leases can not be used.
+func duidMac(ctx context.Context, addr netip.Addr, data []byte) string {
+	duid, err := dhcpv6.DUIDFromBytes(data)
+	var hwType iana.HWType
+	var hwAddr net.HardwareAddr
+	switch d := duid.(type) {
+	case *dhcpv6.DUIDLLT:
+		hwType, hwAddr = d.HWType, d.LinkLayerAddr
+	case *dhcpv6.DUIDLL:
+		hwType, hwAddr = d.HWType, d.LinkLayerAddr
+	}
+	if err != nil || hwType != iana.HWTypeEthernet || len(hwAddr) != 6 {
+		loggerFrom(ctx).Info("Lease has a DUID without MAC", "clientIP", addr.String(), "duid", hex.EncodeToString(data))
+		return ""
+	}
+	return hex.EncodeToString(hwAddr)
+}
+
+// parseISCTime parses the time of a lease, either "never", "epoch <seconds>"
+// or "<weekday> <yyyy/mm/dd> <hh:mm:ss>" in UTC. Leases which never end have
+// a zero time.
+func parseISCTime(fields []string) time.Time {
+	switch {
+	case len(fields) == 2 && fields[0] == "epoch":
+		seconds, err := strconv.ParseInt(fields[1], 10, 64)
+		if err == nil {
+			return time.Unix(seconds, 0)
+		}
+	case len(fields) == 3:
+		t, err := time.Parse("2006/01/02 15:04:05", fields[1]+" "+fields[2])
+		if err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// leaseCache caches the MACs found by the lease resolvers for a short time,
+// so the DHCP server is not asked for every request of a booting machine.
+type leaseCache struct {
+	mu      sync.Mutex
+	entries map[string]leaseCacheEntry
+}
+
+type leaseCacheEntry struct {
+	mac     string
+	expires time.Time
+}
+
+// maxLeaseCacheEntries is the size of the lease cache above which expired
+// entries are removed.
+const maxLeaseCacheEntries = 4096
+
+var leases = &leaseCache{entries: map[string]leaseCacheEntry{}}
+
+// cachedResolver caches the MACs of resolver, including unknown clients.
+// Errors are not cached.
+type cachedResolver struct {
+	resolver macResolver
+	// source identifies the resolver and its config in the cache
+	source string
+	ttl    time.Duration
+	cache  *leaseCache
+}
+
+func (r cachedResolver) resolve(ctx context.Context, client macClient) (string, error) {
+	if r.ttl <= 0 {
+		return r.resolver.resolve(ctx, client)
+	}
+
+	key := fmt.Sprintf("%s/%s", r.source, client.IP)
+	now := time.Now()
+	if mac, ok := r.cache.get(key, now); ok {
+		return mac, nil
+	}
+	mac, err := r.resolver.resolve(ctx, client)
+	if err != nil {
+		return "", err
+	}
+	r.cache.set(key, leaseCacheEntry{mac: mac, expires: now.Add(r.ttl)}, now)
+	return mac, nil
+}
+
+func (c *leaseCache) get(key string, now time.Time) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || !now.Before(entry.expires) {
+		return "", false
+	}
+	return entry.mac, true
+}
+
+func (c *leaseCache) set(key string, entry leaseCacheEntry, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxLeaseCacheEntries {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	c.entries[key] = entry
+}
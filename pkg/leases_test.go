@@ -0,0 +1,231 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// leaseTime is the time the fixture lease files are read at.
+var leaseTime = time.Date(2024, 6, 13, 12, 0, 0, 0, time.UTC)
+
+// fakeKea serves lease4-get and lease6-get of the Kea control agent from
+// leases and counts the requests.
+type fakeKea struct {
+	leases   map[string]string
+	requests atomic.Int32
+	username string
+	password string
+}
+
+func (k *fakeKea) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	k.requests.Add(1)
+	if username, password, _ := r.BasicAuth(); username != k.username || password != k.password {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var command keaCommand
+	Expect(json.NewDecoder(r.Body).Decode(&command)).To(Succeed())
+
+	response := map[string]any{"result": keaResultEmpty, "text": "Lease not found."}
+	switch {
+	case command.Command == "lease4-get" && command.Service[0] == "dhcp4":
+	case command.Command == "lease6-get" && command.Service[0] == "dhcp6" && command.Arguments["type"] == "IA_NA":
+	default:
+		response = map[string]any{"result": 1, "text": "unsupported command"}
+	}
+	ip := command.Arguments["ip-address"]
+	for leased, mac := range k.leases {
+		if netip.MustParseAddr(leased) != netip.MustParseAddr(ip) || response["result"] != keaResultEmpty {
+			continue
+		}
+		response = map[string]any{
+			"result":    keaResultSuccess,
+			"text":      "IPv4 lease found.",
+			"arguments": map[string]any{"ip-address": ip, "hw-address": mac, "state": 0},
+		}
+	}
+	Expect(json.NewEncoder(w).Encode([]any{response})).To(Succeed())
+}
+
+func startFakeKea(kea *fakeKea) string {
+	server := httptest.NewServer(kea)
+	DeferCleanup(server.Close)
+	return server.URL
+}
+
+var _ = Describe("Lease resolver", func() {
+	ctx := context.Background()
+	at := func() time.Time { return leaseTime }
+
+	It("Reads the leases of dnsmasq", func() {
+		resolver := dnsmasqResolver{leaseFile: "testdata/dnsmasq.leases", now: at}
+		for ip, mac := range map[string]string{
+			"10.0.0.30":               "08c0eba29904",
+			"::ffff:10.0.0.30":        "08c0eba29904",
+			"10.0.0.31":               "",
+			"10.0.0.32":               "08c0eba29906",
+			"10.0.0.99":               "",
+			"fd00:da8:fff6:3302::d:1": "08c0eba29904",
+			"fd00:da8:fff6:3302::d:2": "",
+		} {
+			Expect(resolver.resolve(ctx, macClient{IP: ip})).To(Equal(mac), ip)
+		}
+
+		_, err := dnsmasqResolver{leaseFile: "testdata/missing", now: at}.resolve(ctx, macClient{IP: "10.0.0.30"})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Reads the leases of the ISC DHCP server", func() {
+		resolver := iscResolver{leaseFile: "testdata/dhcpd.leases", now: at}
+		for ip, mac := range map[string]string{
+			"10.0.0.30": "08c0eba29904",
+			"10.0.0.31": "",
+			"10.0.0.32": "08c0eba29906",
+			"10.0.0.33": "",
+			"10.0.0.99": "",
+		} {
+			Expect(resolver.resolve(ctx, macClient{IP: ip})).To(Equal(mac), ip)
+		}
+
+		_, err := iscResolver{leaseFile: "testdata/missing", now: at}.resolve(ctx, macClient{IP: "10.0.0.30"})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Reads the IPv6 leases of the ISC DHCP server", func() {
+		resolver := iscResolver{leaseFile: "testdata/dhcpd6.leases", now: at}
+		for ip, mac := range map[string]string{
+			// DUID-LL
+			validIP1: "08c0eba29904",
+			// DUID-LLT with printable bytes
+			validIP2: "08c0eba29905",
+			// DUID-UUID holds no MAC
+			"fd00:da8:fff6:3302::b:3": "",
+			// expired
+			"fd00:da8:fff6:3302::b:4": "",
+			"fd00:da8:fff6:3302::b:9": "",
+		} {
+			Expect(resolver.resolve(ctx, macClient{IP: ip})).To(Equal(mac), ip)
+		}
+	})
+
+	It("Parses the times of ISC leases", func() {
+		Expect(parseISCTime([]string{"4", "2024/06/13", "22:00:00"})).To(Equal(time.Date(2024, 6, 13, 22, 0, 0, 0, time.UTC)))
+		Expect(parseISCTime([]string{"epoch", "1718323200"}).Unix()).To(Equal(int64(1718323200)))
+		Expect(parseISCTime([]string{"never"})).To(BeZero())
+	})
+
+	It("Asks the Kea control agent", func() {
+		passwordFile := filepath.Join(GinkgoT().TempDir(), "password")
+		Expect(os.WriteFile(passwordFile, []byte("secret\n"), 0o600)).To(Succeed())
+		kea := &fakeKea{
+			leases:   map[string]string{"10.0.0.30": "08:c0:eb:a2:99:04", validIP1: "08:c0:eb:a2:99:04"},
+			username: "ipxe",
+			password: "secret",
+		}
+		resolver, err := newKeaResolver(KeaConfig{URL: startFakeKea(kea), Username: "ipxe", PasswordFile: passwordFile})
+		Expect(err).ToNot(HaveOccurred())
+
+		for ip, mac := range map[string]string{
+			"10.0.0.30":        "08c0eba29904",
+			"::ffff:10.0.0.30": "08c0eba29904",
+			validIP1:           "08c0eba29904",
+			"10.0.0.99":        "",
+			validIP2:           "",
+			"invalid":          "",
+		} {
+			Expect(resolver.resolve(ctx, macClient{IP: ip})).To(Equal(mac), ip)
+		}
+
+		By("Reading the MAC of lease6 from the DUID")
+		lease6, err := os.ReadFile("testdata/kea-lease6-get.json")
+		Expect(err).ToNot(HaveOccurred())
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write(lease6)
+		}))
+		DeferCleanup(server.Close)
+		lease6Resolver, err := newKeaResolver(KeaConfig{URL: server.URL})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(lease6Resolver.resolve(ctx, macClient{IP: validIP1})).To(Equal("08c0eba29904"))
+
+		By("Failing when Kea can not be asked")
+		resolver.conf.Username = "unknown"
+		_, err = resolver.resolve(ctx, macClient{IP: "10.0.0.30"})
+		Expect(err).To(HaveOccurred())
+
+		_, err = newKeaResolver(KeaConfig{})
+		Expect(err).To(HaveOccurred())
+		Expect(MacResolverConfig{Order: []string{MacResolverKea}, Trusted: [][]string{{MacResolverKea}}}.validate()).ToNot(Succeed())
+	})
+
+	It("Caches the leases for a short time", func() {
+		kea := &fakeKea{leases: map[string]string{"10.0.0.30": "08:c0:eb:a2:99:04"}}
+		url := startFakeKea(kea)
+		conf := MacResolverConfig{Order: []string{MacResolverKea}, Kea: KeaConfig{URL: url}, LeaseCacheTTL: "1h"}
+		resolver, err := IPXE{Config: Config{MacResolvers: conf}}.newMacResolver(MacResolverKea)
+		Expect(err).ToNot(HaveOccurred())
+
+		for range 3 {
+			Expect(resolver.resolve(ctx, macClient{IP: "10.0.0.30"})).To(Equal("08c0eba29904"))
+			Expect(resolver.resolve(ctx, macClient{IP: "10.0.0.99"})).To(BeEmpty())
+		}
+		Expect(kea.requests.Load()).To(BeNumerically("==", 2))
+
+		By("Expiring the cached leases")
+		cache := &leaseCache{entries: map[string]leaseCacheEntry{}}
+		cache.set("kea/10.0.0.30", leaseCacheEntry{mac: "08c0eba29904", expires: leaseTime}, leaseTime)
+		mac, ok := cache.get("kea/10.0.0.30", leaseTime.Add(-time.Second))
+		Expect(ok).To(BeTrue())
+		Expect(mac).To(Equal("08c0eba29904"))
+		_, ok = cache.get("kea/10.0.0.30", leaseTime)
+		Expect(ok).To(BeFalse())
+
+		By("Not caching when disabled")
+		conf.LeaseCacheTTL = "0s"
+		resolver, err = IPXE{Config: Config{MacResolvers: conf}}.newMacResolver(MacResolverKea)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resolver.resolve(ctx, macClient{IP: "10.0.0.31"})).To(BeEmpty())
+		Expect(resolver.resolve(ctx, macClient{IP: "10.0.0.31"})).To(BeEmpty())
+		Expect(kea.requests.Load()).To(BeNumerically("==", 4))
+	})
+
+	Context("Chain", func() {
+		SetupTestData(ctx)
+
+		It("Serves machines without IPAM IPs by their lease", func() {
+			kea := &fakeKea{leases: map[string]string{"10.0.0.30": "08:c0:eb:a2:99:04", validIP1: "08:c0:eb:a2:99:05"}}
+			resolving := ipxe
+			resolving.Config.MacResolvers = MacResolverConfig{
+				Order:   []string{MacResolverIPAM, MacResolverKea},
+				Trusted: [][]string{{MacResolverIPAM}, {MacResolverKea}},
+				Kea:     KeaConfig{URL: startFakeKea(kea)},
+			}
+
+			resolution, err := resolving.resolveMac(ctx, nil, "10.0.0.30")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resolution).To(Equal(macResolution{MAC: "08c0eba29904", Trusted: true, Sources: []string{MacResolverKea}}))
+
+			rr := httptest.NewRecorder()
+			resolving.getRouter().ServeHTTP(rr, requestFrom(fmt.Sprintf("/ipxe/%s/boot", uuid), "10.0.0.30"))
+			Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+
+			By("Rejecting clients whose lease does not match IPAM")
+			_, err = resolving.resolveMac(ctx, nil, validIP1)
+			Expect(err).To(BeAssignableToTypeOf(&UnknownClientError{}))
+		})
+	})
+})
@@ -0,0 +1,189 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	ctrlzap "sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+// RequestIDHeader carries the ID of a request. An ID set by a proxy in front
+// of the service is kept, otherwise a new one is generated. The ID is added
+// to all log lines of the request and returned in the response.
+const RequestIDHeader = "X-Request-ID"
+
+// Log levels of LogConfig. At debug level the rendered iPXE scripts and
+// ignitions are logged, with sensitive fields redacted.
+const (
+	LogLevelError = "error"
+	LogLevelInfo  = "info"
+	LogLevelDebug = "debug"
+)
+
+// redacted replaces sensitive values in log lines.
+const redacted = "[redacted]"
+
+// LogConfig configures the logger. Format is json or console. The level is
+// updated on config reload, the format only on restart.
+type LogConfig struct {
+	Level  string `yaml:"level,omitempty"`
+	Format string `yaml:"format,omitempty"`
+}
+
+var (
+	logLevel = zap.NewAtomicLevelAt(zapcore.InfoLevel)
+	logger   = newLogger(ctrlzap.JSONEncoder())
+)
+
+// SetupLogger configures the logger of the service and returns it, so it can
+// be passed on to controller-runtime.
+func SetupLogger(conf LogConfig) logr.Logger {
+	setLogLevel(conf.Level)
+
+	encoder := ctrlzap.JSONEncoder()
+	if conf.Format == "console" {
+		encoder = ctrlzap.ConsoleEncoder()
+	}
+	logger = newLogger(encoder)
+	return logger
+}
+
+func newLogger(encoder ctrlzap.Opts) logr.Logger {
+	return ctrlzap.New(ctrlzap.Level(logLevel), ctrlzap.StacktraceLevel(zapcore.PanicLevel), encoder).WithName("ipxe-service")
+}
+
+func setLogLevel(level string) {
+	switch level {
+	case LogLevelError:
+		logLevel.SetLevel(zapcore.ErrorLevel)
+	case LogLevelDebug:
+		logLevel.SetLevel(zapcore.DebugLevel)
+	case LogLevelInfo, "":
+		logLevel.SetLevel(zapcore.InfoLevel)
+	default:
+		logger.Info("Unknown log level, use info", "level", level)
+		logLevel.SetLevel(zapcore.InfoLevel)
+	}
+}
+
+// loggerFrom returns the logger of the request of ctx, or the service logger
+// outside of requests.
+func loggerFrom(ctx context.Context) logr.Logger {
+	if l, err := logr.FromContext(ctx); err == nil {
+		return l
+	}
+	return logger
+}
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// withRequestLogger assigns an ID to every request and stores a logger with
+// the ID in the request context.
+func withRequestLogger(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(RequestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		log := logger.WithValues("requestID", id)
+		if spanContext := trace.SpanContextFromContext(r.Context()); spanContext.IsValid() {
+			log = log.WithValues("traceID", spanContext.TraceID().String())
+		}
+		log.V(1).Info("Received request", "method", r.Method, "path", r.URL.Path, "remoteAddr", r.RemoteAddr)
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(recorder, r.WithContext(logr.NewContext(r.Context(), log)))
+		log.V(1).Info("Served request", "status", recorder.status, "duration", time.Since(start))
+	})
+}
+
+// MarshalLog redacts the kubeconfig when the template data is logged.
+func (d IgnitionTemplateData) MarshalLog() any {
+	type data IgnitionTemplateData
+	out := data(d)
+	if out.Kubeconfig != "" {
+		out.Kubeconfig = redacted
+	}
+	return out
+}
+
+// sensitiveIgnitionKeys are the fields of an ignition config whose values
+// may carry secrets like kubeconfigs or passwords.
+var sensitiveIgnitionKeys = map[string]bool{
+	"source":            true,
+	"contents":          true,
+	"passwordHash":      true,
+	"sshAuthorizedKeys": true,
+	"verification":      true,
+}
+
+// redactIgnition returns the ignition config with file contents, unit
+// contents and credentials replaced, so it can be logged.
+func redactIgnition(ignition string) string {
+	var config any
+	if err := json.Unmarshal([]byte(ignition), &config); err != nil {
+		return redacted
+	}
+	out, err := json.Marshal(redactJSON(config))
+	if err != nil {
+		return redacted
+	}
+	return string(out)
+}
+
+func redactJSON(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, child := range v {
+			if sensitiveIgnitionKeys[key] {
+				v[key] = redacted
+				continue
+			}
+			v[key] = redactJSON(child)
+		}
+	case []any:
+		for n := range v {
+			v[n] = redactJSON(v[n])
+		}
+	}
+	return value
+}
+
+// fatal logs err and exits, for errors the service can not start with.
+func fatal(err error, msg string, keysAndValues ...any) {
+	logger.Error(err, msg, keysAndValues...)
+	os.Exit(1)
+}
@@ -0,0 +1,130 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// captureLogs replaces the service logger with one collecting all lines
+// up to verbosity 1 until the end of the spec.
+func captureLogs() *[]string {
+	lines := &[]string{}
+	previous := logger
+	logger = funcr.New(func(prefix, args string) {
+		*lines = append(*lines, prefix+" "+args)
+	}, funcr.Options{Verbosity: 1})
+	DeferCleanup(func() {
+		logger = previous
+	})
+	return lines
+}
+
+var _ = Describe("Logging", func() {
+	Context("Request ID", func() {
+		It("Generates an ID for every request", func() {
+			lines := captureLogs()
+
+			rr := serveRequest(ipxe.Handler(), "/-/ready")
+			Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+			id := rr.Header().Get(RequestIDHeader)
+			Expect(id).To(MatchRegexp(`^[0-9a-f]{32}$`))
+			Expect(*lines).ToNot(BeEmpty())
+			for _, line := range *lines {
+				Expect(line).To(ContainSubstring(id))
+			}
+
+			Expect(serveRequest(ipxe.Handler(), "/-/ready").Header().Get(RequestIDHeader)).ToNot(Equal(id))
+		})
+
+		It("Keeps a valid ID of the client", func() {
+			req := httptest.NewRequest("GET", "/-/ready", nil)
+			req.Header.Set(RequestIDHeader, "proxy-1234.5")
+			rr := httptest.NewRecorder()
+			ipxe.Handler().ServeHTTP(rr, req)
+			Expect(rr.Header().Get(RequestIDHeader)).To(Equal("proxy-1234.5"))
+
+			req = httptest.NewRequest("GET", "/-/ready", nil)
+			req.Header.Set(RequestIDHeader, "bad id\nwith newline")
+			rr = httptest.NewRecorder()
+			ipxe.Handler().ServeHTTP(rr, req)
+			Expect(rr.Header().Get(RequestIDHeader)).To(MatchRegexp(`^[0-9a-f]{32}$`))
+		})
+
+		It("Adds the ID to the log lines of handlers", func() {
+			lines := captureLogs()
+
+			rr := serveRequest(ipxe.Handler(), fmt.Sprintf("/ipxe/%s/boot", badUUID))
+			Expect(rr.Code).Should(BeNumerically("==", http.StatusForbidden))
+			id := rr.Header().Get(RequestIDHeader)
+
+			var failed []string
+			for _, line := range *lines {
+				if strings.Contains(line, "Request failed") {
+					failed = append(failed, line)
+				}
+			}
+			Expect(failed).To(HaveLen(1))
+			Expect(failed[0]).To(ContainSubstring(id))
+			Expect(failed[0]).To(ContainSubstring(ErrorCodeUnknownClient))
+		})
+
+		It("Falls back to the service logger outside of requests", func() {
+			Expect(loggerFrom(logr.NewContext(ctx, logr.Discard()))).To(Equal(logr.Discard()))
+			Expect(loggerFrom(ctx)).To(Equal(logger))
+		})
+	})
+
+	Context("Redaction", func() {
+		It("Redacts the kubeconfig of the template data", func() {
+			lines := captureLogs()
+
+			data := newIgnitionTemplateData(uuid, "08c0eba29904", validIP1, nil)
+			data.Kubeconfig = "apiVersion: v1\nkind: Config\ntoken: secret-token"
+			logger.Info("Render ignition template", "data", data)
+
+			Expect(*lines).To(HaveLen(1))
+			Expect((*lines)[0]).ToNot(ContainSubstring("secret-token"))
+			Expect((*lines)[0]).To(ContainSubstring(redacted))
+			Expect((*lines)[0]).To(ContainSubstring(uuid))
+		})
+
+		It("Redacts file contents and credentials of ignitions", func() {
+			ignition := `{"ignition":{"version":"3.3.0"},"passwd":{"users":[{"name":"core","passwordHash":"$6$hash","sshAuthorizedKeys":["ssh-ed25519 key"]}]},` +
+				`"storage":{"files":[{"path":"/etc/kubeconfig","contents":{"source":"data:,token%3A%20secret"}}]},` +
+				`"systemd":{"units":[{"name":"kubelet.service","contents":"[Service]\nEnvironment=TOKEN=secret"}]}}`
+
+			out := redactIgnition(ignition)
+			Expect(out).ToNot(ContainSubstring("secret"))
+			Expect(out).ToNot(ContainSubstring("$6$hash"))
+			Expect(out).ToNot(ContainSubstring("ssh-ed25519"))
+			Expect(out).To(ContainSubstring("/etc/kubeconfig"))
+			Expect(out).To(ContainSubstring("kubelet.service"))
+
+			Expect(redactIgnition("not json")).To(Equal(redacted))
+		})
+	})
+
+	Context("Level", func() {
+		It("Changes the level at runtime", func() {
+			DeferCleanup(setLogLevel, LogLevelInfo)
+
+			setLogLevel(LogLevelDebug)
+			Expect(logLevel.Enabled(-1)).To(BeTrue())
+			setLogLevel(LogLevelError)
+			Expect(logLevel.Enabled(0)).To(BeFalse())
+			setLogLevel("unknown")
+			Expect(logLevel.Enabled(0)).To(BeTrue())
+			Expect(logLevel.Enabled(-1)).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,113 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	inventoryv1alpha4 "github.com/ironcore-dev/metal/apis/metal/v1alpha4"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// inventoryLookup finds Inventories by a value other than their name, for
+// machines whose SMBIOS UUID is unreliable, e.g. /ipxe/by-mac/${mac}/boot.
+type inventoryLookup struct {
+	// name is used in the path of the route, /ipxe/by-<name>/{value}/{part}
+	name string
+	// pattern of the value in the path
+	pattern string
+	route   string
+	// index is the field index of the cache
+	index string
+	// indexer returns the values of an Inventory, it also filters the live
+	// fallback of the cache
+	indexer client.IndexerFunc
+	// selector narrows the live fallback, if the value can be selected
+	selector func(value string) client.ListOption
+	// normalize returns the value as indexed or empty if it is invalid
+	normalize func(value string) string
+}
+
+var (
+	lookupByMAC = inventoryLookup{
+		name:    "mac",
+		pattern: "[0-9a-fA-F:.-]+",
+		route:   routeIPXEByMAC,
+		index:   InventoryMacIndex,
+		indexer: inventoryMacIndexer,
+		selector: func(mac string) client.ListOption {
+			return client.HasLabels{InventoryMacLabelPrefix + mac}
+		},
+		normalize: normalizeMac,
+	}
+	lookupBySerial = inventoryLookup{
+		name:      "serial",
+		pattern:   "[A-Za-z0-9._-]+",
+		route:     routeIPXEBySerial,
+		index:     InventorySerialIndex,
+		indexer:   inventorySerialIndexer,
+		normalize: func(serial string) string { return serial },
+	}
+	lookupByAsset = inventoryLookup{
+		name:    "asset",
+		pattern: "[A-Za-z0-9._-]+",
+		route:   routeIPXEByAsset,
+		index:   InventoryAssetIndex,
+		indexer: labelIndexer(InventoryAssetLabel),
+		selector: func(asset string) client.ListOption {
+			return client.MatchingLabels{InventoryAssetLabel: asset}
+		},
+		normalize: func(asset string) string { return asset },
+	}
+)
+
+var inventoryLookups = []inventoryLookup{lookupByMAC, lookupBySerial, lookupByAsset}
+
+func inventorySerialIndexer(obj client.Object) []string {
+	inventory, ok := obj.(*inventoryv1alpha4.Inventory)
+	if !ok || inventory.Spec.System == nil || inventory.Spec.System.SerialNumber == "" {
+		return nil
+	}
+	return []string{inventory.Spec.System.SerialNumber}
+}
+
+// getChainByLookup serves the iPXE config of the single Inventory found by
+// lookup. The MAC of the client still has to belong to the Inventory.
+func getChainByLookup(lookup inventoryLookup) func(IPXE, http.ResponseWriter, *http.Request) {
+	return func(i IPXE, w http.ResponseWriter, r *http.Request) {
+		m := newRequestMetrics(r.Context(), requestIPXEDuration, lookup.route)
+		defer m.observe()
+
+		value := lookup.normalize(mux.Vars(r)["value"])
+		if value == "" {
+			m.writeError(w, r, &RequestError{Reason: "invalid " + lookup.name})
+			return
+		}
+		i.serveChain(w, r, m, func(ctx context.Context) (*inventoryv1alpha4.Inventory, error) {
+			return i.K8sClient.lookupInventory(ctx, lookup, value, i.Config.InventoryNS)
+		})
+	}
+}
+
+// lookupInventory returns the single Inventory with value.
+func (k K8sClient) lookupInventory(ctx context.Context, lookup inventoryLookup, value, namespace string) (*inventoryv1alpha4.Inventory, error) {
+	inventories, err := k.getInventories(ctx, lookup, value, namespace)
+	if err != nil {
+		return nil, err
+	}
+	switch len(inventories) {
+	case 0:
+		return nil, &NotFoundError{Kind: "Inventory", Namespace: namespace, Name: lookup.name + " " + value}
+	case 1:
+		return &inventories[0], nil
+	default:
+		names := make([]string, 0, len(inventories))
+		for _, inventory := range inventories {
+			names = append(names, inventory.Name)
+		}
+		return nil, &ConflictError{Kind: "Inventory", Key: lookup.name + " " + value, Names: names}
+	}
+}
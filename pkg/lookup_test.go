@@ -0,0 +1,114 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+
+	inventoryv1alpha4 "github.com/ironcore-dev/metal/apis/metal/v1alpha4"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/cache/informertest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+const serial = "W800656X"
+
+var _ = Describe("Inventory lookup", func() {
+	ctx := context.Background()
+	SetupTestData(ctx)
+
+	serve := func(url, ip string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		ipxe.getRouter().ServeHTTP(rr, requestFrom(url, ip))
+		return rr
+	}
+	expectMachineConfig := func(rr *httptest.ResponseRecorder) {
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+		expected, err := os.ReadFile("../config/samples/configmap/ipxe-f2175eb4-e203-11ec-b5d5-3a68dd76b473")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rr.Body.String()).To(Equal(string(expected)))
+	}
+	createInventory := func(name string, labels map[string]string, serialNumber string) {
+		inventory := &inventoryv1alpha4.Inventory{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: labels},
+			Spec: inventoryv1alpha4.InventorySpec{
+				System: &inventoryv1alpha4.SystemSpec{ID: name, SerialNumber: serialNumber},
+			},
+		}
+		Expect(ipxe.K8sClient.Client.Create(ctx, inventory)).To(Succeed())
+		DeferCleanup(ipxe.K8sClient.Client.Delete, ctx, inventory)
+	}
+
+	It("Serves the iPXE config by MAC", func() {
+		expectMachineConfig(serve("/ipxe/by-mac/08:c0:eb:a2:99:04/boot", validIP1))
+		expectMachineConfig(serve("/ipxe/by-mac/08c0eba29905/boot", validIP1))
+		expectMachineConfig(serve("/ipxe/by-mac/08-C0-EB-A2-99-04/boot", validIP2))
+
+		expectError(serve("/ipxe/by-mac/08:c0:eb:a2:99:99/boot", validIP1), http.StatusNotFound, "inventory_not_found")
+		expectError(serve("/ipxe/by-mac/08:c0:eb/boot", validIP1), http.StatusBadRequest, ErrorCodeBadRequest)
+		expectError(serve("/ipxe/by-mac/08:c0:eb:a2:99:04/boot", badIP), http.StatusForbidden, ErrorCodeUnknownClient)
+	})
+
+	It("Serves the iPXE config by serial", func() {
+		expectMachineConfig(serve("/ipxe/by-serial/"+serial+"/boot", validIP1))
+		expectError(serve("/ipxe/by-serial/unknown/boot", validIP1), http.StatusNotFound, "inventory_not_found")
+
+		By("Enforcing the MAC check")
+		createInventory("2c0e3f3a-5b5f-11ef-8c1f-3a68dd76b473", map[string]string{InventoryMacLabelPrefix + "08c0eba29906": ""}, "S1")
+		expectError(serve("/ipxe/by-serial/S1/boot", validIP1), http.StatusForbidden, ErrorCodeMacMismatch)
+
+		By("Rejecting serials of more than one Inventory")
+		createInventory("3a1b7c52-5b5f-11ef-8c1f-3a68dd76b473", nil, serial)
+		expectError(serve("/ipxe/by-serial/"+serial+"/boot", validIP1), http.StatusConflict, ErrorCodeConflict)
+	})
+
+	It("Serves the iPXE config by asset tag", func() {
+		expectError(serve("/ipxe/by-asset/A-0815/boot", validIP1), http.StatusNotFound, "inventory_not_found")
+
+		inventory := &inventoryv1alpha4.Inventory{}
+		Expect(ipxe.K8sClient.Client.Get(ctx, client.ObjectKey{Name: uuid, Namespace: namespace}, inventory)).To(Succeed())
+		inventory.Labels[InventoryAssetLabel] = "A-0815"
+		Expect(ipxe.K8sClient.Client.Update(ctx, inventory)).To(Succeed())
+
+		expectMachineConfig(serve("/ipxe/by-asset/A-0815/boot", validIP1))
+	})
+
+	It("Indexes the Inventories", func() {
+		inventory := &inventoryv1alpha4.Inventory{
+			ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{InventoryAssetLabel: "A-0815"}},
+			Spec:       inventoryv1alpha4.InventorySpec{System: &inventoryv1alpha4.SystemSpec{SerialNumber: serial}},
+		}
+		Expect(inventorySerialIndexer(inventory)).To(Equal([]string{serial}))
+		Expect(lookupByAsset.indexer(inventory)).To(Equal([]string{"A-0815"}))
+		Expect(inventorySerialIndexer(&inventoryv1alpha4.Inventory{})).To(BeEmpty())
+	})
+
+	It("Trusts an empty Inventory cache", func() {
+		var lists atomic.Int32
+		cached := K8sClient{
+			Client: fake.NewClientBuilder().WithInterceptorFuncs(interceptor.Funcs{
+				List: func(ctx context.Context, c client.WithWatch, list client.ObjectList, opts ...client.ListOption) error {
+					lists.Add(1)
+					return c.List(ctx, list, opts...)
+				},
+			}).Build(),
+			Cache: &informertest.FakeInformers{},
+		}
+
+		for _, lookup := range inventoryLookups {
+			inventories := &inventoryv1alpha4.InventoryList{}
+			Expect(cached.listInventories(ctx, inventories, namespace, lookup, "unknown")).To(Succeed())
+			Expect(inventories.Items).To(BeEmpty())
+		}
+		Expect(lists.Load()).To(BeNumerically("==", 0))
+	})
+})
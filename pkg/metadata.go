@@ -0,0 +1,360 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	ipamv1alpha1 "github.com/ironcore-dev/ipam/api/ipam/v1alpha1"
+	inventoryv1alpha4 "github.com/ironcore-dev/metal/apis/metal/v1alpha4"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// PublicKeysKey is the key of the ipxe-<uuid> Secret or the default Secret
+// holding the SSH public keys of the metadata, one per line.
+const PublicKeysKey = "ssh-authorized-keys"
+
+// Metadata is served to the booted OS of a machine on /metadata/{uuid}.
+type Metadata struct {
+	UUID       string            `json:"uuid"`
+	Hostname   string            `json:"hostname"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Network    MetadataNetwork   `json:"network"`
+	Hardware   MetadataHardware  `json:"hardware"`
+	PublicKeys []string          `json:"public-keys,omitempty"`
+}
+
+// MetadataNetwork holds the interfaces of the machine with their IPAM
+// addresses, MAC and ClientIP are the ones of the requesting interface.
+type MetadataNetwork struct {
+	MAC        string              `json:"mac"`
+	ClientIP   string              `json:"client-ip"`
+	Interfaces []MetadataInterface `json:"interfaces,omitempty"`
+}
+
+type MetadataInterface struct {
+	Name      string            `json:"name,omitempty"`
+	MAC       string            `json:"mac"`
+	MTU       uint16            `json:"mtu,omitempty"`
+	Speed     uint32            `json:"speed,omitempty"`
+	Addresses []MetadataAddress `json:"addresses,omitempty"`
+}
+
+type MetadataAddress struct {
+	IP string `json:"ip"`
+	// Subnet is the CIDR of the IPAM Subnet of IP
+	Subnet string `json:"subnet,omitempty"`
+}
+
+// MetadataHardware summarizes the hardware facts of the Inventory.
+type MetadataHardware struct {
+	Manufacturer string         `json:"manufacturer,omitempty"`
+	Product      string         `json:"product,omitempty"`
+	SerialNumber string         `json:"serial-number,omitempty"`
+	CPUs         int            `json:"cpus"`
+	Cores        uint64         `json:"cores"`
+	Threads      int            `json:"threads"`
+	MemoryBytes  uint64         `json:"memory-bytes"`
+	Disks        []MetadataDisk `json:"disks,omitempty"`
+}
+
+type MetadataDisk struct {
+	Name       string `json:"name"`
+	Model      string `json:"model,omitempty"`
+	SizeBytes  uint64 `json:"size-bytes"`
+	Rotational bool   `json:"rotational"`
+}
+
+// verifyMachine returns the Inventory uuid and the MAC and address of the
+// client if the client is the machine: its trusted MAC has to belong to the
+// Inventory, like for the per-machine iPXE scripts and ignition.
+func (i IPXE) verifyMachine(r *http.Request, uuid string) (_ *inventoryv1alpha4.Inventory, mac, clientIP string, err error) {
+	ctx := r.Context()
+	clientIP, err = i.getIP(r)
+	if err != nil {
+		return nil, "", "", err
+	}
+	resolution, err := i.resolveMac(ctx, r, clientIP)
+	if err != nil {
+		return nil, "", "", err
+	}
+	inventory, err := i.K8sClient.getInventory(ctx, uuid, i.Config.InventoryNS)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if err := resolution.requireTrusted(clientIP); err != nil {
+		return nil, "", "", err
+	}
+
+	err = checkInventoryMac(inventory, resolution.MAC)
+	if err != nil {
+		i.K8sClient.EventRecorder.Eventf(inventory, corev1.EventTypeWarning,
+			"Denied", "Denied client %s because mac '%s' does not match for inventory", clientIP, resolution.MAC)
+		logSecurityAlert(loggerFrom(ctx).WithValues("uuid", uuid), r, clientIP, resolution.MAC)
+		return nil, "", "", err
+	}
+	return inventory, resolution.MAC, clientIP, nil
+}
+
+// getMetadata answers with the metadata of the machine uuid as JSON.
+func (i IPXE) getMetadata(w http.ResponseWriter, r *http.Request) {
+	m := newRequestMetrics(r.Context(), requestMetadataDuration, routeMetadata)
+	defer m.observe()
+
+	metadata, ok := i.verifiedMetadata(w, r, m)
+	if !ok {
+		return
+	}
+	m.served("json", outcomeServed, sourceNone)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(metadata)
+}
+
+// getMetadataPath answers with a value of the metadata of the machine uuid in
+// the layout of the EC2 instance metadata: the path selects a value by its
+// JSON keys and list indexes, objects and lists are answered with their keys,
+// one per line, with a trailing slash for the ones which are not values.
+func (i IPXE) getMetadataPath(w http.ResponseWriter, r *http.Request) {
+	m := newRequestMetrics(r.Context(), requestMetadataDuration, routeMetadata)
+	defer m.observe()
+
+	metadata, ok := i.verifiedMetadata(w, r, m)
+	if !ok {
+		return
+	}
+	metadataPath := mux.Vars(r)["path"]
+	body, err := metadataValue(metadata, metadataPath)
+	if err != nil {
+		m.writeError(w, r, err)
+		return
+	}
+	m.served("tree", outcomeServed, sourceNone)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write(body)
+}
+
+func (i IPXE) verifiedMetadata(w http.ResponseWriter, r *http.Request, m *requestMetrics) (Metadata, bool) {
+	uuid := mux.Vars(r)["uuid"]
+	trace.SpanFromContext(r.Context()).SetAttributes(attrUUID.String(uuid))
+	inventory, mac, clientIP, err := i.verifyMachine(r, uuid)
+	if err != nil {
+		m.writeError(w, r, err)
+		return Metadata{}, false
+	}
+	metadata, err := i.machineMetadata(r.Context(), inventory, mac, clientIP)
+	if err != nil {
+		m.writeError(w, r, err)
+		return Metadata{}, false
+	}
+	loggerFrom(r.Context()).Info("Serve metadata", "uuid", uuid, "clientIP", clientIP)
+	return metadata, true
+}
+
+// machineMetadata collects the metadata of inventory. IPAM addresses are
+// optional, lookup errors are only logged.
+func (i IPXE) machineMetadata(ctx context.Context, inventory *inventoryv1alpha4.Inventory, mac, clientIP string) (Metadata, error) {
+	data := newIgnitionTemplateData(inventory.Name, mac, clientIP, inventory)
+	metadata := Metadata{
+		UUID:     inventory.Name,
+		Hostname: data.Hostname,
+		Labels:   inventory.Labels,
+		Network:  MetadataNetwork{MAC: mac, ClientIP: clientIP},
+		Hardware: newMetadataHardware(inventory.Spec),
+	}
+
+	subnets := map[string]string{}
+	interfaces := slices.Clone(inventory.Spec.NICs)
+	if data.NIC == nil {
+		interfaces = append(interfaces, inventoryv1alpha4.NICSpec{MACAddress: mac})
+	}
+	for _, nic := range interfaces {
+		iface := MetadataInterface{
+			Name:  nic.Name,
+			MAC:   strings.ReplaceAll(strings.ToLower(nic.MACAddress), ":", ""),
+			MTU:   nic.MTU,
+			Speed: nic.Speed,
+		}
+		ips, err := i.K8sClient.getIPsFromMac(ctx, iface.MAC, i.Config.IpamNS)
+		if err != nil {
+			loggerFrom(ctx).Info("No IPAM IPs for metadata", "mac", iface.MAC, "error", err.Error())
+		}
+		for _, ip := range ips {
+			if address, ok := i.metadataAddress(ctx, ip, subnets); ok {
+				iface.Addresses = append(iface.Addresses, address)
+			}
+		}
+		metadata.Network.Interfaces = append(metadata.Network.Interfaces, iface)
+	}
+
+	keys, err := i.readPublicKeys(ctx, inventory.Name)
+	if err != nil {
+		return Metadata{}, err
+	}
+	metadata.PublicKeys = keys
+	return metadata, nil
+}
+
+// metadataAddress returns the address of ip with the CIDR of its Subnet.
+// subnets caches the CIDRs by Subnet, machines have several IPs in a Subnet.
+func (i IPXE) metadataAddress(ctx context.Context, ip ipamv1alpha1.IP, subnets map[string]string) (MetadataAddress, bool) {
+	var address MetadataAddress
+	switch {
+	case ip.Status.Reserved != nil:
+		address.IP = ip.Status.Reserved.String()
+	case ip.Spec.IP != nil:
+		address.IP = ip.Spec.IP.String()
+	default:
+		return address, false
+	}
+
+	name := ip.Spec.Subnet.Name
+	cidr, ok := subnets[name]
+	if !ok {
+		subnet, err := i.K8sClient.getSubnet(ctx, name, ip.Namespace)
+		switch {
+		case err != nil:
+			loggerFrom(ctx).Info("No Subnet for metadata", "subnet", name, "error", err.Error())
+		case subnet.Status.Reserved != nil:
+			cidr = subnet.Status.Reserved.String()
+		case subnet.Spec.CIDR != nil:
+			cidr = subnet.Spec.CIDR.String()
+		}
+		subnets[name] = cidr
+	}
+	address.Subnet = cidr
+	return address, true
+}
+
+func newMetadataHardware(spec inventoryv1alpha4.InventorySpec) MetadataHardware {
+	var hardware MetadataHardware
+	if spec.System != nil {
+		hardware.Manufacturer = spec.System.Manufacturer
+		hardware.Product = spec.System.ProductSKU
+		hardware.SerialNumber = spec.System.SerialNumber
+	}
+	hardware.CPUs = len(spec.CPUs)
+	for _, cpu := range spec.CPUs {
+		hardware.Cores += cpu.Cores
+		hardware.Threads += len(cpu.LogicalIDs)
+	}
+	if spec.Memory != nil {
+		hardware.MemoryBytes = spec.Memory.Total
+	}
+	for _, block := range spec.Blocks {
+		hardware.Disks = append(hardware.Disks, MetadataDisk{
+			Name:       block.Name,
+			Model:      block.Model,
+			SizeBytes:  block.Size,
+			Rotational: block.Rotational,
+		})
+	}
+	return hardware
+}
+
+// readPublicKeys reads the SSH public keys of the machine from its ipxe-<uuid>
+// Secret and falls back to the default Secret. Machines without keys get none.
+func (i IPXE) readPublicKeys(ctx context.Context, uuid string) ([]string, error) {
+	secret, err := i.K8sClient.getSecret(ctx, "ipxe-"+uuid, i.Config.ConfigmapNS)
+	var notFoundErr *NotFoundError
+	if err != nil && !errors.As(err, &notFoundErr) {
+		return nil, err
+	}
+	var keys []byte
+	if secret != nil {
+		keys = secret.Data[PublicKeysKey]
+	}
+	if len(keys) == 0 {
+		keys, err = os.ReadFile(filepath.Join(getDefaultSecretPath(), PublicKeysKey))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrap(err, "Failed to read default public keys")
+		}
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(keys))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// metadataValue returns the value of metadata at the slash separated path.
+func metadataValue(metadata Metadata, metadataPath string) ([]byte, error) {
+	encoded, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	for _, segment := range strings.Split(strings.Trim(metadataPath, "/"), "/") {
+		if segment == "" {
+			continue
+		}
+		var ok bool
+		switch v := value.(type) {
+		case map[string]any:
+			value, ok = v[segment]
+		case []any:
+			index, err := strconv.Atoi(segment)
+			if ok = err == nil && index >= 0 && index < len(v); ok {
+				value = v[index]
+			}
+		}
+		if !ok {
+			return nil, &KeyNotFoundError{Kind: "metadata", Name: metadata.UUID, Key: metadataPath}
+		}
+	}
+
+	var out bytes.Buffer
+	switch v := value.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key, child := range v {
+			keys = append(keys, key+metadataDirSuffix(child))
+		}
+		slices.Sort(keys)
+		out.WriteString(strings.Join(keys, "\n"))
+	case []any:
+		for index, child := range v {
+			if index > 0 {
+				out.WriteByte('\n')
+			}
+			fmt.Fprintf(&out, "%d%s", index, metadataDirSuffix(child))
+		}
+	case nil:
+	default:
+		fmt.Fprint(&out, v)
+	}
+	return out.Bytes(), nil
+}
+
+func metadataDirSuffix(value any) string {
+	switch value.(type) {
+	case map[string]any, []any:
+		return "/"
+	default:
+		return ""
+	}
+}
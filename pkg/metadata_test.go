@@ -0,0 +1,94 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("Metadata", func() {
+	ctx := context.Background()
+	SetupTestData(ctx)
+
+	serve := func(url, ip string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		ipxe.getRouter().ServeHTTP(rr, requestFrom(url, ip))
+		return rr
+	}
+
+	It("Serves the metadata of the machine", func() {
+		rr := serve("/metadata/"+uuid, validIP1)
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+		Expect(rr.Header().Get("Content-Type")).To(Equal("application/json"))
+
+		var metadata Metadata
+		Expect(json.Unmarshal(rr.Body.Bytes(), &metadata)).To(Succeed())
+		Expect(metadata.UUID).To(Equal(uuid))
+		Expect(metadata.Hostname).To(Equal(uuid))
+		Expect(metadata.Labels).To(HaveKey("machine.onmetal.de/size-compute-metal"))
+		Expect(metadata.Network.MAC).To(Equal("08c0eba29904"))
+		Expect(metadata.Hardware.SerialNumber).To(Equal("W800656X"))
+		Expect(metadata.Hardware.CPUs).To(BeNumerically(">", 0))
+		Expect(metadata.Hardware.MemoryBytes).To(BeNumerically("==", 1081842454528))
+		Expect(metadata.PublicKeys).To(BeEmpty())
+
+		Expect(metadata.Network.Interfaces).To(HaveLen(2))
+		Expect(metadata.Network.Interfaces[0]).To(Equal(MetadataInterface{
+			Name:      "ens4f0np0",
+			MAC:       "08c0eba29904",
+			MTU:       1500,
+			Speed:     25000,
+			Addresses: []MetadataAddress{{IP: "fd00:da8:fff6:3302::b:1", Subnet: "fd00:da8:fff6::/48"}},
+		}))
+	})
+
+	It("Serves the public keys of the machine", func() {
+		secret := &corev1.Secret{}
+		Expect(ipxe.K8sClient.Client.Get(ctx, client.ObjectKey{Name: "ipxe-" + uuid, Namespace: namespace}, secret)).To(Succeed())
+		secret.Data[PublicKeysKey] = []byte("# operators\nssh-ed25519 AAAA... alice\n\nssh-ed25519 BBBB... bob\n")
+		Expect(ipxe.K8sClient.Client.Update(ctx, secret)).To(Succeed())
+
+		// a cached client sees the update only once the informer got it
+		Eventually(func(g Gomega) {
+			rr := serve("/metadata/"+uuid+"/public-keys/1", validIP1)
+			g.Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+			g.Expect(rr.Body.String()).To(Equal("ssh-ed25519 BBBB... bob"))
+		}).Should(Succeed())
+	})
+
+	It("Serves the metadata as tree", func() {
+		rr := serve("/metadata/"+uuid+"/", validIP1)
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+		Expect(rr.Body.String()).To(Equal("hardware/\nhostname\nlabels/\nnetwork/\nuuid"))
+
+		rr = serve("/metadata/"+uuid+"/hardware/serial-number", validIP1)
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+		Expect(rr.Body.String()).To(Equal("W800656X"))
+
+		rr = serve("/metadata/"+uuid+"/network/interfaces", validIP1)
+		Expect(rr.Body.String()).To(Equal("0/\n1/"))
+		rr = serve("/metadata/"+uuid+"/network/interfaces/0/addresses/0/ip", validIP1)
+		Expect(rr.Body.String()).To(Equal("fd00:da8:fff6:3302::b:1"))
+		rr = serve("/metadata/"+uuid+"/hardware/memory-bytes", validIP1)
+		Expect(rr.Body.String()).To(Equal("1081842454528"))
+
+		expectError(serve("/metadata/"+uuid+"/network/interfaces/2", validIP1), http.StatusNotFound, ErrorCodeKeyNotFound)
+		expectError(serve("/metadata/"+uuid+"/hostname/more", validIP1), http.StatusNotFound, ErrorCodeKeyNotFound)
+	})
+
+	It("Serves the metadata only to the machine", func() {
+		expectError(serve("/metadata/"+uuid, badIP), http.StatusForbidden, ErrorCodeUnknownClient)
+		expectError(serve("/metadata/"+emptyInventoryUUID, validIP1), http.StatusForbidden, ErrorCodeMacMismatch)
+		expectError(serve("/metadata/"+emptyInventoryUUID+"/hostname", validIP1), http.StatusForbidden, ErrorCodeMacMismatch)
+		expectError(serve("/metadata/"+badUUID, validIP1), http.StatusNotFound, "inventory_not_found")
+	})
+})
@@ -0,0 +1,128 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	inventoryv1alpha4 "github.com/ironcore-dev/metal/apis/metal/v1alpha4"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// sampleCount returns the number of observations of the histogram with the
+// given label values.
+func sampleCount(vec *prometheus.HistogramVec, lvs ...string) uint64 {
+	metric := &dto.Metric{}
+	Expect(vec.WithLabelValues(lvs...).(prometheus.Histogram).Write(metric)).To(Succeed())
+	return metric.GetHistogram().GetSampleCount()
+}
+
+var _ = Describe("Metrics", func() {
+	ctx := context.Background()
+	SetupTestData(ctx)
+
+	It("Labels served requests by route, part, outcome and source", func() {
+		served := sampleCount(requestIPXEDuration, routeIPXEByUUID, "boot", outcomeServed, sourceMachineConfigMap)
+		defaulted := sampleCount(requestIPXEDuration, routeIPXEByUUID, "boot", outcomeDefault, sourceDefaultConfigMap)
+
+		rr := serveRequest(ipxe.getRouter(), fmt.Sprintf("/ipxe/%s/boot", uuid))
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+		rr = serveRequest(ipxe.getRouter(), fmt.Sprintf("/ipxe/%s/boot", emptyInventoryUUID))
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+
+		Expect(sampleCount(requestIPXEDuration, routeIPXEByUUID, "boot", outcomeServed, sourceMachineConfigMap)).To(Equal(served + 1))
+		Expect(sampleCount(requestIPXEDuration, routeIPXEByUUID, "boot", outcomeDefault, sourceDefaultConfigMap)).To(Equal(defaulted + 1))
+	})
+
+	It("Does not use client chosen values as labels", func() {
+		notFound := sampleCount(requestIPXEDuration, routeIPXEByUUID, partUnknown, outcomeNotFound, sourceNone)
+		denied := sampleCount(requestIGNITIONDuration, routeIgnition, partUnknown, outcomeDenied, sourceNone)
+
+		rr := serveRequest(ipxe.getRouter(), fmt.Sprintf("/ipxe/%s/missing", uuid))
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusNotFound))
+		rr = serveRequest(ipxe.getRouter(), fmt.Sprintf("/ipxe/%s/boot", badUUID))
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusNotFound))
+		req, err := http.NewRequest("GET", fmt.Sprintf("/ignition/%s/default", uuid), nil)
+		Expect(err).ToNot(HaveOccurred())
+		req.Header.Set("X-FORWARDED-FOR", badIP)
+		req.RemoteAddr = proxyAddr
+		ipxe.getRouter().ServeHTTP(httptest.NewRecorder(), req)
+
+		Expect(sampleCount(requestIPXEDuration, routeIPXEByUUID, partUnknown, outcomeNotFound, sourceNone)).To(Equal(notFound + 2))
+		Expect(sampleCount(requestIGNITIONDuration, routeIgnition, partUnknown, outcomeDenied, sourceNone)).To(Equal(denied + 1))
+
+		for _, vec := range []*prometheus.HistogramVec{requestIPXEDuration, requestIGNITIONDuration} {
+			Expect(vec.DeletePartialMatch(prometheus.Labels{"part": "missing"})).To(BeZero())
+			Expect(vec.DeletePartialMatch(prometheus.Labels{"part": uuid})).To(BeZero())
+		}
+	})
+
+	It("Counts mac mismatch denials", func() {
+		inventory := &inventoryv1alpha4.Inventory{}
+		Expect(ipxe.K8sClient.Client.Get(ctx, client.ObjectKey{Name: uuid, Namespace: namespace}, inventory)).To(Succeed())
+		delete(inventory.Labels, InventoryMacLabelPrefix+"08c0eba29904")
+		Expect(ipxe.K8sClient.Client.Update(ctx, inventory)).To(Succeed())
+
+		before := testutil.ToFloat64(macMismatchTotal.WithLabelValues(routeIPXEByUUID))
+		rr := serveRequest(ipxe.getRouter(), fmt.Sprintf("/ipxe/%s/boot", uuid))
+		expectError(rr, http.StatusForbidden, ErrorCodeMacMismatch)
+		Expect(testutil.ToFloat64(macMismatchTotal.WithLabelValues(routeIPXEByUUID))).To(Equal(before + 1))
+	})
+
+	It("Observes Kubernetes lookups by kind and result", func() {
+		found := sampleCount(kubernetesLookupDuration, "Inventory", "found")
+		notFound := sampleCount(kubernetesLookupDuration, "Inventory", outcomeNotFound)
+		ips := sampleCount(kubernetesLookupDuration, "IP", "found")
+
+		_, err := ipxe.K8sClient.getInventory(ctx, uuid, namespace)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = ipxe.K8sClient.getInventory(ctx, badUUID, namespace)
+		Expect(err).To(HaveOccurred())
+		_, err = ipxe.K8sClient.getMacFromIP(ctx, validIP1, namespace)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(sampleCount(kubernetesLookupDuration, "Inventory", "found")).To(Equal(found + 1))
+		Expect(sampleCount(kubernetesLookupDuration, "Inventory", outcomeNotFound)).To(Equal(notFound + 1))
+		Expect(sampleCount(kubernetesLookupDuration, "IP", "found")).To(BeNumerically(">", ips))
+	})
+
+	It("Observes butane renderings", func() {
+		success := sampleCount(butaneRenderDuration, "success")
+		failed := sampleCount(butaneRenderDuration, outcomeError)
+
+		_, err := renderButane(ctx, []byte("variant: fcos\nversion: 1.4.0\n"))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = renderButane(ctx, []byte("not: butane"))
+		Expect(err).To(HaveOccurred())
+
+		Expect(sampleCount(butaneRenderDuration, "success")).To(Equal(success + 1))
+		Expect(sampleCount(butaneRenderDuration, outcomeError)).To(Equal(failed + 1))
+	})
+
+	It("Records the last boot of an Inventory only when enabled", func() {
+		inventoryLastBootInfo.Reset()
+		DeferCleanup(inventoryLastBootInfo.Reset)
+
+		rr := serveRequest(ipxe.getRouter(), fmt.Sprintf("/ipxe/%s/boot", uuid))
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+		Expect(testutil.CollectAndCount(inventoryLastBootInfo)).To(BeZero())
+
+		enabled := ipxe
+		enabled.Config.Metrics.LastBootInfo = true
+		for range 2 {
+			rr = serveRequest(enabled.getRouter(), fmt.Sprintf("/ipxe/%s/boot", uuid))
+			Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+		}
+		Expect(testutil.CollectAndCount(inventoryLastBootInfo)).To(Equal(1))
+		Expect(testutil.ToFloat64(inventoryLastBootInfo.WithLabelValues(uuid, "08c0eba29904", "boot"))).To(BeNumerically(">", 0))
+	})
+})
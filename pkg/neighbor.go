@@ -0,0 +1,105 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+)
+
+// Neighbor states of the kernel, see include/uapi/linux/neighbour.h.
+const (
+	nudIncomplete = 0x01
+	nudFailed     = 0x20
+)
+
+// atfComplete is the flag of complete entries in /proc/net/arp.
+const atfComplete = 0x02
+
+// listNeighborsV6 dumps the IPv6 neighbor table of the kernel by netlink.
+var listNeighborsV6 = func() ([]netlink.Neigh, error) {
+	return netlink.NeighList(0, syscall.AF_INET6)
+}
+
+// neighborResolver looks up the client in the neighbor table of the kernel,
+// ARP for IPv4 and NDP for IPv6. It only knows clients on the links of the
+// service, e.g. with hostNetwork.
+type neighborResolver struct {
+	arpFile string
+	listV6  func() ([]netlink.Neigh, error)
+}
+
+func (r neighborResolver) resolve(_ context.Context, client macClient) (string, error) {
+	addr, err := netip.ParseAddr(client.IP)
+	if err != nil {
+		return "", nil
+	}
+	addr = addr.Unmap().WithZone("")
+
+	if addr.Is4() {
+		return r.resolveARP(addr)
+	}
+	return r.resolveNDP(addr)
+}
+
+// resolveARP reads the MAC of addr from /proc/net/arp, e.g.
+// 10.0.0.20  0x1  0x2  08:c0:eb:a2:99:04  *  eth0
+func (r neighborResolver) resolveARP(addr netip.Addr) (string, error) {
+	file, err := os.Open(r.arpFile)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to read ARP table")
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	// skip the header
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		ip, err := netip.ParseAddr(fields[0])
+		if err != nil || ip != addr {
+			continue
+		}
+		flags, err := strconv.ParseUint(strings.TrimPrefix(fields[2], "0x"), 16, 32)
+		if err != nil || flags&atfComplete == 0 {
+			continue
+		}
+		if mac := normalizeMac(fields[3]); mac != "" && mac != "000000000000" {
+			return mac, nil
+		}
+	}
+	return "", errors.Wrap(scanner.Err(), "Failed to read ARP table")
+}
+
+// resolveNDP reads the MAC of addr from the IPv6 neighbor table.
+func (r neighborResolver) resolveNDP(addr netip.Addr) (string, error) {
+	neighbors, err := r.listV6()
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to list IPv6 neighbors")
+	}
+
+	for _, neighbor := range neighbors {
+		ip, ok := netip.AddrFromSlice(neighbor.IP)
+		if !ok || ip.WithZone("") != addr {
+			continue
+		}
+		if neighbor.State&(nudIncomplete|nudFailed) != 0 || len(neighbor.HardwareAddr) != 6 {
+			continue
+		}
+		return hex.EncodeToString(neighbor.HardwareAddr), nil
+	}
+	return "", nil
+}
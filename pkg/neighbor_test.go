@@ -0,0 +1,139 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+)
+
+const testARPFile = "testdata/proc-net-arp"
+
+// testNeighborsV6 is a fixture of a netlink dump of the IPv6 neighbor table.
+var testNeighborsV6 = []netlink.Neigh{
+	{IP: net.ParseIP(validIP1), HardwareAddr: mustParseMAC("08:c0:eb:a2:99:04"), State: 0x02},
+	{IP: net.ParseIP(validIP2), HardwareAddr: mustParseMAC("08:c0:eb:a2:99:06"), State: 0x04},
+	{IP: net.ParseIP("fd00:da8:fff6:3302::c:1"), State: nudIncomplete},
+	{IP: net.ParseIP("fd00:da8:fff6:3302::c:2"), HardwareAddr: mustParseMAC("08:c0:eb:a2:99:07"), State: nudFailed},
+	{IP: net.ParseIP("fe80::1"), HardwareAddr: mustParseMAC("52:54:00:12:34:56"), State: 0x80},
+}
+
+func mustParseMAC(mac string) net.HardwareAddr {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		panic(err)
+	}
+	return hw
+}
+
+var _ = Describe("Neighbor resolver", func() {
+	resolver := neighborResolver{
+		arpFile: testARPFile,
+		listV6: func() ([]netlink.Neigh, error) {
+			return testNeighborsV6, nil
+		},
+	}
+	resolve := func(ip string) (string, error) {
+		return resolver.resolve(context.Background(), macClient{IP: ip})
+	}
+
+	It("Reads complete entries of the ARP table", func() {
+		for ip, mac := range map[string]string{
+			"10.0.0.1":           "525400123456",
+			"10.0.0.20":          "08c0eba29904",
+			"::ffff:10.0.0.20":   "08c0eba29904",
+			"10.0.0.22":          "08c0eba29905",
+			"10.0.0.21":          "",
+			"10.0.0.23":          "",
+			"10.0.0.99":          "",
+			"invalid IP address": "",
+		} {
+			Expect(resolve(ip)).To(Equal(mac), ip)
+		}
+
+		_, err := neighborResolver{arpFile: "testdata/missing"}.resolve(context.Background(), macClient{IP: "10.0.0.1"})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Reads reachable entries of the IPv6 neighbor table", func() {
+		for ip, mac := range map[string]string{
+			validIP1:                  "08c0eba29904",
+			validIP2:                  "08c0eba29906",
+			"fe80::1":                 "525400123456",
+			"fd00:da8:fff6:3302::c:1": "",
+			"fd00:da8:fff6:3302::c:2": "",
+			badIP:                     "",
+		} {
+			Expect(resolve(ip)).To(Equal(mac), ip)
+		}
+
+		failing := neighborResolver{listV6: func() ([]netlink.Neigh, error) {
+			return nil, errors.New("netlink not supported")
+		}}
+		_, err := failing.resolve(context.Background(), macClient{IP: validIP1})
+		Expect(err).To(HaveOccurred())
+	})
+
+	Context("Chain", func() {
+		ctx := context.Background()
+		SetupTestData(ctx)
+
+		BeforeEach(func() {
+			previous := listNeighborsV6
+			listNeighborsV6 = resolver.listV6
+			DeferCleanup(func() {
+				listNeighborsV6 = previous
+			})
+		})
+
+		withNeighbor := func(trusted ...[]string) IPXE {
+			resolving := ipxe
+			resolving.Config.MacResolvers = MacResolverConfig{
+				Order:   []string{MacResolverIPAM, MacResolverNeighbor},
+				Trusted: trusted,
+				ARPFile: testARPFile,
+			}
+			return resolving
+		}
+
+		It("Cross-checks the MAC of IPAM", func() {
+			resolving := withNeighbor([]string{MacResolverIPAM, MacResolverNeighbor})
+
+			resolution, err := resolving.resolveMac(ctx, nil, validIP1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resolution.Trusted).To(BeTrue())
+			Expect(resolution.Sources).To(Equal([]string{MacResolverIPAM, MacResolverNeighbor}))
+
+			rr := httptest.NewRecorder()
+			resolving.getRouter().ServeHTTP(rr, requestFrom(fmt.Sprintf("/ipxe/%s/boot", uuid), validIP1))
+			Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+
+			By("Rejecting clients whose neighbor entry does not match IPAM")
+			_, err = resolving.resolveMac(ctx, nil, validIP2)
+			Expect(err).To(BeAssignableToTypeOf(&UnknownClientError{}))
+			rr = httptest.NewRecorder()
+			resolving.getRouter().ServeHTTP(rr, requestFrom(fmt.Sprintf("/ipxe/%s/boot", uuid), validIP2))
+			expectError(rr, http.StatusForbidden, ErrorCodeUnknownClient)
+		})
+
+		It("Falls back to the neighbor table", func() {
+			resolving := withNeighbor([]string{MacResolverIPAM}, []string{MacResolverNeighbor})
+
+			resolution, err := resolving.resolveMac(ctx, nil, "10.0.0.20")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resolution).To(Equal(macResolution{MAC: "08c0eba29904", Trusted: true, Sources: []string{MacResolverNeighbor}}))
+
+			_, err = resolving.resolveMac(ctx, nil, "10.0.0.99")
+			Expect(err).To(BeAssignableToTypeOf(&UnknownClientError{}))
+		})
+	})
+})
@@ -0,0 +1,124 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	inventoryv1alpha4 "github.com/ironcore-dev/metal/apis/metal/v1alpha4"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Annotations of the Inventory for a one-time boot override. The next-boot
+// annotation names the override, once served it is replaced by the consumed
+// annotation holding the override and the time it was served.
+const (
+	NextBootAnnotation         = "metal.ironcore.dev/ipxe-next-boot"
+	NextBootConsumedAnnotation = "metal.ironcore.dev/ipxe-next-boot-consumed"
+)
+
+// serveNextBoot serves the one-time boot override of inventory, the key of
+// its ConfigMap or of the default config named by the next-boot annotation,
+// and consumes it. It returns false if there is no override to serve.
+func (i IPXE) serveNextBoot(w http.ResponseWriter, r *http.Request, m *requestMetrics, inventory *inventoryv1alpha4.Inventory, part, mac, clientIP string) bool {
+	key, ok := inventory.Annotations[NextBootAnnotation]
+	if !ok {
+		return false
+	}
+	uuid := inventory.Name
+	log := loggerFrom(r.Context()).WithValues("uuid", uuid, "part", part, "nextBoot", key)
+	if !partPattern.MatchString(key) {
+		m.writeError(w, r, &RequestError{Reason: "invalid next boot " + key})
+		return true
+	}
+
+	body, source, err := i.readNextBoot(r.Context(), inventory, key)
+	if err != nil {
+		m.writeError(w, r, err)
+		return true
+	}
+	body, err = renderTemplate(r.Context(), key, body, newIPXETemplateData(uuid, mac, clientIP, r.Host, inventory))
+	if err != nil {
+		m.writeError(w, r, err)
+		return true
+	}
+
+	consumed, err := i.K8sClient.consumeNextBoot(r.Context(), inventory, key)
+	if err != nil {
+		m.writeError(w, r, err)
+		return true
+	}
+	if !consumed {
+		log.Info("Next boot was consumed by another request")
+		return false
+	}
+	log.Info("Serve next boot override", "clientIP", clientIP)
+	i.K8sClient.EventRecorder.Eventf(inventory, corev1.EventTypeNormal, "NextBoot",
+		"Served one-time boot override %s to client %s", key, clientIP)
+	i.observeLastBoot(uuid, mac, part)
+
+	log.V(1).Info("Rendered next boot iPXE config", "output", string(body))
+	m.served(part, outcomeNextBoot, source)
+	_, err = w.Write(body)
+	if err != nil {
+		log.Error(err, "Failed to write iPXE config", "mac", mac)
+	}
+	return true
+}
+
+// readNextBoot reads key from the ConfigMap or BootProfile of the machine and
+// falls back to the default config, so rescue scripts can be shared by all
+// machines.
+func (i IPXE) readNextBoot(ctx context.Context, inventory *inventoryv1alpha4.Inventory, key string) ([]byte, string, error) {
+	body, source, err := i.readMachineIPXE(ctx, inventory, key)
+	var notFoundErr *NotFoundError
+	var keyNotFoundErr *KeyNotFoundError
+	if err != nil && !errors.As(err, &notFoundErr) && !errors.As(err, &keyNotFoundErr) {
+		return nil, sourceNone, err
+	}
+	if err == nil {
+		return body, source, nil
+	}
+	return readIpxeConfFile(key)
+}
+
+// consumeNextBoot replaces the next-boot annotation of inventory by the
+// consumed annotation. The patch is guarded by the resource version, so of
+// concurrent requests, also of other replicas, only one consumes the override
+// and gets true.
+func (k K8sClient) consumeNextBoot(ctx context.Context, inventory *inventoryv1alpha4.Inventory, key string) (consumed bool, err error) {
+	ctx, span := startSpan(ctx, "consumeNextBoot", attrUUID.String(inventory.Name))
+	defer func() { endSpan(span, err) }()
+
+	current := inventory.DeepCopy()
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		// the cached Inventory may be stale, only the API server knows if the
+		// override is still pending
+		if err := k.Client.Get(ctx, client.ObjectKeyFromObject(current), current); err != nil {
+			return err
+		}
+		if current.Annotations[NextBootAnnotation] != key {
+			consumed = false
+			return nil
+		}
+
+		patch := client.MergeFromWithOptions(current.DeepCopy(), client.MergeFromWithOptimisticLock{})
+		delete(current.Annotations, NextBootAnnotation)
+		current.Annotations[NextBootConsumedAnnotation] = key + " " + time.Now().UTC().Format(time.RFC3339)
+		if err := k.Client.Patch(ctx, current, patch); err != nil {
+			return err
+		}
+		consumed = true
+		return nil
+	})
+	if err != nil {
+		return false, apiError(err, "Inventory", inventory.Namespace, inventory.Name)
+	}
+	return consumed, nil
+}
@@ -0,0 +1,162 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	inventoryv1alpha4 "github.com/ironcore-dev/metal/apis/metal/v1alpha4"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("Next boot", func() {
+	ctx := context.Background()
+	SetupTestData(ctx)
+
+	var recorder *record.FakeRecorder
+	var booting IPXE
+	BeforeEach(func() {
+		recorder = record.NewFakeRecorder(10)
+		booting = ipxe
+		booting.K8sClient.EventRecorder = recorder
+	})
+
+	getInventory := func() *inventoryv1alpha4.Inventory {
+		inventory := &inventoryv1alpha4.Inventory{}
+		Expect(ipxe.K8sClient.Client.Get(ctx, client.ObjectKey{Name: uuid, Namespace: namespace}, inventory)).To(Succeed())
+		return inventory
+	}
+	setNextBoot := func(key string) {
+		inventory := getInventory()
+		if inventory.Annotations == nil {
+			inventory.Annotations = map[string]string{}
+		}
+		inventory.Annotations[NextBootAnnotation] = key
+		Expect(ipxe.K8sClient.Client.Update(ctx, inventory)).To(Succeed())
+	}
+	addRescue := func() {
+		configMap := &corev1.ConfigMap{}
+		Expect(ipxe.K8sClient.Client.Get(ctx, client.ObjectKey{Name: "ipxe-" + uuid, Namespace: namespace}, configMap)).To(Succeed())
+		configMap.Data["rescue"] = "#!ipxe\necho rescue {{ .UUID }}\n"
+		Expect(ipxe.K8sClient.Client.Update(ctx, configMap)).To(Succeed())
+	}
+	boot := func(ip string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		booting.getRouter().ServeHTTP(rr, requestFrom(fmt.Sprintf("/ipxe/%s/boot", uuid), ip))
+		return rr
+	}
+	machineConfig := func() string {
+		expected, err := os.ReadFile("../config/samples/configmap/ipxe-f2175eb4-e203-11ec-b5d5-3a68dd76b473")
+		Expect(err).ToNot(HaveOccurred())
+		return string(expected)
+	}
+
+	It("Serves the override once", func() {
+		addRescue()
+		setNextBoot("rescue")
+
+		rr := boot(validIP1)
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+		Expect(rr.Body.String()).To(Equal(fmt.Sprintf("#!ipxe\necho rescue %s\n", uuid)))
+
+		inventory := getInventory()
+		Expect(inventory.Annotations).ToNot(HaveKey(NextBootAnnotation))
+		Expect(inventory.Annotations[NextBootConsumedAnnotation]).To(HavePrefix("rescue "))
+		Expect(recorder.Events).To(Receive(ContainSubstring("NextBoot")))
+
+		By("Serving the machine config afterwards")
+		rr = boot(validIP1)
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+		Expect(rr.Body.String()).To(Equal(machineConfig()))
+	})
+
+	It("Falls back to the default config", func() {
+		setNextBoot("ipxe")
+
+		rr := boot(validIP1)
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+		expected, err := os.ReadFile("../config/samples/ipxe-default-cm/ipxe")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rr.Body.String()).To(Equal(string(expected)))
+	})
+
+	It("Keeps the override when it can not be served", func() {
+		setNextBoot("missing")
+		expectError(boot(validIP1), http.StatusNotFound, ErrorCodeKeyNotFound)
+		Expect(getInventory().Annotations).To(HaveKeyWithValue(NextBootAnnotation, "missing"))
+
+		setNextBoot("../boot")
+		expectError(boot(validIP1), http.StatusBadRequest, ErrorCodeBadRequest)
+
+		By("Not serving it to other clients")
+		addRescue()
+		setNextBoot("rescue")
+		expectError(boot(badIP), http.StatusForbidden, ErrorCodeUnknownClient)
+		Expect(getInventory().Annotations).To(HaveKeyWithValue(NextBootAnnotation, "rescue"))
+		Expect(recorder.Events).ToNot(Receive())
+	})
+
+	It("Is consumed by one request only", func() {
+		setNextBoot("rescue")
+		inventory := getInventory()
+
+		var wg sync.WaitGroup
+		var consumed atomic.Int32
+		for range 5 {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				ok, err := ipxe.K8sClient.consumeNextBoot(ctx, inventory, "rescue")
+				Expect(err).ToNot(HaveOccurred())
+				if ok {
+					consumed.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		Expect(consumed.Load()).To(BeNumerically("==", 1))
+	})
+
+	It("Signs the script which was served", func() {
+		certPEM, keyPEM := newRSATestCert()
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: signingSecret, Namespace: namespace},
+			Type:       corev1.SecretTypeTLS,
+			Data:       map[string][]byte{corev1.TLSCertKey: certPEM, corev1.TLSPrivateKeyKey: keyPEM},
+		}
+		Expect(ipxe.K8sClient.Client.Create(ctx, secret)).To(Succeed())
+		DeferCleanup(func() {
+			Expect(ipxe.K8sClient.Client.Delete(ctx, secret)).To(Succeed())
+		})
+		booting.Config.Signing = SigningConfig{Enabled: true, Secret: signingSecret}
+		signature := func() *httptest.ResponseRecorder {
+			rr := httptest.NewRecorder()
+			booting.getRouter().ServeHTTP(rr, requestFrom(fmt.Sprintf("/ipxe/%s/boot%s", uuid, SignatureSuffix), validIP1))
+			return rr
+		}
+		addRescue()
+		setNextBoot("rescue")
+
+		rr := boot(validIP1)
+		Expect(rr.Body.String()).To(Equal(fmt.Sprintf("#!ipxe\necho rescue %s\n", uuid)))
+		expectSignature(signature(), rr.Body.Bytes())
+
+		By("Signing the machine config of the next boot")
+		rr = boot(validIP1)
+		Expect(rr.Body.String()).To(Equal(machineConfig()))
+		expectSignature(signature(), rr.Body.Bytes())
+	})
+})
@@ -3,21 +3,229 @@
 
 package pkg
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Values of the route label.
+const (
+	routeIPXE         = "ipxe"
+	routeIPXEByUUID   = "ipxe_uuid"
+	routeIPXEByMAC    = "ipxe_mac"
+	routeIPXEBySerial = "ipxe_serial"
+	routeIPXEByAsset  = "ipxe_asset"
+	routeIgnition     = "ignition"
+	routeMetadata     = "metadata"
+	routeCloudInit    = "cloud_init"
+	// routeRule is the route of requests served by a rule
+	routeRule = "rule"
+)
+
+// Values of the outcome label.
+const (
+	outcomeServed   = "served"
+	outcomeDefault  = "default"
+	outcomeDenied   = "denied"
+	outcomeNotFound = "not_found"
+	outcomeError    = "error"
+	// outcomeIdentified is the outcome of /ipxe chaining an identified client
+	outcomeIdentified = "identified"
+	// outcomeNextBoot is the outcome of serving a one-time boot override
+	outcomeNextBoot = "next_boot"
+)
+
+// Values of the source label, where the served script or ignition came from.
+const (
+	sourceNone             = "none"
+	sourceMachineConfigMap = "machine_configmap"
+	sourceMachineSecret    = "machine_secret"
+	sourceDefaultSecret    = "default_secret"
+	sourceDefaultConfigMap = "default_configmap"
+	sourceBootProfile      = "boot_profile"
+	sourceRuleInline       = "rule_inline"
+	sourceRuleConfigMap    = "rule_configmap"
+	sourceRuleSecret       = "rule_secret"
+)
+
+// partUnknown replaces the part label of failed requests, the part is chosen
+// by the client and would make the cardinality unbounded.
+const partUnknown = "unknown"
+
+// MetricsConfig configures optional metrics. LastBootInfo adds a series per
+// Inventory, so it is disabled by default.
+type MetricsConfig struct {
+	LastBootInfo bool `yaml:"last-boot-info,omitempty"`
+}
+
+var requestLabels = []string{"route", "part", "outcome", "source"}
 
 var (
 	requestIPXEDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Name:    "ipxe_request_duration_seconds",
-		Help:    "Histogram for the runtime of a simple ipxe(getChainByUUID) function.",
+		Help:    "Histogram of the duration of iPXE requests by route, part, outcome and source.",
 		Buckets: prometheus.LinearBuckets(0.01, 0.05, 10),
 	},
-		[]string{"mac"},
+		requestLabels,
 	)
 	requestIGNITIONDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Name:    "ignition_request_duration_seconds",
-		Help:    "Histogram for the runtime of a simple ignition(getIgnitionByUUID) function.",
+		Help:    "Histogram of the duration of ignition requests by route, part, outcome and source.",
 		Buckets: prometheus.LinearBuckets(0.01, 0.05, 10),
 	},
-		[]string{"mac"},
+		requestLabels,
+	)
+	requestMetadataDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "metadata_request_duration_seconds",
+		Help:    "Histogram of the duration of metadata requests by route, part, outcome and source.",
+		Buckets: prometheus.LinearBuckets(0.01, 0.05, 10),
+	},
+		requestLabels,
+	)
+	requestCloudInitDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cloud_init_request_duration_seconds",
+		Help:    "Histogram of the duration of cloud-init requests by route, part, outcome and source.",
+		Buckets: prometheus.LinearBuckets(0.01, 0.05, 10),
+	},
+		requestLabels,
+	)
+	requestTFTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tftp_request_duration_seconds",
+		Help:    "Histogram for the runtime of a TFTP transfer by outcome.",
+		Buckets: prometheus.LinearBuckets(0.01, 0.05, 10),
+	},
+		[]string{"outcome"},
+	)
+	macMismatchTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ipxe_mac_mismatch_denied_total",
+		Help: "Number of requests denied because the client MAC does not belong to the Inventory.",
+	},
+		[]string{"route"},
+	)
+	kubernetesLookupDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ipxe_kubernetes_lookup_duration_seconds",
+		Help:    "Histogram of the duration of Kubernetes lookups by kind and result.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	},
+		[]string{"kind", "result"},
+	)
+	butaneRenderDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ipxe_butane_render_duration_seconds",
+		Help:    "Histogram of the duration of butane renderings by result.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	},
+		[]string{"result"},
+	)
+	inventoryLastBootInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ipxe_inventory_last_boot_info",
+		Help: "Timestamp of the last iPXE boot of an Inventory, enabled by metrics.last-boot-info.",
+	},
+		[]string{"uuid", "mac", "part"},
+	)
+	macResolverErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ipxe_mac_resolver_errors_total",
+		Help: "Number of failed MAC lookups by resolver, the next resolver is asked instead.",
+	},
+		[]string{"resolver"},
+	)
+	configReloadTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "config_reload_total",
+		Help: "Number of config reloads by result.",
+	},
+		[]string{"result"},
 	)
+	configLastReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful config reload.",
+	})
 )
+
+// requestMetrics collects the labels of a request while it is handled and
+// observes its duration when it is done. The labels are added to the span of
+// the request as well.
+type requestMetrics struct {
+	histogram *prometheus.HistogramVec
+	span      trace.Span
+	start     time.Time
+	route     string
+	part      string
+	outcome   string
+	source    string
+}
+
+func newRequestMetrics(ctx context.Context, histogram *prometheus.HistogramVec, route string) *requestMetrics {
+	return &requestMetrics{
+		histogram: histogram,
+		span:      trace.SpanFromContext(ctx),
+		start:     time.Now(),
+		route:     route,
+		part:      partUnknown,
+		outcome:   outcomeError,
+		source:    sourceNone,
+	}
+}
+
+// served records a successful request.
+func (m *requestMetrics) served(part, outcome, source string) {
+	m.part = part
+	m.outcome = outcome
+	m.source = source
+}
+
+// writeError records the outcome of err and answers the request with it.
+func (m *requestMetrics) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status, _, _ := errorStatus(err)
+	switch status {
+	case http.StatusForbidden:
+		m.outcome = outcomeDenied
+	case http.StatusNotFound:
+		m.outcome = outcomeNotFound
+	default:
+		m.outcome = outcomeError
+	}
+
+	var macMismatchErr *MacMismatchError
+	if errors.As(err, &macMismatchErr) {
+		macMismatchTotal.WithLabelValues(m.route).Inc()
+	}
+
+	writeError(w, r, err)
+}
+
+func (m *requestMetrics) observe() {
+	m.span.SetAttributes(attrRoute.String(m.route), attrOutcome.String(m.outcome), attrSource.String(m.source))
+	m.histogram.WithLabelValues(m.route, m.part, m.outcome, m.source).Observe(time.Since(m.start).Seconds())
+}
+
+// observeLookup records the duration of a Kubernetes lookup of obj which
+// started at start and failed with *err.
+func observeLookup(obj any, start time.Time, err *error) {
+	kind := strings.TrimSuffix(reflect.TypeOf(obj).Elem().Name(), "List")
+
+	result := "found"
+	if *err != nil {
+		result = outcomeError
+		if apierrors.IsNotFound(*err) {
+			result = outcomeNotFound
+		}
+	}
+	kubernetesLookupDuration.WithLabelValues(kind, result).Observe(time.Since(start).Seconds())
+}
+
+// observeLastBoot records the boot of the Inventory uuid when enabled. Older
+// series of the Inventory are removed, so there is one per Inventory.
+func (i IPXE) observeLastBoot(uuid, mac, part string) {
+	if !i.Config.Metrics.LastBootInfo {
+		return
+	}
+	inventoryLastBootInfo.DeletePartialMatch(prometheus.Labels{"uuid": uuid})
+	inventoryLastBootInfo.WithLabelValues(uuid, mac, part).SetToCurrentTime()
+}
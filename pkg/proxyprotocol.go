@@ -0,0 +1,63 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/pires/go-proxyproto"
+	"github.com/pkg/errors"
+)
+
+// ProxyProtocolConfig enables the PROXY protocol v1 and v2 on the HTTP and
+// HTTPS listeners, for load balancers which do not terminate HTTP. The header
+// is only used from peers in TrustedCIDRs and is optional for them, so health
+// checks still work. Connections of other peers sending a header are closed.
+type ProxyProtocolConfig struct {
+	Enabled      bool     `yaml:"enabled,omitempty"`
+	TrustedCIDRs []string `yaml:"trusted-cidrs,omitempty"`
+}
+
+// listen opens the TCP listener of address and wraps it to read the PROXY
+// protocol header when enabled.
+func (i IPXE) listen(address string) (net.Listener, error) {
+	conf := i.Config.HTTP.ProxyProtocol
+	var trusted []netip.Prefix
+	if conf.Enabled {
+		var err error
+		trusted, err = parseTrustedProxies(conf.TrustedCIDRs)
+		if err != nil {
+			return nil, err
+		}
+		if len(trusted) == 0 {
+			return nil, errors.New("PROXY protocol requires trusted-cidrs")
+		}
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if !conf.Enabled {
+		return listener, nil
+	}
+
+	return &proxyproto.Listener{
+		Listener: listener,
+		Policy:   proxyPolicy(trusted),
+	}, nil
+}
+
+// proxyPolicy uses the PROXY header of trusted peers and rejects it from all
+// others. It never returns an error, which would stop the server.
+func proxyPolicy(trusted []netip.Prefix) proxyproto.PolicyFunc {
+	return func(upstream net.Addr) (proxyproto.Policy, error) {
+		addrPort, err := netip.ParseAddrPort(upstream.String())
+		if err == nil && isTrusted(addrPort.Addr().Unmap().WithZone(""), trusted) {
+			return proxyproto.USE, nil
+		}
+		return proxyproto.REJECT, nil
+	}
+}
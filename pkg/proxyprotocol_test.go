@@ -0,0 +1,165 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/pires/go-proxyproto"
+)
+
+// startProxyServer serves handler on a listener of i and returns its address.
+func startProxyServer(i IPXE, handler http.Handler) string {
+	listener, err := i.listen("127.0.0.1:0")
+	Expect(err).ToNot(HaveOccurred())
+	server := &http.Server{Handler: handler}
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	DeferCleanup(server.Close)
+	return listener.Addr().String()
+}
+
+// proxyRequest sends a GET request for path to address, preceded by header
+// if it is not nil.
+func proxyRequest(address, path string, header *proxyproto.Header) (*http.Response, error) {
+	conn, err := net.Dial("tcp", address)
+	Expect(err).ToNot(HaveOccurred())
+	DeferCleanup(conn.Close)
+
+	if header != nil {
+		_, err = header.WriteTo(conn)
+		Expect(err).ToNot(HaveOccurred())
+	}
+	_, err = fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: ipxe\r\nConnection: close\r\n\r\n", path)
+	Expect(err).ToNot(HaveOccurred())
+	return http.ReadResponse(bufio.NewReader(conn), nil)
+}
+
+func proxyHeader(version byte, client string) *proxyproto.Header {
+	transport := proxyproto.TCPv4
+	if strings.Contains(client, ":") {
+		transport = proxyproto.TCPv6
+	}
+	return &proxyproto.Header{
+		Version:           version,
+		Command:           proxyproto.PROXY,
+		TransportProtocol: transport,
+		SourceAddr:        &net.TCPAddr{IP: net.ParseIP(client), Port: 4711},
+		DestinationAddr:   &net.TCPAddr{IP: net.ParseIP(client), Port: 80},
+	}
+}
+
+var _ = Describe("PROXY protocol", func() {
+	echoIP := func(i IPXE) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip, err := i.getIP(r)
+			Expect(err).ToNot(HaveOccurred())
+			_, _ = w.Write([]byte(ip))
+		})
+	}
+	// the server answers with 400 or closes the connection
+	expectRejected := func(resp *http.Response, err error) {
+		if err == nil {
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+		}
+	}
+	body := func(resp *http.Response) string {
+		out, err := io.ReadAll(resp.Body)
+		Expect(err).ToNot(HaveOccurred())
+		return string(out)
+	}
+
+	It("Uses the client address of trusted load balancers", func() {
+		proxied := IPXE{}
+		proxied.Config.HTTP.ProxyProtocol = ProxyProtocolConfig{Enabled: true, TrustedCIDRs: []string{"127.0.0.0/8"}}
+		address := startProxyServer(proxied, echoIP(proxied))
+
+		resp, err := proxyRequest(address, "/", proxyHeader(1, "198.51.100.7"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(body(resp)).To(Equal("198.51.100.7"))
+
+		resp, err = proxyRequest(address, "/", proxyHeader(2, "fd00:da8:fff6:3302::b:1"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(body(resp)).To(Equal("fd00:da8:fff6:3302::b:1"))
+
+		resp, err = proxyRequest(address, "/", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(body(resp)).To(Equal("127.0.0.1"))
+	})
+
+	It("Rejects headers of untrusted peers", func() {
+		proxied := IPXE{}
+		proxied.Config.HTTP.ProxyProtocol = ProxyProtocolConfig{Enabled: true, TrustedCIDRs: []string{"10.0.0.0/8"}}
+		address := startProxyServer(proxied, echoIP(proxied))
+
+		expectRejected(proxyRequest(address, "/", proxyHeader(1, "198.51.100.7")))
+		expectRejected(proxyRequest(address, "/", proxyHeader(2, "198.51.100.7")))
+
+		resp, err := proxyRequest(address, "/", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(body(resp)).To(Equal("127.0.0.1"))
+	})
+
+	It("Is disabled by default", func() {
+		address := startProxyServer(IPXE{}, echoIP(IPXE{}))
+
+		expectRejected(proxyRequest(address, "/", proxyHeader(1, "198.51.100.7")))
+		expectRejected(proxyRequest(address, "/", proxyHeader(2, "198.51.100.7")))
+	})
+
+	It("Requires trusted CIDRs", func() {
+		proxied := IPXE{}
+		proxied.Config.HTTP.ProxyProtocol = ProxyProtocolConfig{Enabled: true}
+		_, err := proxied.listen("127.0.0.1:0")
+		Expect(err).To(HaveOccurred())
+
+		proxied.Config.HTTP.ProxyProtocol.TrustedCIDRs = []string{"invalid"}
+		_, err = proxied.listen("127.0.0.1:0")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Requires disabled forwarding headers", func() {
+		configFile := filepath.Join(GinkgoT().TempDir(), "config.yaml")
+		conf := "http:\n  proxy-protocol:\n    enabled: true\n    trusted-cidrs: [10.0.0.0/24]\n"
+		Expect(os.WriteFile(configFile, []byte(conf), 0o644)).To(Succeed())
+		_, err := LoadConf(configFile)
+		Expect(err).To(MatchError("PROXY protocol requires disable-forward-header"))
+
+		Expect(os.WriteFile(configFile, []byte(conf+"disable-forward-header: true\n"), 0o644)).To(Succeed())
+		_, err = LoadConf(configFile)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	Context("Identity check", func() {
+		ctx := context.Background()
+		SetupTestData(ctx)
+
+		It("Serves machines behind the load balancer without forwarding headers", func() {
+			proxied := ipxe
+			proxied.Config.TrustedProxies = nil
+			proxied.Config.DisableForwardHeader = true
+			proxied.Config.HTTP.ProxyProtocol = ProxyProtocolConfig{Enabled: true, TrustedCIDRs: []string{"127.0.0.1"}}
+			address := startProxyServer(proxied, proxied.Handler())
+
+			resp, err := proxyRequest(address, fmt.Sprintf("/ipxe/%s/boot", uuid), proxyHeader(2, validIP1))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			resp, err = proxyRequest(address, fmt.Sprintf("/ipxe/%s/boot", uuid), proxyHeader(2, badIP))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+		})
+	})
+})
@@ -0,0 +1,160 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// reloadDelay collects the burst of events of a ConfigMap or Secret volume
+// update into a single reload.
+const reloadDelay = time.Second
+
+// configReloader holds the current Config. It is swapped atomically on reload,
+// requests which already took a snapshot finish with the old Config.
+type configReloader struct {
+	configFile string
+	config     atomic.Pointer[Config]
+	mu         sync.Mutex
+}
+
+func newConfigReloader(configFile string, conf Config) *configReloader {
+	c := &configReloader{configFile: configFile}
+	c.config.Store(&conf)
+	return c
+}
+
+// reload parses the config file and swaps it in. On failure, or when a
+// setting changed which is only read at start, the current Config stays
+// active.
+func (c *configReloader) reload() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	conf, err := readConf(c.configFile)
+	if err == nil {
+		err = checkStartSettings(*c.config.Load(), conf)
+	}
+	if err != nil {
+		logger.Error(err, "Failed to reload config", "file", c.configFile)
+		configReloadTotal.WithLabelValues("failure").Inc()
+		return errors.Wrapf(err, "Failed to reload config %s", c.configFile)
+	}
+
+	c.config.Store(&conf)
+	setLogLevel(conf.Log.Level)
+	logger.Info("Reloaded config", "file", c.configFile)
+	configReloadTotal.WithLabelValues("success").Inc()
+	configLastReloadSuccess.SetToCurrentTime()
+	return nil
+}
+
+// checkStartSettings fails when conf changes a setting of old which is only
+// read at start: the namespaces of the cache, the listeners, the TFTP and
+// DHCP servers, the log format and tracing.
+func checkStartSettings(old, conf Config) error {
+	var changed []string
+	for _, setting := range []struct {
+		name     string
+		old, new any
+	}{
+		{"configmap-namespace", old.ConfigmapNS, conf.ConfigmapNS},
+		{"ipam-namespace", old.IpamNS, conf.IpamNS},
+		{"inventory-namespace", old.InventoryNS, conf.InventoryNS},
+		{"disable-cache", old.DisableCache, conf.DisableCache},
+		{"boot-profiles", old.BootProfiles, conf.BootProfiles},
+		{"http", old.HTTP, conf.HTTP},
+		{"tls", old.TLS, conf.TLS},
+		{"tftp", old.TFTP, conf.TFTP},
+		{"dhcp", old.DHCP, conf.DHCP},
+		{"log.format", old.Log.Format, conf.Log.Format},
+		{"tracing", old.Tracing, conf.Tracing},
+	} {
+		if !reflect.DeepEqual(setting.old, setting.new) {
+			changed = append(changed, setting.name)
+		}
+	}
+	if len(changed) > 0 {
+		return errors.Errorf("Changing %s requires a restart", strings.Join(changed, ", "))
+	}
+	return nil
+}
+
+// watch reloads the config whenever the config file or the mounted default
+// Secret and ConfigMap change. Volumes are updated by swapping a symlink, so
+// the directories are watched instead of the files.
+func (c *configReloader) watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "Failed to create file watcher")
+	}
+
+	dirs := []string{filepath.Dir(c.configFile), getDefaultSecretPath(), getDefaultConfigMapPath()}
+	for _, dir := range dirs {
+		if !doesFileExist(dir) {
+			logger.Info("Skip watching directory, it does not exist", "dir", dir)
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			_ = watcher.Close()
+			return errors.Wrapf(err, "Failed to watch %s", dir)
+		}
+		logger.Info("Watching directory for changes", "dir", dir)
+	}
+
+	go func() {
+		defer func() {
+			_ = watcher.Close()
+		}()
+
+		var timer <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				logger.V(1).Info("Detected change", "file", event.Name)
+				timer = time.After(reloadDelay)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Error(err, "Error watching config")
+			case <-timer:
+				timer = nil
+				_ = c.reload()
+			}
+		}
+	}()
+
+	return nil
+}
+
+// current returns a copy of i with the currently active Config.
+func (i IPXE) current() IPXE {
+	if i.reloader != nil {
+		i.Config = *i.reloader.config.Load()
+	}
+	return i
+}
+
+// withConfig binds the handler h to the Config active when the request comes in.
+func (i IPXE) withConfig(h func(IPXE, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h(i.current(), w, r)
+	}
+}
@@ -0,0 +1,90 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Config reload", func() {
+	Context("Reload", func() {
+		It("Swaps the config and keeps it on failure", func() {
+			configFile := filepath.Join(GinkgoT().TempDir(), "config.yaml")
+			Expect(os.WriteFile(configFile, []byte("trusted-proxies: [10.0.0.0/8]\n"), 0o644)).To(Succeed())
+
+			reloadIPXE := ipxe
+			reloadIPXE.reloader = newConfigReloader(configFile, GetConf(configFile))
+			snapshot := reloadIPXE.current()
+			Expect(snapshot.Config.TrustedProxies).To(Equal([]string{"10.0.0.0/8"}))
+
+			Expect(os.WriteFile(configFile, []byte("trusted-proxies: [192.0.2.0/24]\n"), 0o644)).To(Succeed())
+			Expect(reloadIPXE.reloader.reload()).To(Succeed())
+			Expect(reloadIPXE.current().Config.TrustedProxies).To(Equal([]string{"192.0.2.0/24"}))
+			Expect(snapshot.Config.TrustedProxies).To(Equal([]string{"10.0.0.0/8"}))
+
+			Expect(os.WriteFile(configFile, []byte("trusted-proxies: [\n"), 0o644)).To(Succeed())
+			Expect(reloadIPXE.reloader.reload()).ToNot(Succeed())
+			Expect(reloadIPXE.current().Config.TrustedProxies).To(Equal([]string{"192.0.2.0/24"}))
+		})
+
+		It("Rejects changes of settings which are read at start", func() {
+			configFile := filepath.Join(GinkgoT().TempDir(), "config.yaml")
+			Expect(os.WriteFile(configFile, []byte("ipam-namespace: old\ninventory-namespace: old\n"), 0o644)).To(Succeed())
+
+			reloadIPXE := ipxe
+			reloadIPXE.reloader = newConfigReloader(configFile, GetConf(configFile))
+
+			for _, conf := range []string{
+				"ipam-namespace: new\ninventory-namespace: old\n",
+				"ipam-namespace: old\ninventory-namespace: new\n",
+				"ipam-namespace: old\ninventory-namespace: old\nhttp:\n  address: :8080\n",
+				"ipam-namespace: old\ninventory-namespace: old\ntls:\n  address: :8444\n",
+				"ipam-namespace: old\ninventory-namespace: old\ntftp:\n  enabled: true\n",
+				"ipam-namespace: old\ninventory-namespace: old\ndhcp:\n  enabled: true\n",
+				"ipam-namespace: old\ninventory-namespace: old\nlog:\n  format: console\n",
+				"ipam-namespace: old\ninventory-namespace: old\ntracing:\n  endpoint: otel:4318\n",
+			} {
+				Expect(os.WriteFile(configFile, []byte(conf+"trusted-proxies: [10.0.0.0/8]\n"), 0o644)).To(Succeed())
+				err := reloadIPXE.reloader.reload()
+				Expect(err).To(MatchError(ContainSubstring("requires a restart")), conf)
+				Expect(reloadIPXE.current().Config.IpamNS).To(Equal("old"))
+				Expect(reloadIPXE.current().Config.TrustedProxies).To(BeEmpty())
+			}
+
+			By("Keeping the config when the file is gone")
+			Expect(os.Remove(configFile)).To(Succeed())
+			Expect(reloadIPXE.reloader.reload()).To(MatchError(ContainSubstring("Failed to read config")))
+			Expect(reloadIPXE.current().Config.IpamNS).To(Equal("old"))
+		})
+
+		It("Reloads on request from localhost only", func() {
+			configFile := filepath.Join(GinkgoT().TempDir(), "config.yaml")
+			Expect(os.WriteFile(configFile, []byte("disable-forward-header: true\n"), 0o644)).To(Succeed())
+
+			reloadIPXE := ipxe
+			reloadIPXE.reloader = newConfigReloader(configFile, GetConf(configFile))
+			Expect(os.WriteFile(configFile, []byte("trusted-proxies: [10.0.0.0/8]\n"), 0o644)).To(Succeed())
+
+			req, err := http.NewRequest("GET", "/-/reload", nil)
+			Expect(err).ToNot(HaveOccurred())
+			req.RemoteAddr = "192.168.0.1:1234"
+			rr := httptest.NewRecorder()
+			reloadIPXE.withConfig(IPXE.reloadApp).ServeHTTP(rr, req)
+			Expect(rr.Code).Should(BeNumerically("==", http.StatusForbidden))
+			Expect(reloadIPXE.current().Config.TrustedProxies).To(BeEmpty())
+
+			req.RemoteAddr = "127.0.0.1:1234"
+			rr = httptest.NewRecorder()
+			reloadIPXE.withConfig(IPXE.reloadApp).ServeHTTP(rr, req)
+			Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+			Expect(reloadIPXE.current().Config.TrustedProxies).To(Equal([]string{"10.0.0.0/8"}))
+		})
+	})
+})
@@ -0,0 +1,301 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Names of the MAC resolvers used in the config.
+const (
+	MacResolverIPAM      = "ipam"
+	MacResolverIPXEQuery = "ipxe-query"
+	MacResolverEUI64     = "eui64"
+	MacResolverNeighbor  = "neighbor"
+	MacResolverKea       = "kea"
+	MacResolverDnsmasq   = "dnsmasq"
+	MacResolverISC       = "isc-dhcpd"
+)
+
+// MacQueryParameter is the query parameter carrying the MAC reported by
+// iPXE, e.g. /ipxe/${uuid}/boot?mac=${net0/mac}.
+const MacQueryParameter = "mac"
+
+// MacResolverConfig sets the order of the MAC resolvers and the combinations
+// of resolvers which are trusted enough to serve a per-machine config. A MAC
+// is trusted when all resolvers of one combination returned it. By default
+// only the IPAM resolver is used and trusted.
+type MacResolverConfig struct {
+	Order   []string   `yaml:"order,omitempty"`
+	Trusted [][]string `yaml:"trusted,omitempty"`
+	ARPFile string     `yaml:"arp-file,omitempty"`
+
+	Kea              KeaConfig `yaml:"kea,omitempty"`
+	DnsmasqLeaseFile string    `yaml:"dnsmasq-lease-file,omitempty"`
+	ISCLeaseFile     string    `yaml:"isc-lease-file,omitempty"`
+	// LeaseCacheTTL is how long the MACs of the DHCP server leases are cached
+	LeaseCacheTTL string `yaml:"lease-cache-ttl,omitempty"`
+}
+
+// macClient is what is known about a client before its MAC is resolved.
+type macClient struct {
+	IP      string
+	Request *http.Request
+}
+
+// macResolver finds the MAC of a client. It returns an empty MAC when it does
+// not know the client and an error only when it could not be asked.
+type macResolver interface {
+	resolve(ctx context.Context, client macClient) (string, error)
+}
+
+// selfReported resolvers return what the client claims, their MAC is only
+// used to corroborate the MAC of another resolver.
+type selfReported interface {
+	selfReported()
+}
+
+// macResolution is the result of the resolver chain.
+type macResolution struct {
+	MAC     string
+	Trusted bool
+	// Sources are the resolvers which returned MAC
+	Sources []string
+}
+
+func (i IPXE) newMacResolver(name string) (macResolver, error) {
+	conf := i.Config.MacResolvers
+	switch name {
+	case MacResolverIPAM:
+		return ipamResolver{k8sClient: i.K8sClient, namespace: i.Config.IpamNS}, nil
+	case MacResolverIPXEQuery:
+		return ipxeQueryResolver{}, nil
+	case MacResolverEUI64:
+		return eui64Resolver{}, nil
+	case MacResolverNeighbor:
+		arpFile := conf.ARPFile
+		if arpFile == "" {
+			arpFile = DefaultARPFile
+		}
+		return neighborResolver{arpFile: arpFile, listV6: listNeighborsV6}, nil
+	case MacResolverKea:
+		resolver, err := newKeaResolver(conf.Kea)
+		if err != nil {
+			return nil, err
+		}
+		return conf.cached(resolver, name+"/"+conf.Kea.URL), nil
+	case MacResolverDnsmasq:
+		leaseFile := conf.DnsmasqLeaseFile
+		if leaseFile == "" {
+			leaseFile = DefaultDnsmasqLeaseFile
+		}
+		return conf.cached(dnsmasqResolver{leaseFile: leaseFile, now: time.Now}, name+"/"+leaseFile), nil
+	case MacResolverISC:
+		leaseFile := conf.ISCLeaseFile
+		if leaseFile == "" {
+			leaseFile = DefaultISCLeaseFile
+		}
+		return conf.cached(iscResolver{leaseFile: leaseFile, now: time.Now}, name+"/"+leaseFile), nil
+	default:
+		return nil, errors.Errorf("Unknown MAC resolver %s", name)
+	}
+}
+
+func (c MacResolverConfig) cached(resolver macResolver, source string) macResolver {
+	return cachedResolver{
+		resolver: resolver,
+		source:   source,
+		ttl:      durationOrDefault(c.LeaseCacheTTL, DefaultLeaseCacheTTL),
+		cache:    leases,
+	}
+}
+
+func (c MacResolverConfig) order() []string {
+	if len(c.Order) == 0 {
+		return []string{MacResolverIPAM}
+	}
+	return c.Order
+}
+
+func (c MacResolverConfig) trusted() [][]string {
+	if len(c.Trusted) == 0 {
+		return [][]string{{MacResolverIPAM}}
+	}
+	return c.Trusted
+}
+
+// validate checks that all resolvers are known and that the trusted
+// combinations only use resolvers of the order.
+func (c MacResolverConfig) validate() error {
+	err := validateDurations("mac-resolvers.lease-cache-ttl", c.LeaseCacheTTL, "mac-resolvers.kea.timeout", c.Kea.Timeout)
+	if err != nil {
+		return err
+	}
+	order := c.order()
+	for _, name := range order {
+		if _, err := (IPXE{Config: Config{MacResolvers: c}}).newMacResolver(name); err != nil {
+			return err
+		}
+	}
+	for _, combination := range c.trusted() {
+		if len(combination) == 0 {
+			return errors.New("Empty trusted combination of MAC resolvers")
+		}
+		for _, name := range combination {
+			if !slices.Contains(order, name) {
+				return errors.Errorf("Trusted MAC resolver %s is not in the order", name)
+			}
+		}
+	}
+	return nil
+}
+
+// resolveMac asks the resolvers in the configured order for the MAC of the
+// client. The first MAC of a resolver which is not self reported is used.
+// Resolvers returning a different MAC make the client unknown. A failing
+// resolver is logged and skipped, the lookup only fails when all resolvers
+// failed.
+func (i IPXE) resolveMac(ctx context.Context, r *http.Request, clientIP string) (_ macResolution, err error) {
+	ctx, span := startSpan(ctx, "resolveMac")
+	defer func() { endSpan(span, err) }()
+	log := loggerFrom(ctx)
+
+	conf := i.Config.MacResolvers
+	client := macClient{IP: clientIP, Request: r}
+	macs := map[string]string{}
+	var resolution macResolution
+	var failed int
+	var lastErr error
+	for _, name := range conf.order() {
+		resolver, err := i.newMacResolver(name)
+		if err != nil {
+			return macResolution{}, err
+		}
+		mac, err := resolver.resolve(ctx, client)
+		if err != nil {
+			log.Error(err, "MAC resolver failed, ask the next one", "resolver", name, "clientIP", clientIP)
+			macResolverErrorsTotal.WithLabelValues(name).Inc()
+			failed++
+			lastErr = err
+			continue
+		}
+		if mac == "" {
+			continue
+		}
+		log.V(1).Info("Resolved mac", "resolver", name, "mac", mac, "clientIP", clientIP)
+		macs[name] = mac
+
+		if _, ok := resolver.(selfReported); ok {
+			continue
+		}
+		if resolution.MAC != "" && resolution.MAC != mac {
+			return macResolution{}, &UnknownClientError{IP: clientIP, Reason: "MAC resolvers disagree"}
+		}
+		resolution.MAC = mac
+	}
+	if resolution.MAC == "" && failed == len(conf.order()) {
+		return macResolution{}, lastErr
+	}
+	if resolution.MAC == "" {
+		return macResolution{}, &UnknownClientError{IP: clientIP, Reason: "no MAC resolver knows the client"}
+	}
+
+	for _, name := range conf.order() {
+		if macs[name] == resolution.MAC {
+			resolution.Sources = append(resolution.Sources, name)
+		} else if macs[name] != "" {
+			log.Info("Self reported mac does not match", "resolver", name, "mac", macs[name], "resolvedMac", resolution.MAC)
+		}
+	}
+	for _, combination := range conf.trusted() {
+		trusted := true
+		for _, name := range combination {
+			trusted = trusted && slices.Contains(resolution.Sources, name)
+		}
+		resolution.Trusted = resolution.Trusted || trusted
+	}
+
+	span.SetAttributes(attrMAC.String(resolution.MAC), attribute.StringSlice("ipxe.mac.sources", resolution.Sources),
+		attribute.Bool("ipxe.mac.trusted", resolution.Trusted))
+	return resolution, nil
+}
+
+// requireTrusted returns an error if the MAC is not trusted enough to serve
+// a per-machine config.
+func (m macResolution) requireTrusted(clientIP string) error {
+	if m.Trusted {
+		return nil
+	}
+	return &UnknownClientError{IP: clientIP, Reason: "MAC " + m.MAC + " is only known by " + strings.Join(m.Sources, ", ")}
+}
+
+// ipamResolver looks up the mac label of the IPAM IP of the client.
+type ipamResolver struct {
+	k8sClient K8sClient
+	namespace string
+}
+
+func (r ipamResolver) resolve(ctx context.Context, client macClient) (string, error) {
+	mac, err := r.k8sClient.getMacFromIP(ctx, client.IP, r.namespace)
+	var unknownClientErr *UnknownClientError
+	if errors.As(err, &unknownClientErr) {
+		return "", nil
+	}
+	return mac, err
+}
+
+// ipxeQueryResolver returns the MAC iPXE sent in the query of the request.
+type ipxeQueryResolver struct{}
+
+func (ipxeQueryResolver) selfReported() {}
+
+func (ipxeQueryResolver) resolve(_ context.Context, client macClient) (string, error) {
+	if client.Request == nil {
+		return "", nil
+	}
+	return normalizeMac(client.Request.URL.Query().Get(MacQueryParameter)), nil
+}
+
+// eui64Resolver derives the MAC from the interface identifier of an IPv6
+// address built by EUI-64, e.g. SLAAC addresses.
+type eui64Resolver struct{}
+
+func (eui64Resolver) resolve(_ context.Context, client macClient) (string, error) {
+	return macFromEUI64(client.IP), nil
+}
+
+func macFromEUI64(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || !addr.Is6() || addr.Is4In6() {
+		return ""
+	}
+	b := addr.As16()
+	if b[11] != 0xff || b[12] != 0xfe {
+		return ""
+	}
+	// the universal/local bit is inverted in the interface identifier
+	return hex.EncodeToString([]byte{b[8] ^ 0x02, b[9], b[10], b[13], b[14], b[15]})
+}
+
+// normalizeMac returns mac in the format of the IPAM and Inventory labels,
+// lower case hex without separators. Invalid MACs are returned empty.
+func normalizeMac(mac string) string {
+	if hw, err := net.ParseMAC(mac); err == nil && len(hw) == 6 {
+		return hex.EncodeToString(hw)
+	}
+	if b, err := hex.DecodeString(mac); err == nil && len(b) == 6 {
+		return hex.EncodeToString(b)
+	}
+	return ""
+}
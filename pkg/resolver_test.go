@@ -0,0 +1,179 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+
+	ipamv1alpha1 "github.com/ironcore-dev/ipam/api/ipam/v1alpha1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// SLAAC address of 08:c0:eb:a2:99:04, which has no IPAM IP
+	eui64IP  = "fd00:da8:fff6:3302:ac0:ebff:fea2:9904"
+	eui64Mac = "08c0eba29904"
+)
+
+// requestFrom returns a request for url from the client ip.
+func requestFrom(url, ip string) *http.Request {
+	req := httptest.NewRequest("GET", url, nil)
+	req.RemoteAddr = proxyAddr
+	req.Header.Set(HeaderXForwardedFor, ip)
+	return req
+}
+
+var _ = Describe("MAC resolver", func() {
+	It("Derives the MAC of EUI-64 addresses", func() {
+		Expect(macFromEUI64(eui64IP)).To(Equal(eui64Mac))
+		Expect(macFromEUI64("fe80::21b:63ff:fe84:a3c1")).To(Equal("001b6384a3c1"))
+		Expect(macFromEUI64(validIP1)).To(BeEmpty())
+		Expect(macFromEUI64("192.0.2.1")).To(BeEmpty())
+		Expect(macFromEUI64("::ffff:192.0.2.1")).To(BeEmpty())
+		Expect(macFromEUI64("invalid")).To(BeEmpty())
+	})
+
+	It("Normalizes MACs", func() {
+		for _, mac := range []string{"08:c0:eb:a2:99:04", "08-C0-EB-A2-99-04", "08c0.eba2.9904", "08C0EBA29904"} {
+			Expect(normalizeMac(mac)).To(Equal(eui64Mac))
+		}
+		Expect(normalizeMac("")).To(BeEmpty())
+		Expect(normalizeMac("08:c0:eb:a2:99")).To(BeEmpty())
+		Expect(normalizeMac("00:00:00:00:fe:80:00:00:00:00:00:00:00:00:00:00:00:00:00:00")).To(BeEmpty())
+	})
+
+	It("Validates the config", func() {
+		Expect(MacResolverConfig{}.validate()).To(Succeed())
+		Expect(MacResolverConfig{
+			Order:   []string{MacResolverIPAM, MacResolverEUI64, MacResolverIPXEQuery},
+			Trusted: [][]string{{MacResolverIPAM}, {MacResolverEUI64, MacResolverIPXEQuery}},
+		}.validate()).To(Succeed())
+
+		Expect(MacResolverConfig{Order: []string{"unknown"}}.validate()).ToNot(Succeed())
+		Expect(MacResolverConfig{Order: []string{MacResolverEUI64}}.validate()).ToNot(Succeed())
+		Expect(MacResolverConfig{Trusted: [][]string{{}}}.validate()).ToNot(Succeed())
+	})
+
+	Context("Chain", func() {
+		ctx := context.Background()
+		SetupTestData(ctx)
+
+		withResolvers := func(order []string, trusted ...[]string) IPXE {
+			resolving := ipxe
+			resolving.Config.MacResolvers = MacResolverConfig{Order: order, Trusted: trusted}
+			return resolving
+		}
+
+		It("Uses and trusts IPAM by default", func() {
+			resolution, err := ipxe.resolveMac(ctx, nil, validIP1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resolution).To(Equal(macResolution{MAC: "08c0eba29904", Trusted: true, Sources: []string{MacResolverIPAM}}))
+
+			_, err = ipxe.resolveMac(ctx, nil, badIP)
+			Expect(err).To(BeAssignableToTypeOf(&UnknownClientError{}))
+		})
+
+		It("Only uses the MAC of iPXE to corroborate", func() {
+			resolving := withResolvers([]string{MacResolverIPXEQuery, MacResolverIPAM}, []string{MacResolverIPAM, MacResolverIPXEQuery})
+
+			url := fmt.Sprintf("/ipxe/%s/boot", uuid)
+			resolution, err := resolving.resolveMac(ctx, requestFrom(url+"?mac=08:c0:eb:a2:99:04", validIP1), validIP1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resolution.Trusted).To(BeTrue())
+			Expect(resolution.Sources).To(Equal([]string{MacResolverIPXEQuery, MacResolverIPAM}))
+
+			resolution, err = resolving.resolveMac(ctx, requestFrom(url+"?mac=08:c0:eb:a2:99:05", validIP1), validIP1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resolution.MAC).To(Equal("08c0eba29904"))
+			Expect(resolution.Trusted).To(BeFalse())
+
+			_, err = resolving.resolveMac(ctx, requestFrom(url+"?mac=08:c0:eb:a2:99:04", badIP), badIP)
+			Expect(err).To(BeAssignableToTypeOf(&UnknownClientError{}))
+
+			rr := httptest.NewRecorder()
+			resolving.getRouter().ServeHTTP(rr, requestFrom(url+"?mac=08:c0:eb:a2:99:04", validIP1))
+			Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+
+			rr = httptest.NewRecorder()
+			resolving.getRouter().ServeHTTP(rr, requestFrom(url, validIP1))
+			expectError(rr, http.StatusForbidden, ErrorCodeUnknownClient)
+		})
+
+		It("Serves SLAAC clients by EUI-64", func() {
+			resolving := withResolvers([]string{MacResolverIPAM, MacResolverEUI64, MacResolverIPXEQuery},
+				[]string{MacResolverIPAM}, []string{MacResolverEUI64, MacResolverIPXEQuery})
+
+			rr := httptest.NewRecorder()
+			resolving.getRouter().ServeHTTP(rr, requestFrom(fmt.Sprintf("/ipxe/%s/boot?mac=%s", uuid, eui64Mac), eui64IP))
+			Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+
+			By("Serving the default config to untrusted clients")
+			rr = httptest.NewRecorder()
+			resolving.getRouter().ServeHTTP(rr, requestFrom(fmt.Sprintf("/ipxe/%s/boot", emptyInventoryUUID), eui64IP))
+			Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+
+			By("Denying the per-machine config to untrusted clients")
+			rr = httptest.NewRecorder()
+			resolving.getRouter().ServeHTTP(rr, requestFrom(fmt.Sprintf("/ipxe/%s/boot", uuid), eui64IP))
+			expectError(rr, http.StatusForbidden, ErrorCodeUnknownClient)
+			rr = httptest.NewRecorder()
+			resolving.getRouter().ServeHTTP(rr, requestFrom(fmt.Sprintf("/ignition/%s/default", uuid), eui64IP))
+			expectError(rr, http.StatusForbidden, ErrorCodeUnknownClient)
+		})
+
+		It("Asks the next resolver when one fails", func() {
+			resolving := withResolvers([]string{MacResolverDnsmasq, MacResolverIPAM}, []string{MacResolverIPAM})
+			resolving.Config.MacResolvers.DnsmasqLeaseFile = filepath.Join(GinkgoT().TempDir(), "missing.leases")
+			before := testutil.ToFloat64(macResolverErrorsTotal.WithLabelValues(MacResolverDnsmasq))
+
+			resolution, err := resolving.resolveMac(ctx, nil, validIP1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resolution).To(Equal(macResolution{MAC: "08c0eba29904", Trusted: true, Sources: []string{MacResolverIPAM}}))
+			Expect(testutil.ToFloat64(macResolverErrorsTotal.WithLabelValues(MacResolverDnsmasq))).To(Equal(before + 1))
+
+			_, err = resolving.resolveMac(ctx, nil, badIP)
+			Expect(err).To(BeAssignableToTypeOf(&UnknownClientError{}))
+
+			By("Failing when all resolvers fail")
+			resolving.Config.MacResolvers.Order = []string{MacResolverDnsmasq}
+			resolving.Config.MacResolvers.Trusted = [][]string{{MacResolverDnsmasq}}
+			_, err = resolving.resolveMac(ctx, nil, validIP1)
+			Expect(err).To(MatchError(ContainSubstring("Failed to read dnsmasq leases")))
+		})
+
+		It("Rejects clients when resolvers disagree", func() {
+			ip := &ipamv1alpha1.IP{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "fd00-0da8-fff6-3302-0ac0-ebff-fea2-9904-dhcp",
+					Namespace: namespace,
+					Labels: map[string]string{
+						ipLabel:  "fd00-0da8-fff6-3302-0ac0-ebff-fea2-9904",
+						macLabel: "08c0eba29905",
+					},
+				},
+				Spec: ipamv1alpha1.IPSpec{
+					Subnet: corev1.LocalObjectReference{Name: "dhcp"},
+				},
+			}
+			Expect(ipxe.K8sClient.Client.Create(ctx, ip)).To(Succeed())
+			DeferCleanup(ipxe.K8sClient.Client.Delete, ctx, ip)
+
+			resolving := withResolvers([]string{MacResolverIPAM, MacResolverEUI64})
+			_, err := resolving.resolveMac(ctx, nil, eui64IP)
+			Expect(err).To(BeAssignableToTypeOf(&UnknownClientError{}))
+
+			resolution, err := resolving.resolveMac(ctx, nil, validIP1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resolution.Sources).To(Equal([]string{MacResolverIPAM}))
+		})
+	})
+})
@@ -0,0 +1,432 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	inventoryv1alpha4 "github.com/ironcore-dev/metal/apis/metal/v1alpha4"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// RuleHeader names the rule which served a response.
+const RuleHeader = "X-Ipxe-Rule"
+
+// Rule maps the requests it matches to a resource. The rules of the config are
+// evaluated in order before the built-in routes, the first matching rule
+// serves the request.
+type Rule struct {
+	Name     string       `yaml:"name"`
+	Match    RuleMatch    `yaml:"match,omitempty"`
+	Resource RuleResource `yaml:"resource"`
+}
+
+// RuleMatch holds the conditions of a rule, all of them have to match. The
+// path, query parameters and headers are matched by path.Match patterns, e.g.
+// /ipxe/*/boot or iPXE/1.*.
+type RuleMatch struct {
+	Path      string            `yaml:"path,omitempty"`
+	Query     map[string]string `yaml:"query,omitempty"`
+	Headers   map[string]string `yaml:"headers,omitempty"`
+	UserAgent string            `yaml:"user-agent,omitempty"`
+	// Buildarch and Platform match the iPXE settings ${buildarch} and
+	// ${platform}, sent by the client as query parameters of the same name
+	Buildarch string `yaml:"buildarch,omitempty"`
+	Platform  string `yaml:"platform,omitempty"`
+	// Subnets match the client address, e.g. 10.0.0.0/8
+	Subnets []string `yaml:"subnets,omitempty"`
+	// InventorySelector is a label selector, e.g. rack=a,size in (m,l), on the
+	// Inventory of the client identified by its trusted MAC
+	InventorySelector string `yaml:"inventory-selector,omitempty"`
+}
+
+// RuleResource is what a rule serves, exactly one of Inline, ConfigMap, Secret
+// and Default has to be set.
+type RuleResource struct {
+	Inline    string      `yaml:"inline,omitempty"`
+	ConfigMap *RuleKeyRef `yaml:"configmap,omitempty"`
+	Secret    *RuleKeyRef `yaml:"secret,omitempty"`
+	// Default is a key of the default config
+	Default string `yaml:"default,omitempty"`
+	// Template renders the resource with the iPXE template data
+	Template    bool   `yaml:"template,omitempty"`
+	ContentType string `yaml:"content-type,omitempty"`
+}
+
+// RuleKeyRef is a key of a ConfigMap or Secret in the configmap namespace.
+type RuleKeyRef struct {
+	Name string `yaml:"name"`
+	Key  string `yaml:"key"`
+}
+
+func validateRules(rules []Rule) error {
+	names := map[string]bool{}
+	for _, rule := range rules {
+		if !partPattern.MatchString(rule.Name) {
+			return errors.Errorf("Invalid rule name %q", rule.Name)
+		}
+		if names[rule.Name] {
+			return errors.Errorf("Duplicate rule %s", rule.Name)
+		}
+		names[rule.Name] = true
+		if err := rule.Match.validate(); err != nil {
+			return errors.Wrapf(err, "Invalid match of rule %s", rule.Name)
+		}
+		if err := rule.Resource.validate(); err != nil {
+			return errors.Wrapf(err, "Invalid resource of rule %s", rule.Name)
+		}
+	}
+	return nil
+}
+
+func (m RuleMatch) validate() error {
+	patterns := []string{m.Path, m.UserAgent, m.Buildarch, m.Platform}
+	for _, pattern := range m.Query {
+		patterns = append(patterns, pattern)
+	}
+	for _, pattern := range m.Headers {
+		patterns = append(patterns, pattern)
+	}
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "Invalid pattern %s", pattern)
+		}
+	}
+	for _, subnet := range m.Subnets {
+		if _, err := netip.ParsePrefix(subnet); err != nil {
+			return errors.Wrapf(err, "Invalid subnet %s", subnet)
+		}
+	}
+	if _, err := labels.Parse(m.InventorySelector); err != nil {
+		return errors.Wrapf(err, "Invalid inventory selector %s", m.InventorySelector)
+	}
+	return nil
+}
+
+func (r RuleResource) validate() error {
+	sources := 0
+	for _, set := range []bool{r.Inline != "", r.ConfigMap != nil, r.Secret != nil, r.Default != ""} {
+		if set {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return errors.New("Exactly one of inline, configmap, secret and default has to be set")
+	}
+	for _, ref := range []*RuleKeyRef{r.ConfigMap, r.Secret} {
+		if ref != nil && (ref.Name == "" || ref.Key == "") {
+			return errors.New("Name and key of the reference have to be set")
+		}
+	}
+	return nil
+}
+
+// ruleRequest is a request evaluated against the rules. The client address,
+// MAC and Inventory are only resolved once and only when a rule needs them.
+type ruleRequest struct {
+	r *http.Request
+	// path is the path of the script, also for signature requests
+	path       string
+	clientIP   func() (string, error)
+	resolution func() (macResolution, error)
+	inventory  func() (*inventoryv1alpha4.Inventory, error)
+}
+
+func newRuleRequest(i IPXE, r *http.Request) *ruleRequest {
+	rr := &ruleRequest{r: r, path: strings.TrimSuffix(r.URL.Path, SignatureSuffix)}
+	rr.clientIP = sync.OnceValues(func() (string, error) {
+		return i.getIP(r)
+	})
+	rr.resolution = sync.OnceValues(func() (macResolution, error) {
+		clientIP, err := rr.clientIP()
+		if err != nil {
+			return macResolution{}, err
+		}
+		return i.resolveMac(r.Context(), r, clientIP)
+	})
+	rr.inventory = sync.OnceValues(func() (*inventoryv1alpha4.Inventory, error) {
+		clientIP, err := rr.clientIP()
+		if err != nil {
+			return nil, err
+		}
+		resolution, err := rr.resolution()
+		if err != nil {
+			return nil, err
+		}
+		return i.inventoryOfClient(r.Context(), resolution, clientIP)
+	})
+	return rr
+}
+
+// templateData returns the template data of the client as far as it is
+// known, unknown clients get empty fields.
+func (rr *ruleRequest) templateData() IPXETemplateData {
+	clientIP, _ := rr.clientIP()
+	resolution, _ := rr.resolution()
+	inventory, err := rr.inventory()
+	if err != nil {
+		return newIPXETemplateData("", resolution.MAC, clientIP, rr.r.Host, nil)
+	}
+	return newIPXETemplateData(inventory.Name, resolution.MAC, clientIP, rr.r.Host, inventory)
+}
+
+// mismatch returns why the request does not match m, an empty string if it
+// matches. The Inventory is checked last, it is the only costly condition.
+func (m RuleMatch) mismatch(rr *ruleRequest) string {
+	if m.Path != "" && !globMatch(m.Path, rr.path) {
+		return fmt.Sprintf("path %s does not match %s", rr.path, m.Path)
+	}
+
+	query := rr.r.URL.Query()
+	for _, name := range sortedKeys(m.Query) {
+		if reason := valueMismatch("query parameter "+name, m.Query[name], query[name]); reason != "" {
+			return reason
+		}
+	}
+	for _, name := range sortedKeys(m.Headers) {
+		if reason := valueMismatch("header "+name, m.Headers[name], rr.r.Header.Values(name)); reason != "" {
+			return reason
+		}
+	}
+	if m.UserAgent != "" {
+		if reason := valueMismatch("user agent", m.UserAgent, rr.r.Header.Values("User-Agent")); reason != "" {
+			return reason
+		}
+	}
+	if m.Buildarch != "" {
+		if reason := valueMismatch("buildarch", m.Buildarch, query["buildarch"]); reason != "" {
+			return reason
+		}
+	}
+	if m.Platform != "" {
+		if reason := valueMismatch("platform", m.Platform, query["platform"]); reason != "" {
+			return reason
+		}
+	}
+
+	if len(m.Subnets) > 0 {
+		clientIP, err := rr.clientIP()
+		if err != nil {
+			return "client address is unknown: " + err.Error()
+		}
+		addr, err := netip.ParseAddr(clientIP)
+		if err != nil {
+			return "client address is invalid: " + err.Error()
+		}
+		if !slices.ContainsFunc(m.Subnets, func(subnet string) bool {
+			return netip.MustParsePrefix(subnet).Contains(addr.Unmap())
+		}) {
+			return fmt.Sprintf("client %s is not in the subnets", clientIP)
+		}
+	}
+
+	if m.InventorySelector != "" {
+		inventory, err := rr.inventory()
+		if err != nil {
+			return "client is not identified: " + err.Error()
+		}
+		selector, _ := labels.Parse(m.InventorySelector)
+		if !selector.Matches(labels.Set(inventory.Labels)) {
+			return fmt.Sprintf("Inventory %s does not match %s", inventory.Name, m.InventorySelector)
+		}
+	}
+	return ""
+}
+
+// valueMismatch returns why none of values matches pattern, an empty string if
+// one matches.
+func valueMismatch(name, pattern string, values []string) string {
+	if len(values) == 0 {
+		return name + " is missing"
+	}
+	for _, value := range values {
+		if globMatch(pattern, value) {
+			return ""
+		}
+	}
+	return fmt.Sprintf("%s %s does not match %s", name, strings.Join(values, ", "), pattern)
+}
+
+// globMatch reports whether value matches pattern, the patterns are
+// validated when the config is loaded.
+func globMatch(pattern, value string) bool {
+	matched, _ := path.Match(pattern, value)
+	return matched
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// ruleExplanation tells whether a rule matched a request and why not.
+type ruleExplanation struct {
+	Rule    string `json:"rule"`
+	Matched bool   `json:"matched"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// evaluateRules returns the first rule matching rr, nil if none matches, and
+// the explanation of every rule evaluated.
+func (i IPXE) evaluateRules(rr *ruleRequest) (*Rule, []ruleExplanation) {
+	explanations := make([]ruleExplanation, 0, len(i.Config.Rules))
+	for n := range i.Config.Rules {
+		rule := &i.Config.Rules[n]
+		reason := rule.Match.mismatch(rr)
+		explanations = append(explanations, ruleExplanation{Rule: rule.Name, Matched: reason == "", Reason: reason})
+		if reason == "" {
+			return rule, explanations
+		}
+	}
+	return nil, explanations
+}
+
+// withRules serves the requests matched by a rule and passes all others on to
+// next. Signature requests are matched by the path of their script.
+func (i IPXE) withRules(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := i.current()
+		if len(i.Config.Rules) == 0 || r.Method != http.MethodGet {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rr := newRuleRequest(i, r)
+		rule, explanations := i.evaluateRules(rr)
+		log := loggerFrom(r.Context())
+		if rule == nil {
+			log.V(1).Info("No rule matched", "explanations", explanations)
+			next.ServeHTTP(w, r)
+			return
+		}
+		log.V(1).Info("Rule matched", "rule", rule.Name, "explanations", explanations)
+
+		if strings.HasSuffix(r.URL.Path, SignatureSuffix) {
+			i.getSignature(w, r)
+			return
+		}
+		withSignature(func(i IPXE, w http.ResponseWriter, r *http.Request) {
+			i.serveRule(w, r, rule, rr)
+		})(i, w, r)
+	})
+}
+
+func (i IPXE) serveRule(w http.ResponseWriter, r *http.Request, rule *Rule, rr *ruleRequest) {
+	m := newRequestMetrics(r.Context(), requestIPXEDuration, routeRule)
+	defer m.observe()
+	log := loggerFrom(r.Context()).WithValues("rule", rule.Name)
+	trace.SpanFromContext(r.Context()).SetAttributes(attrRule.String(rule.Name))
+
+	body, source, err := i.readRuleResource(r.Context(), rule.Resource)
+	if err != nil {
+		m.writeError(w, r, err)
+		return
+	}
+	if rule.Resource.Template {
+		body, err = renderTemplate(r.Context(), rule.Name, body, rr.templateData())
+		if err != nil {
+			m.writeError(w, r, err)
+			return
+		}
+	}
+
+	log.Info("Serve rule", "source", source)
+	m.served(rule.Name, outcomeServed, source)
+	w.Header().Set(RuleHeader, rule.Name)
+	if rule.Resource.ContentType != "" {
+		w.Header().Set("Content-Type", rule.Resource.ContentType)
+	}
+	_, err = w.Write(body)
+	if err != nil {
+		log.Error(err, "Failed to write rule resource")
+	}
+}
+
+func (i IPXE) readRuleResource(ctx context.Context, resource RuleResource) ([]byte, string, error) {
+	switch {
+	case resource.ConfigMap != nil:
+		ref := resource.ConfigMap
+		configMap, err := i.K8sClient.getConfigMag(ctx, ref.Name, i.Config.ConfigmapNS)
+		if err != nil {
+			return nil, sourceNone, err
+		}
+		data, ok := configMap.Data[ref.Key]
+		if !ok {
+			return nil, sourceNone, &KeyNotFoundError{Kind: "ConfigMap", Name: ref.Name, Key: ref.Key}
+		}
+		return []byte(data), sourceRuleConfigMap, nil
+	case resource.Secret != nil:
+		ref := resource.Secret
+		secret, err := i.K8sClient.getSecret(ctx, ref.Name, i.Config.ConfigmapNS)
+		if err != nil {
+			return nil, sourceNone, err
+		}
+		data, ok := secret.Data[ref.Key]
+		if !ok {
+			return nil, sourceNone, &KeyNotFoundError{Kind: "Secret", Name: ref.Name, Key: ref.Key}
+		}
+		return data, sourceRuleSecret, nil
+	case resource.Default != "":
+		return readIpxeConfFile(resource.Default)
+	default:
+		return []byte(resource.Inline), sourceRuleInline, nil
+	}
+}
+
+type rulesExplanation struct {
+	// Rule is the rule which would serve the request, empty if none matches
+	Rule  string            `json:"rule"`
+	Rules []ruleExplanation `json:"rules"`
+}
+
+// explainRules answers which rule would serve a request to the URL in the
+// query parameter url, made with the headers and from the address of this
+// request, and why the rules before it do not match. The explanation names
+// Inventories and errors, so like the reload it is only answered to loopback
+// peers.
+func (i IPXE) explainRules(w http.ResponseWriter, r *http.Request) {
+	// only the direct peer counts, forwarding headers can be spoofed
+	ip, err := peerIP(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if !ip.IsLoopback() {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte("forbidden"))
+		return
+	}
+
+	target, err := url.ParseRequestURI(r.URL.Query().Get("url"))
+	if err != nil {
+		writeError(w, r, &RequestError{Reason: "invalid url"})
+		return
+	}
+	explained := r.Clone(r.Context())
+	explained.URL = target
+	explained.RequestURI = target.RequestURI()
+
+	rule, explanations := i.evaluateRules(newRuleRequest(i, explained))
+	response := rulesExplanation{Rules: explanations}
+	if rule != nil {
+		response.Rule = rule.Name
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,139 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rules", func() {
+	ctx := context.Background()
+	SetupTestData(ctx)
+
+	var ruled IPXE
+	BeforeEach(func() {
+		ruled = ipxe
+		ruled.Config.Rules = []Rule{
+			{
+				Name:     "arm64",
+				Match:    RuleMatch{Path: "/ipxe", Buildarch: "arm64", UserAgent: "iPXE/*"},
+				Resource: RuleResource{Inline: "#!ipxe\necho arm64 {{ .ClientIP }}\n", Template: true},
+			},
+			{
+				Name:     "compute",
+				Match:    RuleMatch{Path: "/ipxe/*/install", InventorySelector: "machine.onmetal.de/size-compute-metal=true"},
+				Resource: RuleResource{ConfigMap: &RuleKeyRef{Name: "ipxe-" + uuid, Key: "boot"}},
+			},
+			{
+				Name:     "lab",
+				Match:    RuleMatch{Path: "/ipxe/*/install", Subnets: []string{"fd00:da8:fff6:3302::/64"}, Query: map[string]string{"stage": "lab-*"}},
+				Resource: RuleResource{Default: "ipxe", ContentType: "text/plain"},
+			},
+		}
+	})
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		ruled.Handler().ServeHTTP(rr, req)
+		return rr
+	}
+	fromIPXE := func(url, ip string) *http.Request {
+		req := requestFrom(url, ip)
+		req.Header.Set("User-Agent", "iPXE/1.21.1")
+		return req
+	}
+
+	It("Serves the first matching rule", func() {
+		rr := serve(fromIPXE("/ipxe?buildarch=arm64&platform=efi", validIP1))
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+		Expect(rr.Header().Get(RuleHeader)).To(Equal("arm64"))
+		Expect(rr.Body.String()).To(Equal("#!ipxe\necho arm64 " + netip.MustParseAddr(validIP1).String() + "\n"))
+
+		rr = serve(fromIPXE("/ipxe/"+uuid+"/install", validIP1))
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+		Expect(rr.Header().Get(RuleHeader)).To(Equal("compute"))
+		expected, err := os.ReadFile("../config/samples/configmap/ipxe-f2175eb4-e203-11ec-b5d5-3a68dd76b473")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rr.Body.String()).To(Equal(string(expected)))
+
+		By("Matching the client subnet when the client is not identified")
+		rr = serve(fromIPXE("/ipxe/"+uuid+"/install?stage=lab-1", badIP))
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+		Expect(rr.Header().Get(RuleHeader)).To(Equal("lab"))
+		Expect(rr.Header().Get("Content-Type")).To(Equal("text/plain"))
+	})
+
+	It("Falls back to the routes", func() {
+		rr := serve(fromIPXE("/ipxe?buildarch=x86_64", validIP1))
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+		Expect(rr.Header().Get(RuleHeader)).To(BeEmpty())
+		expected, err := os.ReadFile("../config/samples/ipxe-default-cm/ipxe")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rr.Body.String()).To(Equal(string(expected)))
+
+		expectError(serve(fromIPXE("/ipxe/"+uuid+"/install", badIP)), http.StatusForbidden, ErrorCodeUnknownClient)
+	})
+
+	It("Explains which rule fired", func() {
+		explain := func(url, ip string) *http.Request {
+			req := fromIPXE(url, ip)
+			req.RemoteAddr = "127.0.0.1:1234"
+			return req
+		}
+		ruled.Config.TrustedProxies = []string{"127.0.0.1"}
+
+		rr := serve(explain("/-/explain?url="+url.QueryEscape("/ipxe/"+uuid+"/install?stage=lab-1"), badIP))
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+
+		var explanation rulesExplanation
+		Expect(json.Unmarshal(rr.Body.Bytes(), &explanation)).To(Succeed())
+		Expect(explanation.Rule).To(Equal("lab"))
+		Expect(explanation.Rules).To(HaveLen(3))
+		Expect(explanation.Rules[0].Reason).To(Equal("path /ipxe/" + uuid + "/install does not match /ipxe"))
+		Expect(explanation.Rules[1].Reason).To(HavePrefix("client is not identified"))
+		Expect(explanation.Rules[2]).To(Equal(ruleExplanation{Rule: "lab", Matched: true}))
+
+		rr = serve(explain("/-/explain?url=", validIP1))
+		expectError(rr, http.StatusBadRequest, ErrorCodeBadRequest)
+
+		By("Not explaining to other peers")
+		rr = serve(fromIPXE("/-/explain?url="+url.QueryEscape("/ipxe"), badIP))
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusForbidden))
+		Expect(rr.Body.String()).ToNot(ContainSubstring("rule"))
+	})
+
+	It("Explains why values do not match", func() {
+		Expect(valueMismatch("buildarch", "arm64", nil)).To(Equal("buildarch is missing"))
+		Expect(valueMismatch("buildarch", "arm64", []string{"x86_64"})).To(Equal("buildarch x86_64 does not match arm64"))
+		Expect(valueMismatch("header Accept", "text/*", []string{"application/json", "text/plain"})).To(BeEmpty())
+	})
+
+	It("Validates the rules", func() {
+		Expect(validateRules(ruled.Config.Rules)).To(Succeed())
+
+		invalid := []Rule{
+			{Name: "", Resource: RuleResource{Inline: "x"}},
+			{Name: "a", Resource: RuleResource{}},
+			{Name: "a", Resource: RuleResource{Inline: "x", Default: "ipxe"}},
+			{Name: "a", Resource: RuleResource{Secret: &RuleKeyRef{Name: "s"}}},
+			{Name: "a", Match: RuleMatch{Path: "/ipxe/["}, Resource: RuleResource{Inline: "x"}},
+			{Name: "a", Match: RuleMatch{Subnets: []string{"10.0.0.0"}}, Resource: RuleResource{Inline: "x"}},
+			{Name: "a", Match: RuleMatch{InventorySelector: "a in b"}, Resource: RuleResource{Inline: "x"}},
+		}
+		for _, rule := range invalid {
+			Expect(validateRules([]Rule{rule})).ToNot(Succeed(), rule.Name)
+		}
+		duplicate := Rule{Name: "a", Resource: RuleResource{Inline: "x"}}
+		Expect(validateRules([]Rule{duplicate, duplicate})).To(MatchError("Duplicate rule a"))
+	})
+})
@@ -0,0 +1,277 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// HTTPConfig configures the HTTP server. Durations are given as Go duration
+// strings, e.g. 30s.
+type HTTPConfig struct {
+	Address           string `yaml:"address,omitempty"`
+	ReadTimeout       string `yaml:"read-timeout,omitempty"`
+	ReadHeaderTimeout string `yaml:"read-header-timeout,omitempty"`
+	WriteTimeout      string `yaml:"write-timeout,omitempty"`
+	IdleTimeout       string `yaml:"idle-timeout,omitempty"`
+	MaxHeaderBytes    int    `yaml:"max-header-bytes,omitempty"`
+	DrainPeriod       string `yaml:"drain-period,omitempty"`
+	ShutdownTimeout   string `yaml:"shutdown-timeout,omitempty"`
+
+	ProxyProtocol ProxyProtocolConfig `yaml:"proxy-protocol,omitempty"`
+}
+
+// ipxeURL returns the URL of the /ipxe route for clients reaching the service
+// on host. It uses the plain HTTP listener, which every iPXE build can chain
+// to, and the TLS listener only if there is no plain one. A listen address
+// with a host takes precedence over host.
+func (c Config) ipxeURL(host string) string {
+	scheme, address, port := "http", c.HTTP.Address, DefaultHTTPPort
+	if c.TLS.Enabled && c.TLS.DisablePlain {
+		scheme, address, port = "https", c.TLS.Address, DefaultHTTPSPort
+	}
+	if listenHost, listenPort, err := net.SplitHostPort(address); err == nil {
+		if listenPort != "" {
+			port = listenPort
+		}
+		if ip := net.ParseIP(listenHost); listenHost != "" && (ip == nil || !ip.IsUnspecified()) {
+			host = listenHost
+		}
+	}
+	return fmt.Sprintf("%s://%s/ipxe", scheme, net.JoinHostPort(host, port))
+}
+
+var registerMetricsOnce sync.Once
+
+func registerMetrics() {
+	registerMetricsOnce.Do(func() {
+		prometheus.MustRegister(requestIPXEDuration)
+		prometheus.MustRegister(requestIGNITIONDuration)
+		prometheus.MustRegister(requestMetadataDuration)
+		prometheus.MustRegister(requestCloudInitDuration)
+		prometheus.MustRegister(requestTFTPDuration)
+		prometheus.MustRegister(macMismatchTotal)
+		prometheus.MustRegister(macResolverErrorsTotal)
+		prometheus.MustRegister(kubernetesLookupDuration)
+		prometheus.MustRegister(butaneRenderDuration)
+		prometheus.MustRegister(inventoryLastBootInfo)
+		prometheus.MustRegister(configReloadTotal)
+		prometheus.MustRegister(configLastReloadSuccess)
+	})
+}
+
+// Start runs the service until ctx is done, then shuts it down gracefully.
+// When a listener fails, the others are stopped as well.
+func (i *IPXE) Start(ctx context.Context) error {
+	registerMetrics()
+	// stops TFTP, DHCP and the config watch when Start returns
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if i.ConfigFile == "" {
+		i.ConfigFile = ConfigFile
+	}
+	i.reloader = newConfigReloader(i.ConfigFile, i.Config)
+	if err := i.reloader.watch(ctx); err != nil {
+		logger.Error(err, "Failed to watch config, reload only on request")
+	}
+
+	if i.Config.DHCP.Enabled {
+		if err := i.startDHCP(ctx); err != nil {
+			return err
+		}
+	}
+
+	i.draining = &atomic.Bool{}
+	i.servers = []*http.Server{}
+	if !i.Config.TLS.Enabled || !i.Config.TLS.DisablePlain {
+		i.servers = append(i.servers, i.newServer(i.Config.HTTP.Address, ":"+DefaultHTTPPort))
+	}
+	if i.Config.TLS.Enabled {
+		tlsConfig, err := i.newTLSConfig()
+		if err != nil {
+			return err
+		}
+		server := i.newServer(i.Config.TLS.Address, ":"+DefaultHTTPSPort)
+		server.TLSConfig = tlsConfig
+		i.servers = append(i.servers, server)
+	}
+
+	errCh := make(chan error, len(i.servers)+1)
+	if i.Config.TFTP.Enabled {
+		go func() {
+			if err := i.startTFTP(ctx); err != nil {
+				errCh <- err
+			}
+		}()
+	}
+	for _, server := range i.servers {
+		go func(server *http.Server) {
+			errCh <- i.serve(server)
+		}(server)
+	}
+
+	shutdownTimeout := durationOrDefault(i.Config.HTTP.ShutdownTimeout, DefaultShutdownTimeout)
+	select {
+	case err := <-errCh:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		// the other listeners may already serve, stop them with the service
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if shutdownErr := i.closeServers(shutdownCtx); shutdownErr != nil {
+			logger.Error(shutdownErr, "Failed to shutdown IPXE Server")
+		}
+		return errors.Wrap(err, "Failed to start IPXE Server")
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return i.Shutdown(shutdownCtx)
+}
+
+// Shutdown reports the service as not ready, waits for the drain period so
+// load balancers stop sending requests, and then closes the servers after all
+// active requests are finished or ctx is done.
+func (i *IPXE) Shutdown(ctx context.Context) error {
+	if len(i.servers) == 0 {
+		return nil
+	}
+
+	i.draining.Store(true)
+	drainPeriod := durationOrDefault(i.Config.HTTP.DrainPeriod, DefaultDrainPeriod)
+	logger.Info("Draining IPXE Server", "drainPeriod", drainPeriod)
+	select {
+	case <-time.After(drainPeriod):
+	case <-ctx.Done():
+	}
+
+	return i.closeServers(ctx)
+}
+
+// closeServers shuts the servers down, waiting for active requests until ctx
+// is done.
+func (i *IPXE) closeServers(ctx context.Context) error {
+	logger.Info("Shutdown IPXE Server")
+	var result error
+	for _, server := range i.servers {
+		if err := server.Shutdown(ctx); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+func (i IPXE) serve(server *http.Server) error {
+	listener, err := i.listen(server.Addr)
+	if err != nil {
+		return err
+	}
+
+	if server.TLSConfig != nil {
+		logger.Info("Start IPXE Server with TLS", "address", server.Addr)
+		return server.ServeTLS(listener, "", "")
+	}
+	logger.Info("Start IPXE Server", "address", server.Addr)
+	return server.Serve(listener)
+}
+
+// Handler returns the handler of all routes of the service.
+func (i IPXE) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", i.withRules(i.getRouter()))
+	mux.HandleFunc("/-/reload", i.withConfig(IPXE.reloadApp))
+	mux.HandleFunc("/-/explain", i.withConfig(IPXE.explainRules))
+	mux.HandleFunc("/-/ready", i.ready)
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/cert", i.withConfig(IPXE.getCert))
+	return withTracing(withRequestLogger(mux))
+}
+
+func (i IPXE) newServer(address, defaultAddress string) *http.Server {
+	conf := i.Config.HTTP
+	if address == "" {
+		address = defaultAddress
+	}
+	maxHeaderBytes := conf.MaxHeaderBytes
+	if maxHeaderBytes == 0 {
+		maxHeaderBytes = http.DefaultMaxHeaderBytes
+	}
+
+	return &http.Server{
+		Addr:              address,
+		Handler:           i.Handler(),
+		ReadTimeout:       durationOrDefault(conf.ReadTimeout, DefaultReadTimeout),
+		ReadHeaderTimeout: durationOrDefault(conf.ReadHeaderTimeout, DefaultReadHeaderTimeout),
+		WriteTimeout:      durationOrDefault(conf.WriteTimeout, DefaultWriteTimeout),
+		IdleTimeout:       durationOrDefault(conf.IdleTimeout, DefaultIdleTimeout),
+		MaxHeaderBytes:    maxHeaderBytes,
+	}
+}
+
+func (i IPXE) ready(w http.ResponseWriter, _ *http.Request) {
+	if i.draining != nil && i.draining.Load() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// validate fails on invalid timeouts, so they are not replaced by the
+// defaults silently.
+func (c HTTPConfig) validate() error {
+	return validateDurations(
+		"http.read-timeout", c.ReadTimeout,
+		"http.read-header-timeout", c.ReadHeaderTimeout,
+		"http.write-timeout", c.WriteTimeout,
+		"http.idle-timeout", c.IdleTimeout,
+		"http.drain-period", c.DrainPeriod,
+		"http.shutdown-timeout", c.ShutdownTimeout,
+	)
+}
+
+// validateDurations fails on values which are neither empty nor positive
+// durations, given as pairs of config name and value.
+func validateDurations(namesAndValues ...string) error {
+	for k := 0; k+1 < len(namesAndValues); k += 2 {
+		name, value := namesAndValues[k], namesAndValues[k+1]
+		if value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid %s", name)
+		}
+		if d < 0 {
+			return errors.Errorf("Invalid %s %s, must not be negative", name, value)
+		}
+	}
+	return nil
+}
+
+// durationOrDefault parses value, which is validated with the config, or
+// returns def for an empty value.
+func durationOrDefault(value string, def time.Duration) time.Duration {
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		logger.Error(err, "Invalid duration, use default", "value", value, "default", def)
+		return def
+	}
+	return d
+}
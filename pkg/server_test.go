@@ -0,0 +1,118 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HTTP server", func() {
+	Context("Lifecycle", func() {
+		It("Serves the private mux", func() {
+			req, err := http.NewRequest("GET", "/-/ready", nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			ipxe.Handler().ServeHTTP(rr, req)
+			Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+		})
+
+		It("Starts and shuts down gracefully", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			address := listener.Addr().String()
+			Expect(listener.Close()).To(Succeed())
+
+			serverIPXE := ipxe
+			serverIPXE.ConfigFile = filepath.Join(GinkgoT().TempDir(), "config.yaml")
+			serverIPXE.Config.HTTP = HTTPConfig{Address: address, DrainPeriod: "100ms"}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() {
+				done <- serverIPXE.Start(ctx)
+			}()
+
+			Eventually(func() (int, error) {
+				resp, err := http.Get(fmt.Sprintf("http://%s/-/ready", address))
+				if err != nil {
+					return 0, err
+				}
+				defer func() {
+					_ = resp.Body.Close()
+				}()
+				return resp.StatusCode, nil
+			}).Should(Equal(http.StatusOK))
+
+			cancel()
+			Eventually(done).Should(Receive(BeNil()))
+		})
+
+		It("Stops all listeners when one fails", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			address := listener.Addr().String()
+			Expect(listener.Close()).To(Succeed())
+			busy, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(busy.Close)
+
+			dir := GinkgoT().TempDir()
+			certFile, keyFile := writeTestCert(dir, 1, time.Now())
+			serverIPXE := ipxe
+			serverIPXE.ConfigFile = filepath.Join(dir, "config.yaml")
+			serverIPXE.Config.HTTP = HTTPConfig{Address: address}
+			serverIPXE.Config.TLS = TLSConfig{Enabled: true, Address: busy.Addr().String(), CertFile: certFile, KeyFile: keyFile}
+
+			Expect(serverIPXE.Start(context.Background())).To(MatchError(ContainSubstring("Failed to start IPXE Server")))
+			Eventually(func() error {
+				conn, err := net.Dial("tcp", address)
+				if err == nil {
+					_ = conn.Close()
+				}
+				return err
+			}).Should(HaveOccurred())
+		})
+
+		It("Stops all listeners when TFTP fails", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			address := listener.Addr().String()
+			Expect(listener.Close()).To(Succeed())
+			busy, err := net.ListenPacket("udp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(busy.Close)
+
+			serverIPXE := ipxe
+			serverIPXE.ConfigFile = filepath.Join(GinkgoT().TempDir(), "config.yaml")
+			serverIPXE.Config.HTTP = HTTPConfig{Address: address}
+			serverIPXE.Config.TFTP = TFTPConfig{Enabled: true, Address: busy.LocalAddr().String()}
+
+			Expect(serverIPXE.Start(context.Background())).To(MatchError(ContainSubstring("Failed to start TFTP Server")))
+			Eventually(func() error {
+				conn, err := net.Dial("tcp", address)
+				if err == nil {
+					_ = conn.Close()
+				}
+				return err
+			}).Should(HaveOccurred())
+		})
+
+		It("Rejects invalid durations", func() {
+			Expect(HTTPConfig{ReadTimeout: "10s", DrainPeriod: "0s"}.validate()).To(Succeed())
+			Expect(HTTPConfig{ReadTimeout: "10"}.validate()).To(MatchError(ContainSubstring("Invalid http.read-timeout")))
+			Expect(HTTPConfig{ShutdownTimeout: "-1s"}.validate()).To(MatchError(ContainSubstring("Invalid http.shutdown-timeout")))
+			Expect(MacResolverConfig{LeaseCacheTTL: "1 hour"}.validate()).To(MatchError(ContainSubstring("Invalid mac-resolvers.lease-cache-ttl")))
+		})
+	})
+})
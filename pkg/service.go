@@ -4,213 +4,254 @@
 package pkg
 
 import (
-	"bytes"
+	"context"
 	"fmt"
-	"log"
-	"net"
 	"net/http"
 	"os"
 	"path/filepath"
-	"text/template"
+	"sync/atomic"
 
-	"github.com/Masterminds/sprig"
+	"github.com/go-logr/logr"
 	"github.com/gorilla/mux"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	inventoryv1alpha4 "github.com/ironcore-dev/metal/apis/metal/v1alpha4"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
 	corev1 "k8s.io/api/core/v1"
 )
 
 type IPXE struct {
-	Config    Config
-	K8sClient K8sClient
-}
-
-func (i IPXE) Start() {
-	prometheus.MustRegister(requestIPXEDuration)
-	prometheus.MustRegister(requestIGNITIONDuration)
+	Config     Config
+	ConfigFile string
+	K8sClient  K8sClient
 
-	rtr := i.getRouter()
-	http.Handle("/", rtr)
-	http.HandleFunc("/-/reload", i.reloadApp)
-	http.Handle("/metrics", promhttp.Handler())
-	http.HandleFunc("/cert", i.getCert)
-	if err := http.ListenAndServe(":8082", nil); err != nil {
-		log.Fatal("Failed to start IPXE Server", err)
-	}
+	reloader *configReloader
+	servers  []*http.Server
+	draining *atomic.Bool
 }
+
 func (i IPXE) getRouter() *mux.Router {
 	rtr := mux.NewRouter()
-	rtr.HandleFunc("/ipxe", i.getChainDefault).Methods("GET")
-	rtr.HandleFunc("/ipxe/{uuid:[a-f0-9-]+}/{part:[a-z0-9-]+}", i.getChainByUUID).Methods("GET")
-	rtr.HandleFunc("/ignition/{uuid:[a-z0-9-]+}/{part:[a-z0-9-]+}", i.getIgnitionByUUID).Methods("GET")
+	rtr.HandleFunc("/ipxe", i.withConfig(withSignature(IPXE.getChainDefault))).Methods("GET")
+	rtr.HandleFunc("/ipxe"+SignatureSuffix, i.withConfig(IPXE.getSignature)).Methods("GET")
+	rtr.HandleFunc("/ipxe/{uuid:[a-f0-9-]+}/{part:[a-z0-9-]+}", i.withConfig(withSignature(IPXE.getChainByUUID))).Methods("GET")
+	rtr.HandleFunc("/ipxe/{uuid:[a-f0-9-]+}/{part:[a-z0-9-]+}"+SignatureSuffix, i.withConfig(IPXE.getSignature)).Methods("GET")
+	for _, lookup := range inventoryLookups {
+		path := fmt.Sprintf("/ipxe/by-%s/{value:%s}/{part:[a-z0-9-]+}", lookup.name, lookup.pattern)
+		rtr.HandleFunc(path, i.withConfig(withSignature(getChainByLookup(lookup)))).Methods("GET")
+		rtr.HandleFunc(path+SignatureSuffix, i.withConfig(IPXE.getSignature)).Methods("GET")
+	}
+	rtr.HandleFunc("/ignition/{uuid:[a-z0-9-]+}/{part:[a-z0-9-]+}", i.withConfig(IPXE.getIgnitionByUUID)).Methods("GET")
+	rtr.HandleFunc("/metadata/{uuid:[a-f0-9-]+}", i.withConfig(IPXE.getMetadata)).Methods("GET")
+	rtr.HandleFunc("/cloud-init/{uuid:[a-f0-9-]+}/{file:user-data|meta-data|vendor-data|network-config}", i.withConfig(IPXE.getCloudInit)).Methods("GET")
+	rtr.HandleFunc("/metadata/{uuid:[a-f0-9-]+}/{path:.*}", i.withConfig(IPXE.getMetadataPath)).Methods("GET")
 	rtr.HandleFunc("/", ok200).Methods("GET")
+	rtr.Use(withSpanRoute)
 
 	return rtr
 }
-func (i IPXE) getChainDefault(w http.ResponseWriter, _ *http.Request) {
-	timer := prometheus.NewTimer(prometheus.ObserverFunc(func(v float64) {
-		requestIPXEDuration.WithLabelValues("default").Observe(v)
-	}))
-	defer func() {
-		timer.ObserveDuration()
-	}()
+func (i IPXE) getChainDefault(w http.ResponseWriter, r *http.Request) {
+	m := newRequestMetrics(r.Context(), requestIPXEDuration, routeIPXE)
+	defer m.observe()
 
-	log.Println("Response the default IPXE config file ...")
+	log := loggerFrom(r.Context())
+	clientIP, err := i.getIP(r)
+	if err != nil {
+		log.Info("Failed to get client IP", "error", err.Error())
+	} else if i.Config.IdentityChain.Enabled {
+		inventory, err := i.identifyClient(r.Context(), r, clientIP)
+		if err == nil {
+			log.Info("Chain identified client to its iPXE config", "clientIP", clientIP, "uuid", inventory.Name)
+			m.served("ipxe", outcomeIdentified, sourceNone)
+			i.chainToMachine(w, r, inventory.Name)
+			return
+		}
+		log.Info("Failed to identify client", "clientIP", clientIP, "error", err.Error())
+	}
 
-	data, err := readIpxeConfFile("ipxe")
+	log.Info("Response the default IPXE config file")
+	data, source, err := readIpxeConfFile("ipxe")
+	if err != nil {
+		m.writeError(w, r, err)
+		return
+	}
+	data, err = renderTemplate(r.Context(), "ipxe", data, newIPXETemplateData("", "", clientIP, r.Host, nil))
 	if err != nil {
-		http.Error(w, "no data found", http.StatusInternalServerError)
+		m.writeError(w, r, err)
 		return
 	}
+	log.V(1).Info("Rendered iPXE config", "output", string(data))
+	m.served("ipxe", outcomeDefault, source)
 
 	_, _ = fmt.Fprint(w, string(data))
 }
 
-func (i IPXE) getCert(w http.ResponseWriter, _ *http.Request) {
+func (i IPXE) getCert(w http.ResponseWriter, r *http.Request) {
 	ns := i.Config.ConfigmapNS
 
-	configMap, err := i.K8sClient.getConfigMag(ServiceServerCert, ns)
-	if err != nil {
-		log.Printf("Failed to get ConfigMap %s in Namespace %s, error: %s", ServiceServerCert, ns, err)
-		http.Error(w, "no data found", http.StatusInternalServerError)
+	var chain []byte
+	if i.Config.Signing.Enabled {
+		s, err := i.getSigner(r.Context())
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		chain = s.pemChain()
+	}
+
+	configMap, err := i.K8sClient.getConfigMag(r.Context(), ServiceServerCert, ns)
+	if err != nil && chain == nil {
+		writeError(w, r, err)
 		return
 	}
 
 	//TODO check if ca.crt exists
-	_, _ = fmt.Fprint(w, configMap.Data["ca.crt"])
+	if configMap != nil {
+		_, _ = fmt.Fprint(w, configMap.Data["ca.crt"])
+	}
+	_, _ = w.Write(chain)
 }
 
 func (i IPXE) getChainByUUID(w http.ResponseWriter, r *http.Request) {
-	var uuid string
-	timer := prometheus.NewTimer(prometheus.ObserverFunc(func(v float64) {
-		requestIPXEDuration.WithLabelValues(uuid).Observe(v)
-	}))
-	defer func() {
-		timer.ObserveDuration()
-	}()
+	m := newRequestMetrics(r.Context(), requestIPXEDuration, routeIPXEByUUID)
+	defer m.observe()
 
-	params := mux.Vars(r)
-	uuid = params["uuid"]
-	part := params["part"]
-	if uuid != "" {
-		clientIP, err := i.getIP(r)
+	uuid := mux.Vars(r)["uuid"]
+	if uuid == "" {
+		m.writeError(w, r, &RequestError{Reason: "no uuid specified"})
+		return
+	}
+	i.serveChain(w, r, m, func(ctx context.Context) (*inventoryv1alpha4.Inventory, error) {
+		return i.K8sClient.getInventory(ctx, uuid, i.Config.InventoryNS)
+	})
+}
+
+// serveChain answers with the iPXE config part of the Inventory found by
+// getInventory. Inventories without system UUID get the default config, all
+// others their per-machine config if the MAC of the client belongs to them.
+func (i IPXE) serveChain(w http.ResponseWriter, r *http.Request, m *requestMetrics, getInventory func(context.Context) (*inventoryv1alpha4.Inventory, error)) {
+	part := mux.Vars(r)["part"]
+	trace.SpanFromContext(r.Context()).SetAttributes(attrPart.String(part))
+
+	clientIP, err := i.getIP(r)
+	if err != nil {
+		m.writeError(w, r, err)
+		return
+	}
+	resolution, err := i.resolveMac(r.Context(), r, clientIP)
+	if err != nil {
+		m.writeError(w, r, err)
+		return
+	}
+	mac := resolution.MAC
+
+	inventory, err := getInventory(r.Context())
+	if err != nil {
+		m.writeError(w, r, err)
+		return
+	}
+	uuid := inventory.Name
+	log := loggerFrom(r.Context()).WithValues("uuid", uuid, "part", part)
+	trace.SpanFromContext(r.Context()).SetAttributes(attrUUID.String(uuid))
+
+	// if inventory uuid is empty, assume it needs to be created
+	if inventory.Spec.System == nil || inventory.Spec.System.ID == "" {
+		log.Info("Response the default IPXE config file", "clientIP", clientIP)
+		body, source, err := readIpxeConfFile(part)
 		if err != nil {
-			log.Printf("Error: %s\n", err)
-			http.Error(w, "Internal Error", http.StatusInternalServerError)
+			m.writeError(w, r, err)
 			return
 		}
-		mac, err := i.K8sClient.getMacFromIP(clientIP, i.Config.IpamNS)
+		body, err = renderTemplate(r.Context(), part, body, newIPXETemplateData(uuid, mac, clientIP, r.Host, inventory))
 		if err != nil {
-			log.Printf("Error: %s\n", err)
-			http.Error(w, "Internal Error", http.StatusInternalServerError)
+			m.writeError(w, r, err)
 			return
 		}
-
-		inventory, err := i.K8sClient.getInventory(uuid, i.Config.InventoryNS)
+		log.V(1).Info("Rendered iPXE config", "output", string(body))
+		m.served(part, outcomeDefault, source)
+		i.observeLastBoot(uuid, mac, part)
+		_, err = w.Write(body)
 		if err != nil {
-			log.Printf("Error: %s\n", err)
-			http.Error(w, "Internal Error", http.StatusInternalServerError)
-			return
+			log.Error(err, "Failed to write iPXE config", "mac", mac)
 		}
+		return
+	}
 
-		// if inventory uuid is empty, assume it needs to be created
-		if inventory.Spec.System == nil || inventory.Spec.System.ID == "" {
-			log.Printf("Response the %s IPXE config file for %s (%s)", part, clientIP, uuid)
-			body, err := readIpxeConfFile(part)
-			if err != nil {
-				http.Error(w, "failed to render iPXE config for mac", http.StatusInternalServerError)
-				return
-			}
-			_, err = w.Write(body)
-			if err != nil {
-				http.Error(w, "failed to write iPXE config for mac", http.StatusInternalServerError)
-				return
-			}
-		} else {
-			err := checkInventoryMac(inventory, mac)
-			if err != nil {
-				i.K8sClient.EventRecorder.Eventf(inventory, corev1.EventTypeWarning,
-					"Denied", "Denied client %s because mac '%s' does not match for inventory", clientIP, mac)
-				log.Printf("SECURITY Error Alert! Request %#v", r)
-				log.Printf("MAC (%s) does not match with provided UUID (%s) from inventory", mac, uuid)
-				http.Error(w, "Internal Error", http.StatusInternalServerError)
-				return
-			}
+	if err := resolution.requireTrusted(clientIP); err != nil {
+		m.writeError(w, r, err)
+		return
+	}
 
-			log.Printf("Generate iPXE config for the client %s\n", clientIP)
-			i.K8sClient.EventRecorder.Eventf(inventory, corev1.EventTypeNormal, "Generate",
-				"Generate iPXE config for client %s", clientIP)
+	err = checkInventoryMac(inventory, mac)
+	if err != nil {
+		i.K8sClient.EventRecorder.Eventf(inventory, corev1.EventTypeWarning,
+			"Denied", "Denied client %s because mac '%s' does not match for inventory", clientIP, mac)
+		logSecurityAlert(log, r, clientIP, mac)
+		m.writeError(w, r, err)
+		return
+	}
 
-			configMapName := "ipxe-" + uuid
-			configMap, err := i.K8sClient.getConfigMag(configMapName, i.Config.ConfigmapNS)
-			if err != nil {
-				http.Error(w, "UUID not found", http.StatusInternalServerError)
-				return
-			}
+	if i.serveNextBoot(w, r, m, inventory, part, mac, clientIP) {
+		return
+	}
 
-			if len(configMap.Data) == 0 {
-				log.Printf("Not found configmap with UUID  %s", uuid)
-				http.Error(w, "UUID not found", http.StatusInternalServerError)
-				return
-			}
-			userData, ok := configMap.Data[part]
-			if ok {
-				_, err = w.Write([]byte(userData))
-				if err != nil {
-					http.Error(w, "failed to write iPXE config for mac", http.StatusInternalServerError)
-					return
-				}
-			} else {
-				log.Printf("key %s not found in ConfigMap for uuid  %s", part, uuid)
-				http.Error(w, "Key not found", http.StatusInternalServerError)
-				return
-			}
-		}
+	log.Info("Generate iPXE config", "clientIP", clientIP)
+	i.K8sClient.EventRecorder.Eventf(inventory, corev1.EventTypeNormal, "Generate",
+		"Generate iPXE config for client %s", clientIP)
+
+	userData, source, err := i.readMachineIPXE(r.Context(), inventory, part)
+	if err != nil {
+		m.writeError(w, r, err)
+		return
+	}
+
+	body, err := renderTemplate(r.Context(), part, userData, newIPXETemplateData(uuid, mac, clientIP, r.Host, inventory))
+	if err != nil {
+		m.writeError(w, r, err)
+		return
+	}
+	log.V(1).Info("Rendered iPXE config", "output", string(body))
+	m.served(part, outcomeServed, source)
+	i.observeLastBoot(uuid, mac, part)
+	_, err = w.Write(body)
+	if err != nil {
+		log.Error(err, "Failed to write iPXE config", "mac", mac)
 	}
 }
 
 func (i IPXE) getIgnitionByUUID(w http.ResponseWriter, r *http.Request) {
-	var mac string
-	var uuid string
-	var part string
-	timer := prometheus.NewTimer(prometheus.ObserverFunc(func(v float64) {
-		requestIGNITIONDuration.WithLabelValues(mac).Observe(v)
-	}))
-
-	defer func() {
-		timer.ObserveDuration()
-	}()
+	m := newRequestMetrics(r.Context(), requestIGNITIONDuration, routeIgnition)
+	defer m.observe()
 
 	params := mux.Vars(r)
-	uuid = params["uuid"]
+	uuid := params["uuid"]
 	if uuid == "" {
-		http.Error(w, "no uuid specified", http.StatusInternalServerError)
+		m.writeError(w, r, &RequestError{Reason: "no uuid specified"})
 		return
 	}
-	part = params["part"]
+	part := params["part"]
+	log := loggerFrom(r.Context()).WithValues("uuid", uuid, "part", part)
+	trace.SpanFromContext(r.Context()).SetAttributes(attrUUID.String(uuid), attrPart.String(part))
 	if part == "" {
-		http.Error(w, "no ignition part specified", http.StatusInternalServerError)
+		m.writeError(w, r, &RequestError{Reason: "no ignition part specified"})
 		return
 	}
 
 	clientIP, err := i.getIP(r)
 	if err != nil {
-		log.Printf("Error: %s\n", err)
-		http.Error(w, "Internal Error", http.StatusInternalServerError)
+		m.writeError(w, r, err)
 		return
 	}
 
-	mac, err = i.K8sClient.getMacFromIP(clientIP, i.Config.IpamNS)
+	resolution, err := i.resolveMac(r.Context(), r, clientIP)
 	if err != nil {
-		log.Printf("Error: %s\n", err)
-		http.Error(w, "Internal Error", http.StatusInternalServerError)
+		m.writeError(w, r, err)
 		return
 	}
+	mac := resolution.MAC
 
-	inventory, err := i.K8sClient.getInventory(uuid, i.Config.InventoryNS)
+	inventory, err := i.K8sClient.getInventory(r.Context(), uuid, i.Config.InventoryNS)
 	if err != nil {
-		log.Printf("Error: %s\n", err)
-		http.Error(w, "Internal Error", http.StatusInternalServerError)
+		m.writeError(w, r, err)
 		return
 	}
 
@@ -218,164 +259,135 @@ func (i IPXE) getIgnitionByUUID(w http.ResponseWriter, r *http.Request) {
 	// if inventory uuid is empty, assume it needs to be created
 	if inventory.Spec.System == nil || inventory.Spec.System.ID == "" {
 		var dataIn []byte
-		log.Printf("Render default Ignition part %s from Secret, mac is %s and uuid is %s\n", partKey, mac, uuid)
-		defaultSecretPath := os.Getenv("IPXE_DEFAULT_SECRET_PATH")
-		if defaultSecretPath == "" {
-			defaultSecretPath = DefaultSecretPath
-		}
-		file := filepath.Join(defaultSecretPath, partKey)
+		source := sourceDefaultSecret
+		log.Info("Render default Ignition part from Secret", "key", partKey, "mac", mac)
+		file := filepath.Join(getDefaultSecretPath(), partKey)
 		if doesFileExist(file) {
 			dataIn, err = os.ReadFile(file)
 		}
 		if len(dataIn) == 0 {
-			log.Printf("Render default Ignition part %s from ConfigMap, mac is %s and uuid is %s\n", partKey, mac, uuid)
-			defaultConfigMapPath := os.Getenv("IPXE_DEFAULT_CONFIGMAP_PATH")
-			if defaultConfigMapPath == "" {
-				defaultConfigMapPath = DefaultConfigMapPath
-			}
-			file = filepath.Join(defaultConfigMapPath, partKey)
+			source = sourceDefaultConfigMap
+			log.Info("Render default Ignition part from ConfigMap", "key", partKey, "mac", mac)
+			file = filepath.Join(getDefaultConfigMapPath(), partKey)
 			if doesFileExist(file) {
 				dataIn, err = os.ReadFile(file)
 			}
 		}
 		if err != nil {
-			log.Printf("Error in ignition rendering before butane: %s", err)
-			http.Error(w, "Error in ignition reading", http.StatusInternalServerError)
+			m.writeError(w, r, errors.Wrap(err, "Error in ignition reading"))
+			return
+		}
+		if len(dataIn) == 0 {
+			m.writeError(w, r, &KeyNotFoundError{Kind: "default config", Name: "ignition", Key: partKey})
 			return
 		}
 
 		kubeconfigSecretName := fmt.Sprintf("kubeconfig-inventory-%s", uuid)
-		kubeconfigSecret, err := i.K8sClient.getSecret(kubeconfigSecretName, i.Config.InventoryNS)
+		kubeconfigSecret, err := i.K8sClient.getSecret(r.Context(), kubeconfigSecretName, i.Config.InventoryNS)
 		if err != nil {
-			log.Printf("Error getting kubeconfig for inventory: %s", err)
-			http.Error(w, "Error in ignition reading", http.StatusInternalServerError)
+			m.writeError(w, r, err)
 			return
 		}
 
 		kubeconfig, exists := kubeconfigSecret.Data["kubeconfig"]
 		if !exists {
-			log.Printf("Error getting kubeconfig data for inventory: %s", err)
-			http.Error(w, "Error in ignition reading", http.StatusInternalServerError)
+			m.writeError(w, r, &KeyNotFoundError{Kind: "Secret", Name: kubeconfigSecretName, Key: "kubeconfig"})
 			return
 		}
 
-		type Config struct {
-			UUID       string
-			Kubeconfig string
-			Hostname   string
-		}
-		cfg := Config{UUID: uuid, Kubeconfig: string(kubeconfig), Hostname: uuid}
-		tmpl, err := template.New("ignition").Funcs(sprig.HermeticTxtFuncMap()).Parse(string(dataIn))
-		if err != nil {
-			http.Error(w, "Error in ignition template creation", http.StatusInternalServerError)
-			return
-		}
-		var ignition bytes.Buffer
-		err = tmpl.Execute(&ignition, cfg)
+		cfg := i.ignitionTemplateData(r.Context(), uuid, mac, clientIP, inventory)
+		cfg.Kubeconfig = string(kubeconfig)
+		log.V(1).Info("Render ignition template", "data", cfg)
+		ignition, err := renderTemplate(r.Context(), partKey, dataIn, cfg)
 		if err != nil {
-			http.Error(w, "Error in ignition template rendering", http.StatusInternalServerError)
+			m.writeError(w, r, err)
 			return
 		}
-		resData, err := renderButane(ignition.Bytes())
+		resData, err := renderButane(r.Context(), ignition)
 		if err != nil {
-			http.Error(w, "Error in render butane", http.StatusInternalServerError)
+			m.writeError(w, r, err)
 			return
 		}
+		log.V(1).Info("Rendered ignition", "ignition", redactIgnition(resData))
+		m.served(part, outcomeDefault, source)
 
 		_, err = w.Write([]byte(resData))
 		if err != nil {
-			log.Printf("Failed to write ignition for mac: %s err: %s", mac, err)
-			http.Error(w, "Failed to write ignition for mac", http.StatusInternalServerError)
-			return
-		}
-	} else {
-		err = checkInventoryMac(inventory, mac)
-		if err != nil {
-			i.K8sClient.EventRecorder.Eventf(inventory, corev1.EventTypeWarning,
-				"Denied", "Denied client %s because mac '%s' does not match for inventory", clientIP, mac)
-			log.Printf("SECURITY Error Alert! Request %#v", r)
-			log.Printf("MAC (%s) does not match with provided UUID (%s) from inventory", mac, uuid)
-			http.Error(w, "Internal Error", http.StatusInternalServerError)
-			return
+			log.Error(err, "Failed to write ignition", "mac", mac)
 		}
+		return
+	}
 
-		var userData string
-		secretName := "ipxe-" + uuid
-		secret, err := i.K8sClient.getSecret(secretName, i.Config.ConfigmapNS)
-		if err != nil {
-			http.Error(w, "no data found", http.StatusInternalServerError)
-			return
-		}
+	if err := resolution.requireTrusted(clientIP); err != nil {
+		m.writeError(w, r, err)
+		return
+	}
 
-		if len(secret.Data) > 0 {
-			if len(partKey) > 0 && len(secret.Data[partKey]) > 0 {
-				userData = string(secret.Data[partKey])
-			}
-		}
+	err = checkInventoryMac(inventory, mac)
+	if err != nil {
+		i.K8sClient.EventRecorder.Eventf(inventory, corev1.EventTypeWarning,
+			"Denied", "Denied client %s because mac '%s' does not match for inventory", clientIP, mac)
+		logSecurityAlert(log, r, clientIP, mac)
+		m.writeError(w, r, err)
+		return
+	}
 
-		if len(userData) == 0 {
-			log.Print("UserData is empty in specific secret")
-			http.Error(w, "no data found", http.StatusInternalServerError)
-			return
-		} else {
-			log.Printf("Render ignition %s for client %s", secretName, clientIP)
-			i.K8sClient.EventRecorder.Eventf(inventory, corev1.EventTypeNormal, "Ignition",
-				"Render ignition %s for client %s", secretName, clientIP)
-
-			//TODO add as debug log
-			//log.Printf("UserData: %+v", userData)
-			userDataByte := []byte(userData)
-			userDataJson, err := renderButane(userDataByte)
-			if err != nil {
-				http.Error(w, "Error in render butane", http.StatusInternalServerError)
-				return
-			}
-			//TODO add as debug log
-			//log.Printf("UserDataJson: %s", userDataJson)
-
-			_, err = w.Write([]byte(userDataJson))
-			if err != nil {
-				log.Printf("Failed to write ignition for uuid: %s err: %s", mac, err)
-				http.Error(w, "Failed to write ignition for uuid", http.StatusInternalServerError)
-				return
-			}
-			return
-		}
+	userData, source, err := i.readMachineIgnition(r.Context(), inventory, partKey)
+	if err != nil {
+		m.writeError(w, r, err)
+		return
 	}
-}
 
-func (i IPXE) getIP(r *http.Request) (string, error) {
-	var clientIP string
-	var err error
-	if i.Config.DisableForwardHeader {
-		clientIP, _, err = net.SplitHostPort(r.RemoteAddr)
-		if err != nil {
-			return "", err
-		}
-	} else {
-		clientIP = r.Header.Get("X-FORWARDED-FOR")
-		if clientIP == "" {
-			clientIP, _, err = net.SplitHostPort(r.RemoteAddr)
-			if err != nil {
-				return "", err
-			}
-		}
+	log.Info("Render ignition", "source", source, "clientIP", clientIP)
+	i.K8sClient.EventRecorder.Eventf(inventory, corev1.EventTypeNormal, "Ignition",
+		"Render ignition %s for client %s", partKey, clientIP)
+
+	cfg := i.ignitionTemplateData(r.Context(), uuid, mac, clientIP, inventory)
+	kubeconfigSecretName := fmt.Sprintf("kubeconfig-inventory-%s", uuid)
+	kubeconfigSecret, err := i.K8sClient.getSecret(r.Context(), kubeconfigSecretName, i.Config.InventoryNS)
+	if err == nil {
+		cfg.Kubeconfig = string(kubeconfigSecret.Data["kubeconfig"])
 	}
 
-	return clientIP, nil
+	log.V(1).Info("Render ignition template", "data", cfg)
+	userDataByte, err := renderTemplate(r.Context(), partKey, userData, cfg)
+	if err != nil {
+		m.writeError(w, r, err)
+		return
+	}
+	userDataJson, err := renderButane(r.Context(), userDataByte)
+	if err != nil {
+		m.writeError(w, r, err)
+		return
+	}
+	log.V(1).Info("Rendered ignition", "ignition", redactIgnition(userDataJson))
+	m.served(part, outcomeServed, source)
+
+	_, err = w.Write([]byte(userDataJson))
+	if err != nil {
+		log.Error(err, "Failed to write ignition", "mac", mac)
+	}
 }
 
 func (i IPXE) reloadApp(w http.ResponseWriter, r *http.Request) {
-	ip, err := i.getIP(r)
+	// only the direct peer counts, forwarding headers can be spoofed
+	ip, err := peerIP(r)
 	if err != nil {
 		_, _ = w.Write([]byte(fmt.Sprintf("error, %s", err)))
 		return
 	}
 
-	if ip == "127.0.0.1" {
-		log.Print("Reload server because changed configmap")
+	if ip.IsLoopback() {
+		loggerFrom(r.Context()).Info("Reload config because changed configmap")
+		if i.reloader == nil {
+			http.Error(w, "reload not available", http.StatusInternalServerError)
+			return
+		}
+		if err := i.reloader.reload(); err != nil {
+			http.Error(w, fmt.Sprintf("error, %s", err), http.StatusInternalServerError)
+			return
+		}
 		_, _ = w.Write([]byte("reloaded"))
-		go os.Exit(0)
 	} else {
 		w.WriteHeader(http.StatusForbidden)
 		_, _ = w.Write([]byte("forbidden"))
@@ -388,3 +400,10 @@ func ok200(w http.ResponseWriter, _ *http.Request) {
 		http.Error(w, "Failed to return 200 (OK)", http.StatusInternalServerError)
 	}
 }
+
+// logSecurityAlert logs a denied access to an Inventory. Only the fields
+// needed to track the client are logged, never the request headers.
+func logSecurityAlert(log logr.Logger, r *http.Request, clientIP, mac string) {
+	log.Info("SECURITY Error Alert! MAC does not match with provided UUID from inventory",
+		"clientIP", clientIP, "mac", mac, "remoteAddr", r.RemoteAddr, "userAgent", r.UserAgent())
+}
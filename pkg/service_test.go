@@ -9,9 +9,14 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
+	"sync/atomic"
 
+	ipamv1alpha1 "github.com/ironcore-dev/ipam/api/ipam/v1alpha1"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
 )
 
 var _ = Describe("iPXE service without test data", func() {
@@ -19,6 +24,7 @@ var _ = Describe("iPXE service without test data", func() {
 		It("Chain ", func() {
 			req, err := http.NewRequest("GET", "/ipxe", nil)
 			req.Header.Set("X-FORWARDED-FOR", validIP1)
+			req.RemoteAddr = proxyAddr
 			Expect(err).ToNot(HaveOccurred())
 
 			rr := httptest.NewRecorder()
@@ -38,6 +44,7 @@ var _ = Describe("iPXE service without test data", func() {
 		It("Chain with bad uuid", func() {
 			req, err := http.NewRequest("GET", fmt.Sprintf("/ipxe/%s/boot", badUUID), nil)
 			req.Header.Set("X-FORWARDED-FOR", validIP1)
+			req.RemoteAddr = proxyAddr
 			Expect(err).ToNot(HaveOccurred())
 
 			rr := httptest.NewRecorder()
@@ -45,12 +52,13 @@ var _ = Describe("iPXE service without test data", func() {
 			handler := http.Handler(rtr)
 			handler.ServeHTTP(rr, req)
 
-			Expect(rr.Code).Should(BeNumerically("==", http.StatusInternalServerError))
+			Expect(rr.Code).Should(BeNumerically("==", http.StatusForbidden))
 		})
 
 		It("Ignition with bad uuid", func() {
 			req, err := http.NewRequest("GET", fmt.Sprintf("/ignition/%s/default", badUUID), nil)
 			req.Header.Set("X-FORWARDED-FOR", validIP1)
+			req.RemoteAddr = proxyAddr
 			Expect(err).ToNot(HaveOccurred())
 
 			rr := httptest.NewRecorder()
@@ -58,7 +66,7 @@ var _ = Describe("iPXE service without test data", func() {
 			handler := http.Handler(rtr)
 			handler.ServeHTTP(rr, req)
 
-			Expect(rr.Code).Should(BeNumerically("==", http.StatusInternalServerError))
+			Expect(rr.Code).Should(BeNumerically("==", http.StatusForbidden))
 		})
 	})
 })
@@ -71,6 +79,7 @@ var _ = Describe("iPXE service with test data", func() {
 		It("Ignition with valid ip and bad uuid", func() {
 			req, err := http.NewRequest("GET", fmt.Sprintf("/ignition/%s/default", badUUID), nil)
 			req.Header.Set("X-FORWARDED-FOR", validIP1)
+			req.RemoteAddr = proxyAddr
 			Expect(err).ToNot(HaveOccurred())
 
 			rr := httptest.NewRecorder()
@@ -78,12 +87,13 @@ var _ = Describe("iPXE service with test data", func() {
 			handler := http.Handler(rtr)
 			handler.ServeHTTP(rr, req)
 
-			Expect(rr.Code).Should(BeNumerically("==", http.StatusInternalServerError))
+			Expect(rr.Code).Should(BeNumerically("==", http.StatusNotFound))
 		})
 
 		It("Ignition with valid ip and uuid", func() {
 			req, err := http.NewRequest("GET", fmt.Sprintf("/ignition/%s/default", uuid), nil)
 			req.Header.Set("X-FORWARDED-FOR", validIP1)
+			req.RemoteAddr = proxyAddr
 			Expect(err).ToNot(HaveOccurred())
 
 			rr := httptest.NewRecorder()
@@ -103,6 +113,7 @@ var _ = Describe("iPXE service with test data", func() {
 		It("Ignition with valid ip and empty inventory uuid", func() {
 			req, err := http.NewRequest("GET", fmt.Sprintf("/ignition/%s/default", emptyInventoryUUID), nil)
 			req.Header.Set("X-FORWARDED-FOR", validIP2)
+			req.RemoteAddr = proxyAddr
 			Expect(err).ToNot(HaveOccurred())
 
 			rr := httptest.NewRecorder()
@@ -122,6 +133,7 @@ var _ = Describe("iPXE service with test data", func() {
 		It("Chain with valid emtpy inventory uuid", func() {
 			req, err := http.NewRequest("GET", fmt.Sprintf("/ipxe/%s/boot", emptyInventoryUUID), nil)
 			req.Header.Set("X-FORWARDED-FOR", validIP1)
+			req.RemoteAddr = proxyAddr
 			Expect(err).ToNot(HaveOccurred())
 
 			rr := httptest.NewRecorder()
@@ -141,6 +153,7 @@ var _ = Describe("iPXE service with test data", func() {
 		It("Chain with valid uuid", func() {
 			req, err := http.NewRequest("GET", fmt.Sprintf("/ipxe/%s/boot", uuid), nil)
 			req.Header.Set("X-FORWARDED-FOR", validIP1)
+			req.RemoteAddr = proxyAddr
 			Expect(err).ToNot(HaveOccurred())
 
 			rr := httptest.NewRecorder()
@@ -160,6 +173,7 @@ var _ = Describe("iPXE service with test data", func() {
 		It("Chain with bad ip and valid uuid", func() {
 			req, err := http.NewRequest("GET", fmt.Sprintf("/ipxe/%s/boot", uuid), nil)
 			req.Header.Set("X-FORWARDED-FOR", badIP)
+			req.RemoteAddr = proxyAddr
 			Expect(err).ToNot(HaveOccurred())
 
 			rr := httptest.NewRecorder()
@@ -167,7 +181,74 @@ var _ = Describe("iPXE service with test data", func() {
 			handler := http.Handler(rtr)
 			handler.ServeHTTP(rr, req)
 
-			Expect(rr.Code).Should(BeNumerically("==", http.StatusInternalServerError))
+			Expect(rr.Code).Should(BeNumerically("==", http.StatusForbidden))
+		})
+	})
+})
+
+var _ = Describe("iPXE service with cache", func() {
+	Context("Access", func() {
+		ctx := context.Background()
+		SetupTestData(ctx)
+
+		It("Chain with valid uuid", func() {
+			cacheCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+
+			cachedIPXE := ipxe
+			err := cachedIPXE.K8sClient.StartCache(cacheCtx, cachedIPXE.Config)
+			Expect(err).ToNot(HaveOccurred())
+
+			req, err := http.NewRequest("GET", fmt.Sprintf("/ipxe/%s/boot", uuid), nil)
+			req.Header.Set("X-FORWARDED-FOR", validIP1)
+			req.RemoteAddr = proxyAddr
+			Expect(err).ToNot(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			rtr := cachedIPXE.getRouter()
+			handler := http.Handler(rtr)
+			handler.ServeHTTP(rr, req)
+
+			Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+
+			expected, err := os.ReadFile("../config/samples/configmap/ipxe-f2175eb4-e203-11ec-b5d5-3a68dd76b473")
+			Expect(err).ToNot(HaveOccurred())
+
+			By("Expect successful iPXE response")
+			Expect(rr.Body.String()).Should(BeIdenticalTo(string(expected)))
+		})
+
+		It("Index inventory mac labels", func() {
+			inventory, err := ipxe.K8sClient.getInventory(ctx, uuid, namespace)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(inventoryMacIndexer(inventory)).Should(ConsistOf("08c0eba29904", "08c0eba29905"))
+		})
+
+		It("Trusts an empty IP cache", func() {
+			cacheCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+
+			live, err := client.NewWithWatch(ipxe.K8sClient.restConfig, client.Options{Scheme: ipxe.K8sClient.Client.Scheme()})
+			Expect(err).ToNot(HaveOccurred())
+			var lists atomic.Int32
+			cached := ipxe.K8sClient
+			cached.Client = interceptor.NewClient(live, interceptor.Funcs{
+				List: func(ctx context.Context, c client.WithWatch, list client.ObjectList, opts ...client.ListOption) error {
+					lists.Add(1)
+					return c.List(ctx, list, opts...)
+				},
+			})
+			Expect(cached.StartCache(cacheCtx, ipxe.Config)).To(Succeed())
+
+			ips := &ipamv1alpha1.IPList{}
+			Expect(cached.listIPs(ctx, ips, namespace, ipLabel, strings.ReplaceAll(badIP, ":", "-"))).To(Succeed())
+			Expect(ips.Items).To(BeEmpty())
+			Expect(lists.Load()).To(BeNumerically("==", 0))
+
+			By("Serving indexed IPs from the cache")
+			Expect(cached.listIPs(ctx, ips, namespace, macLabel, "08c0eba29904")).To(Succeed())
+			Expect(ips.Items).ToNot(BeEmpty())
+			Expect(lists.Load()).To(BeNumerically("==", 0))
 		})
 	})
 })
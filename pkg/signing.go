@@ -0,0 +1,286 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mozilla.org/pkcs7"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// SignatureSuffix is appended to the URL of a script to get its detached
+// signature, e.g. /ipxe.sig for /ipxe.
+const SignatureSuffix = ".sig"
+
+// SigningConfig configures the signing of iPXE scripts. Secret is a
+// kubernetes.io/tls Secret in the ConfigMap namespace, tls.crt holds the
+// signer certificate followed by its intermediates and the optional ca.crt
+// the root the iPXE binaries trust.
+type SigningConfig struct {
+	Enabled bool   `yaml:"enabled,omitempty"`
+	Secret  string `yaml:"secret,omitempty"`
+}
+
+type signer struct {
+	cert  *x509.Certificate
+	key   any
+	chain []*x509.Certificate
+}
+
+func (i IPXE) getSigner(ctx context.Context) (*signer, error) {
+	conf := i.Config.Signing
+	if !conf.Enabled {
+		return nil, errors.New("Signing is disabled")
+	}
+	if conf.Secret == "" {
+		return nil, errors.New("Signing requires a secret")
+	}
+
+	secret, err := i.K8sClient.getSecret(ctx, conf.Secret, i.Config.ConfigmapNS)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPair, err := tls.X509KeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse signing Secret %s", conf.Secret)
+	}
+
+	s := &signer{key: keyPair.PrivateKey}
+	for n, der := range keyPair.Certificate {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to parse certificate of signing Secret %s", conf.Secret)
+		}
+		if n == 0 {
+			s.cert = cert
+		} else {
+			s.chain = append(s.chain, cert)
+		}
+	}
+
+	rest := secret.Data["ca.crt"]
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to parse ca.crt of signing Secret %s", conf.Secret)
+		}
+		s.chain = append(s.chain, cert)
+	}
+
+	return s, nil
+}
+
+// sign creates a detached DER encoded CMS signature of data as expected by
+// the iPXE imgverify command. iPXE verifies the digest of the content itself,
+// so no signed attributes are added.
+func (s *signer) sign(data []byte) ([]byte, error) {
+	signedData, err := pkcs7.NewSignedData(data)
+	if err != nil {
+		return nil, err
+	}
+	signedData.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	if err := signedData.SignWithoutAttr(s.cert, s.key, pkcs7.SignerInfoConfig{}); err != nil {
+		return nil, errors.Wrap(err, "Failed to sign")
+	}
+	for _, cert := range s.chain {
+		signedData.AddCertificate(cert)
+	}
+	signedData.Detach()
+
+	return signedData.Finish()
+}
+
+// pemChain returns the signer certificate and its chain PEM encoded.
+func (s *signer) pemChain() []byte {
+	var out bytes.Buffer
+	for _, cert := range append([]*x509.Certificate{s.cert}, s.chain...) {
+		_ = pem.Encode(&out, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return out.Bytes()
+}
+
+// withSignature signs the script the handler h serves when signing is enabled.
+// The script is rendered once, its signature is kept for the client and served
+// by getSignature, so templates with random or time dependent output and
+// one-time overrides are signed as they were served.
+func withSignature(h func(IPXE, http.ResponseWriter, *http.Request)) func(IPXE, http.ResponseWriter, *http.Request) {
+	return func(i IPXE, w http.ResponseWriter, r *http.Request) {
+		if !i.Config.Signing.Enabled {
+			h(i, w, r)
+			return
+		}
+
+		s, err := i.getSigner(r.Context())
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		clientIP, err := i.getIP(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		script := newBufferedResponseWriter()
+		h(i, script, r)
+		key := signatureKey(clientIP, r.URL.Path, r.URL.RawQuery)
+		switch {
+		case script.status == http.StatusOK:
+			signature, err := s.sign(script.body.Bytes())
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			signatures.put(key, signedScript{signature: signature})
+		case script.status >= 300 && script.status < 400:
+			// the signature of a redirected script is at the redirected path
+			signatures.put(key, signedScript{location: script.header.Get("Location")})
+		}
+		copyResponse(w, script)
+	}
+}
+
+// getSignature answers with the detached signature of the script at the path
+// without SignatureSuffix which was served to the client last.
+func (i IPXE) getSignature(w http.ResponseWriter, r *http.Request) {
+	if !i.Config.Signing.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+	clientIP, err := i.getIP(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	scriptPath := strings.TrimSuffix(r.URL.Path, SignatureSuffix)
+	script, ok := signatures.get(signatureKey(clientIP, scriptPath, r.URL.RawQuery))
+	if !ok {
+		writeError(w, r, &NotFoundError{Kind: "Signature", Name: scriptPath})
+		return
+	}
+	if script.location != "" {
+		location, query, _ := strings.Cut(script.location, "?")
+		http.Redirect(w, r, withQuery(location+SignatureSuffix, query), http.StatusFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pkcs7-signature")
+	_, _ = w.Write(script.signature)
+}
+
+func signatureKey(clientIP, path, query string) string {
+	return clientIP + " " + path + "?" + query
+}
+
+// signatureTTL is how long the signature of a served script is kept, iPXE
+// fetches it right after the script.
+const signatureTTL = 10 * time.Minute
+
+// maxSignatures bounds the signatures kept, the oldest are dropped first.
+const maxSignatures = 10000
+
+var signatures = &signatureStore{scripts: map[string]signedScript{}}
+
+// signedScript is the signature of a served script or, if the script was a
+// redirect, its location.
+type signedScript struct {
+	signature []byte
+	location  string
+	expires   time.Time
+}
+
+// signatureStore keeps the signatures of the scripts served by this replica.
+// As all signatures live as long, the order of insertion is also the order of
+// expiry.
+type signatureStore struct {
+	mu      sync.Mutex
+	scripts map[string]signedScript
+	order   []signatureEntry
+}
+
+// signatureEntry is the key of a stored signature in the order of insertion.
+type signatureEntry struct {
+	key     string
+	expires time.Time
+}
+
+func (s *signatureStore) put(key string, script signedScript) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for len(s.order) > 0 && (len(s.scripts) >= maxSignatures || now.After(s.order[0].expires)) {
+		oldest := s.order[0]
+		s.order = s.order[1:]
+		// a key signed again has a newer entry further back
+		if stored, ok := s.scripts[oldest.key]; ok && stored.expires.Equal(oldest.expires) {
+			delete(s.scripts, oldest.key)
+		}
+	}
+	script.expires = now.Add(signatureTTL)
+	s.scripts[key] = script
+	s.order = append(s.order, signatureEntry{key: key, expires: script.expires})
+}
+
+func (s *signatureStore) get(key string) (signedScript, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	script, ok := s.scripts[key]
+	if !ok || time.Now().After(script.expires) {
+		return signedScript{}, false
+	}
+	return script, true
+}
+
+// bufferedResponseWriter keeps the response of a handler in memory.
+type bufferedResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponseWriter() *bufferedResponseWriter {
+	return &bufferedResponseWriter{header: http.Header{}, status: http.StatusOK}
+}
+
+func (b *bufferedResponseWriter) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponseWriter) Write(data []byte) (int, error) {
+	return b.body.Write(data)
+}
+
+func (b *bufferedResponseWriter) WriteHeader(status int) {
+	b.status = status
+}
+
+func copyResponse(w http.ResponseWriter, b *bufferedResponseWriter) {
+	for key, values := range b.header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(b.status)
+	_, _ = w.Write(b.body.Bytes())
+}
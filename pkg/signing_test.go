@@ -0,0 +1,203 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.mozilla.org/pkcs7"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const signingSecret = "ipxe-signing"
+
+func serveRequest(handler http.Handler, url string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", url, nil)
+	Expect(err).ToNot(HaveOccurred())
+	req.Header.Set("X-Forwarded-For", validIP1)
+	req.RemoteAddr = proxyAddr
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+// newRSATestCert returns a code signing certificate with an RSA key, the only
+// key type iPXE imgverify supports.
+func newRSATestCert() ([]byte, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	Expect(err).ToNot(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ipxe-service"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).ToNot(HaveOccurred())
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+// expectSignature verifies the detached signature rr of script.
+func expectSignature(rr *httptest.ResponseRecorder, script []byte) *pkcs7.PKCS7 {
+	Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+	Expect(rr.Header().Get("Content-Type")).To(Equal("application/pkcs7-signature"))
+
+	signature, err := pkcs7.Parse(rr.Body.Bytes())
+	Expect(err).ToNot(HaveOccurred())
+	Expect(signature.Content).To(BeEmpty())
+	signature.Content = script
+	Expect(signature.Verify()).To(Succeed())
+	return signature
+}
+
+var _ = Describe("Signing", func() {
+	ctx := context.Background()
+	SetupTestData(ctx)
+
+	var certPEM []byte
+	var secret *corev1.Secret
+	var signingIPXE IPXE
+
+	BeforeEach(func() {
+		var keyPEM []byte
+		certPEM, keyPEM = newTestCert(1)
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      signingSecret,
+				Namespace: namespace,
+			},
+			Type: corev1.SecretTypeTLS,
+			Data: map[string][]byte{
+				corev1.TLSCertKey:       certPEM,
+				corev1.TLSPrivateKeyKey: keyPEM,
+			},
+		}
+		Expect(ipxe.K8sClient.Client.Create(ctx, secret)).To(Succeed())
+		DeferCleanup(func() {
+			Expect(ipxe.K8sClient.Client.Delete(ctx, secret)).To(Succeed())
+		})
+
+		signingIPXE = ipxe
+		signingIPXE.Config.Signing = SigningConfig{Enabled: true, Secret: signingSecret}
+	})
+
+	It("Does not serve signatures when disabled", func() {
+		serveRequest(ipxe.getRouter(), "/ipxe")
+		rr := serveRequest(ipxe.getRouter(), "/ipxe.sig")
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusNotFound))
+	})
+
+	It("Signs the default script", func() {
+		script := serveRequest(signingIPXE.getRouter(), "/ipxe")
+		Expect(script.Code).Should(BeNumerically("==", http.StatusOK))
+		signature := expectSignature(serveRequest(signingIPXE.getRouter(), "/ipxe.sig"), script.Body.Bytes())
+
+		By("rejecting a modified script")
+		signature.Content = append(script.Body.Bytes(), []byte("shell\n")...)
+		Expect(signature.Verify()).ToNot(Succeed())
+	})
+
+	It("Signs the script as it was served", func() {
+		configMap := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "ipxe-signed", Namespace: namespace},
+			Data:       map[string]string{"boot": "#!ipxe\necho first\n"},
+		}
+		Expect(ipxe.K8sClient.Client.Create(ctx, configMap)).To(Succeed())
+		DeferCleanup(func() {
+			Expect(ipxe.K8sClient.Client.Delete(ctx, configMap)).To(Succeed())
+		})
+		signingIPXE.Config.Rules = []Rule{{
+			Name:     "signed",
+			Match:    RuleMatch{Path: "/ipxe/signed"},
+			Resource: RuleResource{ConfigMap: &RuleKeyRef{Name: "ipxe-signed", Key: "boot"}},
+		}}
+
+		script := serveRequest(signingIPXE.Handler(), "/ipxe/signed")
+		Expect(script.Code).Should(BeNumerically("==", http.StatusOK))
+
+		By("changing the script before iPXE fetches the signature")
+		configMap.Data["boot"] = "#!ipxe\necho second\n"
+		Expect(ipxe.K8sClient.Client.Update(ctx, configMap)).To(Succeed())
+		expectSignature(serveRequest(signingIPXE.Handler(), "/ipxe/signed.sig"), script.Body.Bytes())
+	})
+
+	It("Signs with RSA keys", func() {
+		certPEM, keyPEM := newRSATestCert()
+		secret.Data[corev1.TLSCertKey] = certPEM
+		secret.Data[corev1.TLSPrivateKeyKey] = keyPEM
+		Expect(ipxe.K8sClient.Client.Update(ctx, secret)).To(Succeed())
+
+		script := serveRequest(signingIPXE.getRouter(), "/ipxe")
+		Expect(script.Code).Should(BeNumerically("==", http.StatusOK))
+		signature := expectSignature(serveRequest(signingIPXE.getRouter(), "/ipxe.sig"), script.Body.Bytes())
+		Expect(signature.GetOnlySigner().PublicKeyAlgorithm).To(Equal(x509.RSA))
+	})
+
+	It("Signs the redirected script at the redirected path", func() {
+		signingIPXE.Config.IdentityChain = IdentityChainConfig{Enabled: true, Redirect: true}
+
+		rr := serveRequest(signingIPXE.getRouter(), "/ipxe")
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusFound))
+		rr = serveRequest(signingIPXE.getRouter(), "/ipxe.sig")
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusFound))
+		Expect(rr.Header().Get("Location")).To(Equal("/ipxe/" + uuid + "/boot.sig"))
+	})
+
+	It("Does not sign scripts which were not served", func() {
+		expectError(serveRequest(signingIPXE.getRouter(), "/ipxe/"+badUUID+"/ipxe"), http.StatusNotFound, "inventory_not_found")
+		expectError(serveRequest(signingIPXE.getRouter(), "/ipxe/"+badUUID+"/ipxe.sig"), http.StatusNotFound, "signature_not_found")
+		expectError(serveRequest(signingIPXE.getRouter(), "/ipxe/"+uuid+"/never.sig"), http.StatusNotFound, "signature_not_found")
+	})
+
+	It("Fails without signing Secret", func() {
+		signingIPXE.Config.Signing.Secret = "missing"
+
+		rr := serveRequest(signingIPXE.getRouter(), "/ipxe")
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusNotFound))
+	})
+
+	It("Exposes the signer chain", func() {
+		rr := serveRequest(signingIPXE.Handler(), "/cert")
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+		Expect(rr.Body.String()).To(ContainSubstring(string(certPEM)))
+	})
+
+	It("Drops the oldest signatures first", func() {
+		store := &signatureStore{scripts: map[string]signedScript{}}
+		store.put("first", signedScript{location: "/first"})
+		for k := 1; k < maxSignatures; k++ {
+			store.put(fmt.Sprintf("key-%d", k), signedScript{})
+		}
+		store.put("first", signedScript{location: "/again"})
+		store.put("last", signedScript{})
+
+		Expect(store.scripts).To(HaveLen(maxSignatures))
+		_, ok := store.get("key-1")
+		Expect(ok).To(BeFalse())
+		script, ok := store.get("first")
+		Expect(ok).To(BeTrue())
+		Expect(script.location).To(Equal("/again"))
+		_, ok = store.get("last")
+		Expect(ok).To(BeTrue())
+	})
+})
@@ -16,6 +16,7 @@ import (
 	"k8s.io/apimachinery/pkg/util/yaml"
 
 	ipamv1alpha1 "github.com/ironcore-dev/ipam/api/ipam/v1alpha1"
+	ipxev1alpha1 "github.com/ironcore-dev/ipxe-service/api/v1alpha1"
 	inventoryv1alpha4 "github.com/ironcore-dev/metal/apis/metal/v1alpha4"
 
 	corev1 "k8s.io/api/core/v1"
@@ -43,6 +44,8 @@ var (
 	validIP2           = "fd00:0da8:fff6:3302::b:2"
 	badIP              = "fd00:0da8:fff6:3302::f:1"
 	namespace          = "metal-api-system"
+	proxyAddr          = "192.0.2.1:1234"
+	trustedProxies     = "192.0.2.0/24"
 )
 
 func TestIPXEService(t *testing.T) {
@@ -60,6 +63,7 @@ var _ = BeforeSuite(func() {
 	testEnv = &envtest.Environment{
 		CRDDirectoryPaths: []string{
 			filepath.Join("..", "config", "crd", "bases"),
+			filepath.Join("..", "config", "crd", "ipxe"),
 		},
 		ErrorIfCRDPathMissing: true,
 	}
@@ -89,12 +93,17 @@ var _ = BeforeSuite(func() {
 	Expect(inventoryv1alpha4.AddToScheme(scheme)).NotTo(HaveOccurred())
 	Expect(ipamv1alpha1.AddToScheme(scheme)).NotTo(HaveOccurred())
 	Expect(corev1.AddToScheme(scheme)).NotTo(HaveOccurred())
+	Expect(ipxev1alpha1.AddToScheme(scheme)).NotTo(HaveOccurred())
 
 	// +kubebuilder:scaffold:scheme
 	k8sClient := NewK8sClient(cfg, client.Options{Scheme: scheme})
 	Expect(k8sClient).ToNot(BeNil())
 
+	// The suite reads through the live client, K8sClient.Cache is only set by
+	// the tests of the cache. Tests which update objects and serve them right
+	// away wait with Eventually, so they also hold with a cache.
 	conf := GetConf("../config/samples/config.yaml")
+	conf.TrustedProxies = []string{trustedProxies}
 	ipxe = IPXE{
 		Config:    conf,
 		K8sClient: k8sClient,
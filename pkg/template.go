@@ -0,0 +1,151 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"text/template"
+
+	"github.com/Masterminds/sprig"
+	ipamv1alpha1 "github.com/ironcore-dev/ipam/api/ipam/v1alpha1"
+	inventoryv1alpha4 "github.com/ironcore-dev/metal/apis/metal/v1alpha4"
+	"github.com/pkg/errors"
+)
+
+// IPXETemplateData is passed to the default and per-machine iPXE scripts.
+// Labels and Spec are empty as long as the machine is unknown.
+type IPXETemplateData struct {
+	UUID      string
+	MAC       string
+	ClientIP  string
+	IPVersion string
+	Host      string
+	Labels    map[string]string
+	Spec      inventoryv1alpha4.InventorySpec
+}
+
+func newIPXETemplateData(uuid, mac, clientIP, host string, inventory *inventoryv1alpha4.Inventory) IPXETemplateData {
+	data := IPXETemplateData{
+		UUID:     uuid,
+		MAC:      mac,
+		ClientIP: clientIP,
+		Host:     host,
+	}
+	if clientIP != "" {
+		data.IPVersion = getIPVersion(clientIP)
+	}
+	if inventory != nil {
+		data.Labels = inventory.Labels
+		data.Spec = inventory.Spec
+	}
+
+	return data
+}
+
+// IgnitionTemplateVersion is the version of IgnitionTemplateData. It is
+// raised on incompatible changes of the data model, so templates can guard
+// on it with {{ if eq .Version "v1" }}.
+const IgnitionTemplateVersion = "v1"
+
+// IgnitionTemplateData is passed to the default and per-machine ignition
+// templates. See docs/documentation.md for a description of all fields.
+type IgnitionTemplateData struct {
+	Version    string
+	UUID       string
+	Hostname   string
+	Kubeconfig string
+	MAC        string
+	ClientIP   string
+	IPVersion  string
+	Labels     map[string]string
+
+	// hardware facts of the Inventory
+	System *inventoryv1alpha4.SystemSpec
+	CPUs   []inventoryv1alpha4.CPUSpec
+	Memory *inventoryv1alpha4.MemorySpec
+	NICs   []inventoryv1alpha4.NICSpec
+	Blocks []inventoryv1alpha4.BlockSpec
+
+	// NIC, IP and Subnet of the requesting interface, nil if unknown
+	NIC    *inventoryv1alpha4.NICSpec
+	IP     *ipamv1alpha1.IP
+	Subnet *ipamv1alpha1.Subnet
+}
+
+func newIgnitionTemplateData(uuid, mac, clientIP string, inventory *inventoryv1alpha4.Inventory) IgnitionTemplateData {
+	data := IgnitionTemplateData{
+		Version:   IgnitionTemplateVersion,
+		UUID:      uuid,
+		Hostname:  uuid,
+		MAC:       mac,
+		ClientIP:  clientIP,
+		IPVersion: getIPVersion(clientIP),
+	}
+	if inventory == nil {
+		return data
+	}
+
+	spec := inventory.Spec
+	data.Labels = inventory.Labels
+	data.System = spec.System
+	data.CPUs = spec.CPUs
+	data.Memory = spec.Memory
+	data.NICs = spec.NICs
+	data.Blocks = spec.Blocks
+	if spec.Host != nil && spec.Host.Name != "" {
+		data.Hostname = spec.Host.Name
+	}
+	for n := range spec.NICs {
+		if strings.ReplaceAll(strings.ToLower(spec.NICs[n].MACAddress), ":", "") == mac {
+			data.NIC = &spec.NICs[n]
+			break
+		}
+	}
+
+	return data
+}
+
+// ignitionTemplateData completes the template data with the IPAM IP and
+// Subnet of the client. Both are optional, lookup errors are only logged.
+func (i IPXE) ignitionTemplateData(ctx context.Context, uuid, mac, clientIP string, inventory *inventoryv1alpha4.Inventory) IgnitionTemplateData {
+	data := newIgnitionTemplateData(uuid, mac, clientIP, inventory)
+
+	ip, err := i.K8sClient.getIPAMIP(ctx, clientIP, i.Config.IpamNS)
+	if err != nil {
+		loggerFrom(ctx).Info("No IPAM IP for ignition template", "ip", clientIP, "error", err.Error())
+		return data
+	}
+	data.IP = ip
+
+	subnet, err := i.K8sClient.getSubnet(ctx, ip.Spec.Subnet.Name, ip.Namespace)
+	if err != nil {
+		loggerFrom(ctx).Info("No Subnet for ignition template", "subnet", ip.Spec.Subnet.Name, "error", err.Error())
+		return data
+	}
+	data.Subnet = subnet
+
+	return data
+}
+
+// renderTemplate executes the text/template text with the sprig functions,
+// the same engine is used for iPXE scripts and ignition parts.
+func renderTemplate(ctx context.Context, name string, text []byte, data any) (_ []byte, err error) {
+	_, span := startSpan(ctx, "renderTemplate", attrPart.String(name))
+	defer func() { endSpan(span, err) }()
+
+	tmpl, err := template.New(name).Funcs(sprig.HermeticTxtFuncMap()).Parse(string(text))
+	if err != nil {
+		return nil, &RenderError{Name: name, Err: errors.Wrap(err, "Failed to parse template")}
+	}
+
+	var out bytes.Buffer
+	err = tmpl.Execute(&out, data)
+	if err != nil {
+		return nil, &RenderError{Name: name, Err: errors.Wrap(err, "Failed to execute template")}
+	}
+
+	return out.Bytes(), nil
+}
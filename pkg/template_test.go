@@ -0,0 +1,87 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+
+	inventoryv1alpha4 "github.com/ironcore-dev/metal/apis/metal/v1alpha4"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("Template rendering", func() {
+	Context("iPXE", func() {
+		It("Renders the iPXE template data", func() {
+			inventory := &inventoryv1alpha4.Inventory{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{"machine.onmetal.de/size-compute-metal": "true"},
+				},
+				Spec: inventoryv1alpha4.InventorySpec{
+					System: &inventoryv1alpha4.SystemSpec{ID: uuid, SerialNumber: "W800656X"},
+				},
+			}
+			text := `#!ipxe
+set uuid {{ .UUID }}
+set mac {{ .MAC }}
+set ip {{ .ClientIP }} {{ .IPVersion }}
+set url http://{{ .Host }}/ignition/{{ .UUID }}/default
+set serial {{ .Spec.System.SerialNumber }}
+{{- if index .Labels "machine.onmetal.de/size-compute-metal" }}
+set size compute
+{{- end }}
+set ${uuid}
+`
+			data := newIPXETemplateData(uuid, "08c0eba29904", validIP1, "ipxe-service", inventory)
+			out, err := renderTemplate(ctx, "boot", []byte(text), data)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(out)).Should(Equal(`#!ipxe
+set uuid f2175eb4-e203-11ec-b5d5-3a68dd76b473
+set mac 08c0eba29904
+set ip fd00:0da8:fff6:3302::b:1 ipv6
+set url http://ipxe-service/ignition/f2175eb4-e203-11ec-b5d5-3a68dd76b473/default
+set serial W800656X
+set size compute
+set ${uuid}
+`))
+		})
+
+		It("Fails on invalid templates", func() {
+			_, err := renderTemplate(ctx, "boot", []byte("{{ .Unknown }"), IPXETemplateData{})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("Ignition", func() {
+		ctx := context.Background()
+		SetupTestData(ctx)
+
+		It("Renders inventory and IPAM data", func() {
+			inventory, err := ipxe.K8sClient.getInventory(ctx, uuid, namespace)
+			Expect(err).ToNot(HaveOccurred())
+
+			text := `version: {{ .Version }}
+hostname: {{ .Hostname }}
+serial: {{ .System.SerialNumber }}
+nic: {{ .NIC.Name }}
+ip: {{ .IP.Spec.IP }}
+subnet: {{ .Subnet.Spec.CIDR }}
+blocks: {{ len .Blocks }}
+`
+			data := ipxe.ignitionTemplateData(ctx, uuid, "08c0eba29904", validIP1, inventory)
+			out, err := renderTemplate(ctx, "ignition-default", []byte(text), data)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(out)).Should(Equal(fmt.Sprintf(`version: v1
+hostname: f2175eb4-e203-11ec-b5d5-3a68dd76b473
+serial: W800656X
+nic: ens4f0np0
+ip: fd00:da8:fff6:3302::b:1
+subnet: fd00:da8:fff6::/48
+blocks: %d
+`, len(inventory.Spec.Blocks))))
+		})
+	})
+})
@@ -0,0 +1,144 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pin/tftp/v3"
+	"github.com/pkg/errors"
+)
+
+type TFTPConfig struct {
+	Enabled    bool   `yaml:"enabled,omitempty"`
+	Address    string `yaml:"address,omitempty"`
+	Directory  string `yaml:"directory,omitempty"`
+	ConfigMap  string `yaml:"configmap,omitempty"`
+	ScriptName string `yaml:"script-name,omitempty"`
+	ChainURL   string `yaml:"chain-url,omitempty"`
+}
+
+type tftpHook struct{}
+
+func (tftpHook) OnSuccess(stats tftp.TransferStats) {
+	logger.Info("TFTP sent file", "file", stats.Filename, "remoteAddr", stats.RemoteAddr.String(), "duration", stats.Duration)
+	requestTFTPDuration.WithLabelValues(outcomeServed).Observe(stats.Duration.Seconds())
+}
+
+func (tftpHook) OnFailure(stats tftp.TransferStats, err error) {
+	logger.Error(err, "TFTP failed to send file", "file", stats.Filename, "remoteAddr", stats.RemoteAddr.String())
+	requestTFTPDuration.WithLabelValues(outcomeError).Observe(stats.Duration.Seconds())
+}
+
+// startTFTP serves TFTP until ctx is done. It returns the error if the server
+// fails to listen.
+func (i IPXE) startTFTP(ctx context.Context) error {
+	address := i.Config.TFTP.Address
+	if address == "" {
+		address = DefaultTFTPAddress
+	}
+
+	s := tftp.NewServer(i.tftpReadHandler, nil)
+	s.SetHook(tftpHook{})
+	s.SetTimeout(TimeoutSecond)
+
+	go func() {
+		<-ctx.Done()
+		s.Shutdown()
+	}()
+
+	logger.Info("Start TFTP Server", "address", address)
+	if err := s.ListenAndServe(address); err != nil {
+		return errors.Wrapf(err, "Failed to start TFTP Server on %s", address)
+	}
+	return nil
+}
+
+func (i IPXE) tftpReadHandler(filename string, rf io.ReaderFrom) error {
+	i = i.current()
+	var localIP net.IP
+	if info, ok := rf.(tftp.RequestPacketInfo); ok {
+		localIP = info.LocalIP()
+	}
+	transfer := rf.(tftp.OutgoingTransfer)
+	remoteAddr := transfer.RemoteAddr()
+
+	logger.V(1).Info("TFTP request", "file", filename, "remoteAddr", remoteAddr.IP.String())
+	data, err := i.readTFTPFile(filename, localIP)
+	if err != nil {
+		logger.Error(err, "Failed to read TFTP file", "file", filename, "remoteAddr", remoteAddr.IP.String())
+		return err
+	}
+
+	transfer.SetSize(int64(len(data)))
+	_, err = rf.ReadFrom(bytes.NewReader(data))
+	return err
+}
+
+// readTFTPFile returns the chain script or the content of the iPXE binary
+// filename from the configured directory or ConfigMap.
+func (i IPXE) readTFTPFile(filename string, localIP net.IP) ([]byte, error) {
+	conf := i.Config.TFTP
+	name := strings.TrimPrefix(path.Clean("/"+filename), "/")
+
+	scriptName := conf.ScriptName
+	if scriptName == "" {
+		scriptName = DefaultTFTPScriptName
+	}
+	if name == scriptName {
+		return []byte(i.chainScript(localIP)), nil
+	}
+
+	if conf.Directory != "" {
+		data, err := os.ReadFile(filepath.Join(conf.Directory, filepath.FromSlash(name)))
+		if err == nil {
+			return data, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	if conf.ConfigMap != "" {
+		// TFTP has no request context, bound the read by the transfer timeout
+		ctx, cancel := context.WithTimeout(context.Background(), TimeoutSecond)
+		defer cancel()
+		configMap, err := i.K8sClient.getConfigMag(ctx, conf.ConfigMap, i.Config.ConfigmapNS)
+		if err != nil {
+			return nil, err
+		}
+		if data, ok := configMap.BinaryData[name]; ok {
+			return data, nil
+		}
+		if data, ok := configMap.Data[name]; ok {
+			return []byte(data), nil
+		}
+	}
+
+	return nil, errors.New(fmt.Sprintf("File %s not found", name))
+}
+
+// chainScript generates the iPXE script which chains into the /ipxe route.
+// Without a configured chain URL it points to the HTTP listener on the address
+// the TFTP request was received on.
+func (i IPXE) chainScript(localIP net.IP) string {
+	url := i.Config.TFTP.ChainURL
+	if url == "" {
+		host := "ipxe-service"
+		if localIP != nil && !localIP.IsUnspecified() {
+			host = localIP.String()
+		}
+		url = i.Config.ipxeURL(host)
+	}
+
+	return fmt.Sprintf("#!ipxe\n\nchain --replace --autofree %s\n", url)
+}
@@ -0,0 +1,69 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TFTP server", func() {
+	Context("Files", func() {
+		It("Chain script points to the receiving address", func() {
+			tftpIPXE := ipxe
+			data, err := tftpIPXE.readTFTPFile(DefaultTFTPScriptName, net.ParseIP(validIP1))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).Should(ContainSubstring("chain --replace --autofree http://[fd00:da8:fff6:3302::b:1]:8082/ipxe"))
+		})
+
+		It("Chain script points to the configured listener", func() {
+			tftpIPXE := ipxe
+			tftpIPXE.Config.HTTP.Address = ":8080"
+			data, err := tftpIPXE.readTFTPFile(DefaultTFTPScriptName, net.ParseIP("192.0.2.1"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).Should(ContainSubstring("chain --replace --autofree http://192.0.2.1:8080/ipxe"))
+
+			tftpIPXE.Config.HTTP.Address = "198.51.100.1:8080"
+			data, err = tftpIPXE.readTFTPFile(DefaultTFTPScriptName, net.ParseIP("192.0.2.1"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).Should(ContainSubstring("chain --replace --autofree http://198.51.100.1:8080/ipxe"))
+
+			By("Using the TLS listener without plain HTTP listener")
+			tftpIPXE.Config.TLS = TLSConfig{Enabled: true, DisablePlain: true}
+			data, err = tftpIPXE.readTFTPFile(DefaultTFTPScriptName, net.ParseIP("192.0.2.1"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).Should(ContainSubstring("chain --replace --autofree https://192.0.2.1:8443/ipxe"))
+		})
+
+		It("Chain script uses the configured chain url", func() {
+			tftpIPXE := ipxe
+			tftpIPXE.Config.TFTP.ChainURL = "http://ipxe-service.local/ipxe"
+			data, err := tftpIPXE.readTFTPFile("/"+DefaultTFTPScriptName, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).Should(ContainSubstring("chain --replace --autofree http://ipxe-service.local/ipxe"))
+		})
+
+		It("Binary from directory without path traversal", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "undionly.kpxe"), []byte("binary"), 0o644)).To(Succeed())
+
+			tftpIPXE := ipxe
+			tftpIPXE.Config.TFTP.Directory = dir
+			data, err := tftpIPXE.readTFTPFile("undionly.kpxe", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).Should(Equal("binary"))
+
+			data, err = tftpIPXE.readTFTPFile("../../undionly.kpxe", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).Should(Equal("binary"))
+
+			_, err = tftpIPXE.readTFTPFile("ipxe.efi", nil)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
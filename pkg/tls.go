@@ -0,0 +1,149 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// TLSConfig configures the HTTPS server. The certificate is read either from
+// CertFile and KeyFile or from a kubernetes.io/tls Secret in the ConfigMap
+// namespace, and is reloaded when it changes.
+type TLSConfig struct {
+	Enabled      bool   `yaml:"enabled,omitempty"`
+	Address      string `yaml:"address,omitempty"`
+	CertFile     string `yaml:"cert-file,omitempty"`
+	KeyFile      string `yaml:"key-file,omitempty"`
+	Secret       string `yaml:"secret,omitempty"`
+	DisablePlain bool   `yaml:"disable-plain,omitempty"`
+}
+
+// secretReadInterval is how long a certificate from a Secret is used before
+// the Secret is read again.
+const secretReadInterval = time.Minute
+
+// certLoader returns the current server certificate. The certificate is only
+// parsed again when the files or the Secret changed, on errors the last good
+// certificate is kept. A Secret is read at most once per secretReadInterval
+// instead of on every handshake.
+type certLoader struct {
+	ipxe IPXE
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	version string
+	read    time.Time
+}
+
+func (i IPXE) newTLSConfig() (*tls.Config, error) {
+	conf := i.Config.TLS
+	if conf.Secret == "" && (conf.CertFile == "" || conf.KeyFile == "") {
+		return nil, errors.New("TLS requires a secret or a cert-file and key-file")
+	}
+
+	loader := &certLoader{ipxe: i}
+	if _, err := loader.load(); err != nil {
+		return nil, errors.Wrap(err, "Failed to load TLS certificate")
+	}
+
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: loader.getCertificate,
+	}, nil
+}
+
+func (c *certLoader) getCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := c.load()
+	if err != nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.cert == nil {
+			return nil, err
+		}
+		logger.Error(err, "Failed to reload TLS certificate, keep the current one")
+		return c.cert, nil
+	}
+	return cert, nil
+}
+
+func (c *certLoader) load() (*tls.Certificate, error) {
+	conf := c.ipxe.current().Config
+	if conf.TLS.Secret != "" {
+		return c.loadSecret(conf.TLS.Secret, conf.ConfigmapNS)
+	}
+	return c.loadFiles(conf.TLS.CertFile, conf.TLS.KeyFile)
+}
+
+func (c *certLoader) loadSecret(name, namespace string) (*tls.Certificate, error) {
+	source := fmt.Sprintf("secret/%s/%s/", namespace, name)
+	c.mu.Lock()
+	if c.cert != nil && strings.HasPrefix(c.version, source) && time.Since(c.read) < secretReadInterval {
+		cert := c.cert
+		c.mu.Unlock()
+		return cert, nil
+	}
+	// also failed reads wait for the interval, the current certificate is kept
+	c.read = time.Now()
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), TimeoutSecond)
+	defer cancel()
+	secret, err := c.ipxe.K8sClient.getSecret(ctx, name, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	version := source + secret.ResourceVersion
+	return c.parse(version, func() (tls.Certificate, error) {
+		return tls.X509KeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+	})
+}
+
+func (c *certLoader) loadFiles(certFile, keyFile string) (*tls.Certificate, error) {
+	version := "file"
+	for _, file := range []string{certFile, keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		version += fmt.Sprintf("/%s/%d/%d", file, info.ModTime().UnixNano(), info.Size())
+	}
+
+	return c.parse(version, func() (tls.Certificate, error) {
+		return tls.LoadX509KeyPair(certFile, keyFile)
+	})
+}
+
+func (c *certLoader) parse(version string, parse func() (tls.Certificate, error)) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cert != nil && c.version == version {
+		return c.cert, nil
+	}
+
+	cert, err := parse()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse TLS certificate")
+	}
+	if cert.Leaf != nil && time.Now().After(cert.Leaf.NotAfter) {
+		logger.Info("TLS certificate expired", "notAfter", cert.Leaf.NotAfter)
+	}
+
+	if c.cert != nil {
+		logger.Info("Reloaded TLS certificate")
+	}
+	c.cert = &cert
+	c.version = version
+	return c.cert, nil
+}
@@ -0,0 +1,157 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestCert(serial int64) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "ipxe-service"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"ipxe-service"},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageCodeSigning},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).ToNot(HaveOccurred())
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	Expect(err).ToNot(HaveOccurred())
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func writeTestCert(dir string, serial int64, modTime time.Time) (string, string) {
+	certPEM, keyPEM := newTestCert(serial)
+
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	Expect(os.WriteFile(certFile, certPEM, 0600)).To(Succeed())
+	Expect(os.WriteFile(keyFile, keyPEM, 0600)).To(Succeed())
+	Expect(os.Chtimes(certFile, modTime, modTime)).To(Succeed())
+	Expect(os.Chtimes(keyFile, modTime, modTime)).To(Succeed())
+
+	return certFile, keyFile
+}
+
+func certSerial(tlsIPXE IPXE) int64 {
+	conf, err := tlsIPXE.newTLSConfig()
+	Expect(err).ToNot(HaveOccurred())
+	cert, err := conf.GetCertificate(nil)
+	Expect(err).ToNot(HaveOccurred())
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	Expect(err).ToNot(HaveOccurred())
+	return leaf.SerialNumber.Int64()
+}
+
+var _ = Describe("TLS", func() {
+	Context("Certificate files", func() {
+		It("Fails without a certificate source", func() {
+			tlsIPXE := ipxe
+			tlsIPXE.Config.TLS = TLSConfig{Enabled: true}
+			_, err := tlsIPXE.newTLSConfig()
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Fails with a missing certificate", func() {
+			dir := GinkgoT().TempDir()
+			tlsIPXE := ipxe
+			tlsIPXE.Config.TLS = TLSConfig{
+				Enabled:  true,
+				CertFile: filepath.Join(dir, "tls.crt"),
+				KeyFile:  filepath.Join(dir, "tls.key"),
+			}
+			_, err := tlsIPXE.newTLSConfig()
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Reloads a rotated certificate", func() {
+			dir := GinkgoT().TempDir()
+			now := time.Now()
+			certFile, keyFile := writeTestCert(dir, 1, now.Add(-time.Minute))
+
+			tlsIPXE := ipxe
+			tlsIPXE.Config.TLS = TLSConfig{Enabled: true, CertFile: certFile, KeyFile: keyFile}
+			conf, err := tlsIPXE.newTLSConfig()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.MinVersion).To(BeNumerically("==", 0x0303))
+			Expect(certSerial(tlsIPXE)).To(BeNumerically("==", 1))
+
+			cert, err := conf.GetCertificate(nil)
+			Expect(err).ToNot(HaveOccurred())
+			writeTestCert(dir, 2, now)
+			rotated, err := conf.GetCertificate(nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rotated).ToNot(BeIdenticalTo(cert))
+			leaf, err := x509.ParseCertificate(rotated.Certificate[0])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(leaf.SerialNumber.Int64()).To(BeNumerically("==", 2))
+
+			By("keeping the last good certificate on errors")
+			Expect(os.WriteFile(certFile, []byte("broken"), 0600)).To(Succeed())
+			kept, err := conf.GetCertificate(nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(kept).To(BeIdenticalTo(rotated))
+		})
+	})
+
+	Context("Certificate Secret", func() {
+		It("Reads the Secret once per interval", func() {
+			certPEM, keyPEM := newTestCert(1)
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "ipxe-tls", Namespace: namespace},
+				Type:       corev1.SecretTypeTLS,
+				Data:       map[string][]byte{corev1.TLSCertKey: certPEM, corev1.TLSPrivateKeyKey: keyPEM},
+			}
+			Expect(ipxe.K8sClient.Client.Create(context.Background(), secret)).To(Succeed())
+			DeferCleanup(func() {
+				Expect(ipxe.K8sClient.Client.Delete(context.Background(), secret)).To(Succeed())
+			})
+
+			tlsIPXE := ipxe
+			tlsIPXE.Config.TLS = TLSConfig{Enabled: true, Secret: secret.Name}
+			Expect(certSerial(tlsIPXE)).To(BeNumerically("==", 1))
+
+			loader := &certLoader{ipxe: tlsIPXE}
+			cert, err := loader.getCertificate(nil)
+			Expect(err).ToNot(HaveOccurred())
+			certPEM, keyPEM = newTestCert(2)
+			secret.Data = map[string][]byte{corev1.TLSCertKey: certPEM, corev1.TLSPrivateKeyKey: keyPEM}
+			Expect(ipxe.K8sClient.Client.Update(context.Background(), secret)).To(Succeed())
+			cached, err := loader.getCertificate(nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cached).To(BeIdenticalTo(cert))
+
+			By("reading the rotated certificate after the interval")
+			loader.read = time.Now().Add(-secretReadInterval)
+			rotated, err := loader.getCertificate(nil)
+			Expect(err).ToNot(HaveOccurred())
+			leaf, err := x509.ParseCertificate(rotated.Certificate[0])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(leaf.SerialNumber.Int64()).To(BeNumerically("==", 2))
+		})
+	})
+})
@@ -0,0 +1,190 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/ironcore-dev/ipxe-service"
+
+// Samplers, named like the values of OTEL_TRACES_SAMPLER.
+const (
+	SamplerAlwaysOn                = "always_on"
+	SamplerAlwaysOff               = "always_off"
+	SamplerTraceIDRatio            = "traceidratio"
+	SamplerParentBasedAlwaysOn     = "parentbased_always_on"
+	SamplerParentBasedAlwaysOff    = "parentbased_always_off"
+	SamplerParentBasedTraceIDRatio = "parentbased_traceidratio"
+)
+
+// Attributes of the request and stage spans.
+const (
+	attrUUID      = attribute.Key("ipxe.uuid")
+	attrPart      = attribute.Key("ipxe.part")
+	attrRoute     = attribute.Key("ipxe.route")
+	attrOutcome   = attribute.Key("ipxe.outcome")
+	attrSource    = attribute.Key("ipxe.source")
+	attrMAC       = attribute.Key("ipxe.mac")
+	attrRule      = attribute.Key("ipxe.rule")
+	attrName      = attribute.Key("k8s.object.name")
+	attrNamespace = attribute.Key("k8s.namespace.name")
+)
+
+// TracingConfig configures the export of traces over OTLP/HTTP. Endpoint is
+// the URL of the collector, e.g. http://otel-collector:4318, without it the
+// OTEL_EXPORTER_OTLP_* environment variables are used. SamplerRatio is the
+// ratio of the traceidratio samplers and defaults to 1.
+type TracingConfig struct {
+	Enabled      bool    `yaml:"enabled,omitempty"`
+	Endpoint     string  `yaml:"endpoint,omitempty"`
+	Sampler      string  `yaml:"sampler,omitempty"`
+	SamplerRatio float64 `yaml:"sampler-ratio,omitempty"`
+}
+
+// propagator reads and writes the W3C trace context and baggage headers.
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// routeVariablePattern matches the regular expression of a route variable.
+var routeVariablePattern = regexp.MustCompile(`:[^}]+}`)
+
+// SetupTracing installs the global tracer provider. The returned function
+// flushes the pending spans and has to be called before the service exits.
+func SetupTracing(ctx context.Context, conf TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagator)
+	if !conf.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	sampler, err := newSampler(conf.Sampler, conf.SamplerRatio)
+	if err != nil {
+		return nil, err
+	}
+
+	var options []otlptracehttp.Option
+	if conf.Endpoint != "" {
+		options = append(options, otlptracehttp.WithEndpointURL(conf.Endpoint))
+	}
+	exporter, err := otlptracehttp.New(ctx, options...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create OTLP exporter")
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithSchemaURL(semconv.SchemaURL),
+		resource.WithAttributes(semconv.ServiceName("ipxe-service")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create tracing resource")
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sampler),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	logger.Info("Export traces", "endpoint", conf.Endpoint, "sampler", conf.Sampler)
+
+	return provider.Shutdown, nil
+}
+
+func newSampler(name string, ratio float64) (sdktrace.Sampler, error) {
+	if ratio == 0 {
+		ratio = 1
+	}
+	if ratio < 0 || ratio > 1 {
+		return nil, errors.Errorf("Sampler ratio %v is not between 0 and 1", ratio)
+	}
+
+	switch name {
+	case SamplerAlwaysOn:
+		return sdktrace.AlwaysSample(), nil
+	case SamplerAlwaysOff:
+		return sdktrace.NeverSample(), nil
+	case SamplerTraceIDRatio:
+		return sdktrace.TraceIDRatioBased(ratio), nil
+	case SamplerParentBasedAlwaysOn, "":
+		return sdktrace.ParentBased(sdktrace.AlwaysSample()), nil
+	case SamplerParentBasedAlwaysOff:
+		return sdktrace.ParentBased(sdktrace.NeverSample()), nil
+	case SamplerParentBasedTraceIDRatio:
+		return sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio)), nil
+	default:
+		return nil, errors.Errorf("Unknown sampler %s", name)
+	}
+}
+
+// tracer is looked up on every use, so spans follow the current global
+// provider.
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// startSpan starts the span of a stage of a request.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err on span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// withTracing starts a server span for every request, continuing the trace
+// of the W3C trace context headers.
+func withTracing(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer().Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPRequestMethodKey.String(r.Method), semconv.URLPath(r.URL.Path)))
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(recorder, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(recorder.status))
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
+
+// withSpanRoute names the server span after the matched route, e.g.
+// GET /ipxe/{uuid}/{part}.
+func withSpanRoute(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil {
+				template = routeVariablePattern.ReplaceAllString(template, "}")
+				span := trace.SpanFromContext(r.Context())
+				span.SetName(fmt.Sprintf("%s %s", r.Method, template))
+				span.SetAttributes(semconv.HTTPRoute(template))
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
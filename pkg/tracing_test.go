@@ -0,0 +1,170 @@
+// SPDX-FileCopyrightText: 2024 SAP SE or an SAP affiliate company and IronCore contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package pkg
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel"
+	collectortracev1 "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracev1 "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	testTraceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testParentID    = "00f067aa0ba902b7"
+	testTraceparent = "00-" + testTraceID + "-" + testParentID + "-01"
+)
+
+// testCollector is an in-process OTLP/HTTP collector keeping all spans.
+type testCollector struct {
+	server *httptest.Server
+
+	mu    sync.Mutex
+	spans []*tracev1.Span
+}
+
+func newTestCollector() *testCollector {
+	c := &testCollector{}
+	c.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer GinkgoRecover()
+		Expect(r.URL.Path).To(Equal("/v1/traces"))
+
+		body, err := io.ReadAll(r.Body)
+		Expect(err).ToNot(HaveOccurred())
+		request := &collectortracev1.ExportTraceServiceRequest{}
+		Expect(proto.Unmarshal(body, request)).To(Succeed())
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, resourceSpans := range request.ResourceSpans {
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				c.spans = append(c.spans, scopeSpans.Spans...)
+			}
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		out, _ := proto.Marshal(&collectortracev1.ExportTraceServiceResponse{})
+		_, _ = w.Write(out)
+	}))
+	DeferCleanup(c.server.Close)
+	return c
+}
+
+func (c *testCollector) byName() map[string]*tracev1.Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	spans := map[string]*tracev1.Span{}
+	for _, span := range c.spans {
+		spans[span.Name] = span
+	}
+	return spans
+}
+
+func spanAttribute(span *tracev1.Span, key string) string {
+	for _, attr := range span.Attributes {
+		if attr.Key == key {
+			return attr.Value.GetStringValue()
+		}
+	}
+	return ""
+}
+
+// setupTestTracing exports spans to collector until shutdown is called.
+func setupTestTracing(collector *testCollector, sampler string) func(context.Context) error {
+	previous := otel.GetTracerProvider()
+	DeferCleanup(func() {
+		otel.SetTracerProvider(previous)
+	})
+
+	shutdown, err := SetupTracing(ctx, TracingConfig{Enabled: true, Endpoint: collector.server.URL, Sampler: sampler})
+	Expect(err).ToNot(HaveOccurred())
+	return shutdown
+}
+
+var _ = Describe("Tracing", func() {
+	ctx := context.Background()
+	SetupTestData(ctx)
+
+	It("Exports a span for each stage of a request", func() {
+		collector := newTestCollector()
+		shutdown := setupTestTracing(collector, SamplerParentBasedAlwaysOn)
+
+		req := httptest.NewRequest("GET", fmt.Sprintf("/ipxe/%s/boot", uuid), nil)
+		req.Header.Set("X-Forwarded-For", validIP1)
+		req.Header.Set("traceparent", testTraceparent)
+		rr := httptest.NewRecorder()
+		ipxe.Handler().ServeHTTP(rr, req)
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+		Expect(shutdown(ctx)).To(Succeed())
+
+		spans := collector.byName()
+		Expect(spans).To(HaveKey("GET /ipxe/{uuid}/{part}"))
+		for _, name := range []string{"getMacFromIP", "getInventory", "getConfigMap", "renderTemplate"} {
+			Expect(spans).To(HaveKey(name))
+		}
+
+		server := spans["GET /ipxe/{uuid}/{part}"]
+		Expect(hex.EncodeToString(server.TraceId)).To(Equal(testTraceID))
+		Expect(hex.EncodeToString(server.ParentSpanId)).To(Equal(testParentID))
+		Expect(spanAttribute(server, string(attrUUID))).To(Equal(uuid))
+		Expect(spanAttribute(server, string(attrPart))).To(Equal("boot"))
+		Expect(spanAttribute(server, string(attrOutcome))).To(Equal(outcomeServed))
+		Expect(spanAttribute(server, string(attrSource))).To(Equal(sourceMachineConfigMap))
+
+		Expect(spans["getInventory"].ParentSpanId).To(Equal(server.SpanId))
+		Expect(spanAttribute(spans["getInventory"], string(attrUUID))).To(Equal(uuid))
+		Expect(spanAttribute(spans["getMacFromIP"], string(attrMAC))).To(Equal("08c0eba29904"))
+	})
+
+	It("Records errors of stages", func() {
+		collector := newTestCollector()
+		shutdown := setupTestTracing(collector, SamplerAlwaysOn)
+
+		rr := serveRequest(ipxe.Handler(), fmt.Sprintf("/ipxe/%s/boot", badUUID))
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusNotFound))
+		Expect(shutdown(ctx)).To(Succeed())
+
+		spans := collector.byName()
+		Expect(spans).To(HaveKey("getInventory"))
+		Expect(spans["getInventory"].Status.Code).To(Equal(tracev1.Status_STATUS_CODE_ERROR))
+		Expect(spanAttribute(spans["GET /ipxe/{uuid}/{part}"], string(attrOutcome))).To(Equal(outcomeNotFound))
+	})
+
+	It("Follows the sampler", func() {
+		collector := newTestCollector()
+		shutdown := setupTestTracing(collector, SamplerParentBasedAlwaysOff)
+
+		rr := serveRequest(ipxe.Handler(), fmt.Sprintf("/ipxe/%s/boot", uuid))
+		Expect(rr.Code).Should(BeNumerically("==", http.StatusOK))
+		req := httptest.NewRequest("GET", "/-/ready", nil)
+		req.Header.Set("traceparent", testTraceparent)
+		ipxe.Handler().ServeHTTP(httptest.NewRecorder(), req)
+		Expect(shutdown(ctx)).To(Succeed())
+
+		spans := collector.byName()
+		Expect(spans).To(HaveLen(1))
+		Expect(spans).To(HaveKey("GET"))
+	})
+
+	It("Validates the sampler", func() {
+		for _, sampler := range []string{"", SamplerAlwaysOn, SamplerAlwaysOff, SamplerTraceIDRatio,
+			SamplerParentBasedAlwaysOn, SamplerParentBasedAlwaysOff, SamplerParentBasedTraceIDRatio} {
+			_, err := newSampler(sampler, 0.5)
+			Expect(err).ToNot(HaveOccurred())
+		}
+		_, err := newSampler("unknown", 0)
+		Expect(err).To(HaveOccurred())
+		_, err = newSampler(SamplerTraceIDRatio, 2)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -4,18 +4,17 @@
 package pkg
 
 import (
+	"context"
 	"encoding/hex"
-	"fmt"
-	"log"
 	"net"
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	buconfig "github.com/coreos/butane/config"
 	"github.com/coreos/butane/config/common"
 	inventoryv1alpha4 "github.com/ironcore-dev/metal/apis/metal/v1alpha4"
-	"github.com/pkg/errors"
 )
 
 func getIPVersion(s string) string {
@@ -42,6 +41,12 @@ func getLongIPv6(ip net.IP) string {
 	return strings.ReplaceAll(longIpv6, ":", "-")
 }
 
+// macLabelValue formats mac as used in the mac label of IPAM IPs and the
+// mac address labels of Inventories, e.g. 08c0eba29904.
+func macLabelValue(mac net.HardwareAddr) string {
+	return strings.ReplaceAll(mac.String(), ":", "")
+}
+
 func doesFileExist(fileName string) bool {
 	_, err := os.Stat(fileName)
 	// check if error is "file not exists"
@@ -52,7 +57,15 @@ func doesFileExist(fileName string) bool {
 	}
 }
 
-func renderButane(dataIn []byte) (string, error) {
+func renderButane(ctx context.Context, dataIn []byte) (_ string, err error) {
+	_, span := startSpan(ctx, "renderButane")
+	start := time.Now()
+	result := "success"
+	defer func() {
+		butaneRenderDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+		endSpan(span, err)
+	}()
+
 	// render by butane to json
 	options := common.TranslateBytesOptions{
 		Raw:    true,
@@ -61,34 +74,44 @@ func renderButane(dataIn []byte) (string, error) {
 	options.NoResourceAutoCompression = true
 	dataOut, _, err := buconfig.TranslateBytes(dataIn, options)
 	if err != nil {
-		log.Printf("\nError in ignition rendering.dataIn is : %+v\n", dataIn)
-		log.Printf("Error in ignition rendering: %+v", err)
-		return "", err
+		result = outcomeError
+		return "", &RenderError{Name: "butane config", Err: err}
 	}
 	return string(dataOut), nil
 }
 
-func readIpxeConfFile(part string) ([]byte, error) {
-	var ipxeData []byte
-	var err error
+func getDefaultSecretPath() string {
 	defaultSecretPath := os.Getenv("IPXE_DEFAULT_SECRET_PATH")
 	if defaultSecretPath == "" {
 		defaultSecretPath = DefaultSecretPath
 	}
-	ipxeData, err = os.ReadFile(path.Join(defaultSecretPath, part))
+	return defaultSecretPath
+}
+
+func getDefaultConfigMapPath() string {
+	defaultConfigMapPath := os.Getenv("IPXE_DEFAULT_CONFIGMAP_PATH")
+	if defaultConfigMapPath == "" {
+		defaultConfigMapPath = DefaultConfigMapPath
+	}
+	return defaultConfigMapPath
+}
+
+// readIpxeConfFile reads the default config part and returns it with its
+// source, the mounted default Secret or ConfigMap.
+func readIpxeConfFile(part string) ([]byte, string, error) {
+	ipxeData, err := os.ReadFile(path.Join(getDefaultSecretPath(), part))
+	if err == nil {
+		return ipxeData, sourceDefaultSecret, nil
+	}
+	ipxeData, err = os.ReadFile(path.Join(getDefaultConfigMapPath(), part))
 	if err != nil {
-		defaultConfigMapPath := os.Getenv("IPXE_DEFAULT_CONFIGMAP_PATH")
-		if defaultConfigMapPath == "" {
-			defaultConfigMapPath = DefaultConfigMapPath
-		}
-		ipxeData, err = os.ReadFile(path.Join(defaultConfigMapPath, part))
-		if err != nil {
-			log.Printf("Problem with default secret and configmap #%v ", err)
-			return nil, err
+		if os.IsNotExist(err) {
+			return nil, sourceNone, &KeyNotFoundError{Kind: "default config", Name: "ipxe", Key: part}
 		}
+		return nil, sourceNone, err
 	}
 
-	return ipxeData, nil
+	return ipxeData, sourceDefaultConfigMap, nil
 }
 
 func checkInventoryMac(inventory *inventoryv1alpha4.Inventory, mac string) error {
@@ -106,5 +129,5 @@ func checkInventoryMac(inventory *inventoryv1alpha4.Inventory, mac string) error
 		}
 	}
 
-	return errors.New(fmt.Sprintf("Mac %s not found for Inventory %s", mac, uuid))
+	return &MacMismatchError{MAC: mac, UUID: uuid}
 }